@@ -1,11 +1,14 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 
 	"github.com/pj/commandline_thing/pkg"
 	"github.com/spf13/cobra"
@@ -25,19 +28,50 @@ func setup(locationKey pkg.LocationKey) (*pkg.Location, pkg.StateStore, *pkg.All
 		return nil, nil, nil, fmt.Errorf("config not found: %s", locationKey)
 	}
 
+	state, err := openStateStore()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return &locationConfig, state, config, nil
+}
+
+func openStateStore() (pkg.StateStore, error) {
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
-		return nil, nil, nil, fmt.Errorf("failed to get user's home directory: %w", err)
+		return nil, fmt.Errorf("failed to get user's home directory: %w", err)
 	}
 
 	stateDBPath := filepath.Join(homeDir, ".config", "commandline_thing", "state.db")
 
 	state, err := pkg.NewSQLiteState(stateDBPath)
 	if err != nil {
-		return nil, nil, nil, fmt.Errorf("failed to create state: %w", err)
+		return nil, fmt.Errorf("failed to create state: %w", err)
 	}
 
-	return &locationConfig, state, config, nil
+	return state, nil
+}
+
+// callDaemon forwards req, along with this process's environment, to a
+// running daemon. handled is false when no daemon is listening, in which case
+// the caller should do the work in-process.
+func callDaemon(req pkg.DaemonRequest) (content string, handled bool, err error) {
+	socketPath, err := pkg.DaemonSocketPath()
+	if err != nil {
+		return "", false, nil
+	}
+	req.Env = pkg.ClientEnvironment()
+	req.PID = os.Getpid()
+	uid := os.Geteuid()
+	req.UID = &uid
+	req.User = pkg.CurrentUsername()
+
+	content, err = pkg.CallDaemon(socketPath, req)
+	if errors.Is(err, pkg.ErrDaemonUnavailable) {
+		return "", false, nil
+	}
+
+	return content, true, err
 }
 
 func setupLogger() (*log.Logger, error) {
@@ -56,22 +90,43 @@ func setupLogger() (*log.Logger, error) {
 	return logger, nil
 }
 
-func runPostCommands(config *pkg.AllConfigs, logger *log.Logger) error {
-	for _, postCommand := range config.PostCommands {
-		cmd := exec.Command("sh", "-c", postCommand)
-		logger.Printf("running post command: %s", postCommand)
-		cmd.Stdout = logger.Writer()
-		cmd.Stderr = logger.Writer()
-		err := cmd.Start()
-		if err != nil {
-			logger.Printf("failed to run post command %s: %s", postCommand, err)
-			return err
-		}
+// startBackgroundUpdate runs `update` in a detached child process and returns
+// without waiting for it.
+func startBackgroundUpdate(locationKey pkg.LocationKey, instanceKey pkg.InstanceKey, locationPath string, asyncOnly bool) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
 	}
 
-	return nil
+	args := []string{"update", string(locationKey), string(instanceKey), locationPath}
+	if asyncOnly {
+		args = append(args, "--async-only")
+	}
+	updateCommand := exec.Command(executable, args...)
+	return updateCommand.Start()
+}
+
+// parseInstanceKey is pkg.ParseInstanceKey, logging a deprecation warning
+// for keys without a kind (see instanceKeyHelp).
+func parseInstanceKey(logger *log.Logger, key string) (pkg.Instance, error) {
+	instance, err := pkg.ParseInstanceKey(pkg.InstanceKey(key))
+	if err == nil && pkg.IsLegacyInstanceKey(instance.Key) {
+		logger.Printf("instance key %q has no kind, which is deprecated: use %q instead, or the bindings from \"init tmux\"", key, "tmux."+key)
+	}
+	return instance, err
 }
 
+// instanceKeyHelp describes the <instance> argument most commands take.
+const instanceKeyHelp = `<instance> identifies the tmux pane, zellij pane or shell being rendered:
+
+  tmux.[<socket>.][$<session>.][@<window>.][%<pane>]   e.g. tmux.%3
+  zellij.[<session>.]<pane id>                         e.g. zellij.main.2
+  shell.[<tty>.]<pid>, or just <pid>                   e.g. shell.1234
+
+Keys without a kind, such as "$1.%3" or "%3" in older tmux configs, are
+still read as tmux keys but are deprecated, and logged as such: use
+tmux.#{pane_id} instead, or the bindings from "init tmux".`
+
 func main() {
 	var rootCmd = &cobra.Command{
 		Use:   "commandline_thing",
@@ -79,9 +134,11 @@ func main() {
 		Long:  `Generate various things related to tmux`,
 	}
 
+	var columns int
 	var generateCmd = &cobra.Command{
-		Use:   "generate",
+		Use:   "generate <location> <instance> <path>",
 		Short: `Generate content for a location`,
+		Long:  "Generate content for a location.\n\n" + instanceKeyHelp,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			logger, err := setupLogger()
 			if err != nil {
@@ -90,15 +147,43 @@ func main() {
 			}
 
 			locationKey := pkg.LocationKey(args[0])
+			instance, err := parseInstanceKey(logger, args[1])
+			if err != nil {
+				logger.Printf("failed to parse instance: %s", err)
+				return err
+			}
+			instanceKey := instance.Key
+			locationPath := args[2]
+
+			content, handled, err := callDaemon(pkg.DaemonRequest{
+				Command:      pkg.DaemonGenerate,
+				LocationKey:  locationKey,
+				InstanceKey:  instanceKey,
+				LocationPath: locationPath,
+				Columns:      columns,
+			})
+			if handled {
+				if err != nil {
+					logger.Printf("failed to generate content via daemon: %s", err)
+					return err
+				}
+				fmt.Print(content)
+				return nil
+			}
+
 			locationConfig, stateStore, _, err := setup(locationKey)
 			if err != nil {
 				logger.Printf("failed to setup: %s", err)
 				return err
 			}
+			defer stateStore.Close()
 
-			instanceKey := pkg.InstanceKey(args[1])
-			locationPath := args[2]
-			content, err := pkg.GenerateContent(stateStore, *locationConfig, locationKey, instanceKey, locationPath)
+			refresh := func() {
+				if err := startBackgroundUpdate(locationKey, instanceKey, locationPath, true); err != nil {
+					logger.Printf("failed to start background update: %s", err)
+				}
+			}
+			content, err = pkg.GenerateContent(cmd.Context(), stateStore, *locationConfig, locationKey, instance, locationPath, columns, refresh)
 			if err != nil {
 				logger.Printf("failed to generate content: %s", err)
 				return err
@@ -111,9 +196,11 @@ func main() {
 		Args: cobra.ExactArgs(3),
 	}
 
+	var asyncOnly bool
 	var runUpdates = &cobra.Command{
-		Use:   "update",
+		Use:   "update <location> <instance> <path>",
 		Short: "run update of operatons for a location and instance",
+		Long:  "Run update of operations for a location and instance.\n\n" + instanceKeyHelp,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			logger, err := setupLogger()
 			if err != nil {
@@ -122,51 +209,89 @@ func main() {
 			}
 
 			locationKey := pkg.LocationKey(args[0])
-			locationConfig, stateStore, config, err := setup(locationKey)
+			instance, err := parseInstanceKey(logger, args[1])
 			if err != nil {
-				logger.Printf("failed to setup: %s", err)
+				logger.Printf("failed to parse instance: %s", err)
 				return err
 			}
-
-			instanceKey := pkg.InstanceKey(args[1])
+			instanceKey := instance.Key
 			locationPath := args[2]
-			err = pkg.Update(stateStore, *locationConfig, locationKey, instanceKey, locationPath)
+
+			_, handled, err := callDaemon(pkg.DaemonRequest{
+				Command:      pkg.DaemonUpdate,
+				LocationKey:  locationKey,
+				InstanceKey:  instanceKey,
+				LocationPath: locationPath,
+				AsyncOnly:    asyncOnly,
+			})
+			if handled {
+				if err != nil {
+					logger.Printf("failed to update via daemon: %s", err)
+				}
+				return err
+			}
+
+			locationConfig, stateStore, config, err := setup(locationKey)
 			if err != nil {
-				logger.Printf("failed to update: %s", err)
+				logger.Printf("failed to setup: %s", err)
 				return err
 			}
+			defer stateStore.Close()
+
+			// Update still writes back whatever succeeded when some operations
+			// fail, so post commands run either way.
+			var updateErr error
+			if asyncOnly {
+				var changed bool
+				changed, updateErr = pkg.RefreshAsync(cmd.Context(), stateStore, *locationConfig, locationKey, instance, locationPath)
+				if updateErr != nil {
+					logger.Printf("failed to update: %s", updateErr)
+				}
+				if !changed {
+					return updateErr
+				}
+			} else {
+				updateErr = pkg.Update(cmd.Context(), stateStore, *locationConfig, locationKey, instance, locationPath)
+				if updateErr != nil {
+					logger.Printf("failed to update: %s", updateErr)
+				}
+			}
 
-			err = runPostCommands(config, logger)
+			err = pkg.RunPostCommands(config, logger, instance)
 			if err != nil {
 				logger.Printf("failed to run post commands: %s", err)
 				return err
 			}
 
-			return nil
+			return updateErr
 		},
 		Args: cobra.ExactArgs(3),
 	}
 
 	var startUpdate = &cobra.Command{
-		Use:   "start-update",
+		Use:   "start-update <location> <instance> <path>",
 		Short: "start update of operatons for a location and instance in the background i.e. calls update and then returns",
+		Long:  "Start update of operations for a location and instance in the background, i.e. call update and return.\n\n" + instanceKeyHelp,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			locationKey := pkg.LocationKey(args[0])
-			instanceKey := pkg.InstanceKey(args[1])
-			locationPath := args[2]
-
-			executable, err := os.Executable()
+			logger, err := setupLogger()
 			if err != nil {
+				fmt.Println("failed to setup logger:", err)
 				return err
 			}
 
-			updateCommand := exec.Command(executable, "update", string(locationKey), string(instanceKey), locationPath)
-			err = updateCommand.Start()
+			locationKey := pkg.LocationKey(args[0])
+			instance, err := parseInstanceKey(logger, args[1])
 			if err != nil {
+				logger.Printf("failed to parse instance: %s", err)
 				return err
 			}
+			locationPath := args[2]
 
-			return nil
+			err = startBackgroundUpdate(locationKey, instance.Key, locationPath, false)
+			if err != nil {
+				logger.Printf("failed to start background update: %s", err)
+			}
+			return err
 		},
 		Args: cobra.ExactArgs(3),
 	}
@@ -180,8 +305,9 @@ func main() {
 	// }
 
 	var setState = &cobra.Command{
-		Use:   "set-state",
+		Use:   "set-state <location> <instance> <operation> <value>",
 		Short: "set state for an operation",
+		Long:  "Set state for an operation.\n\n" + instanceKeyHelp,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			logger, err := setupLogger()
 			if err != nil {
@@ -190,21 +316,42 @@ func main() {
 			}
 
 			locationKey := pkg.LocationKey(args[0])
-			_, stateStore, config, err := setup(locationKey)
+			instance, err := parseInstanceKey(logger, args[1])
+			if err != nil {
+				logger.Printf("failed to parse instance: %s", err)
+				return err
+			}
+			instanceKey := instance.Key
+			operationName := pkg.OperationName(args[2])
+
+			_, handled, err := callDaemon(pkg.DaemonRequest{
+				Command:       pkg.DaemonSetState,
+				LocationKey:   locationKey,
+				InstanceKey:   instanceKey,
+				OperationName: operationName,
+				Value:         args[3],
+			})
+			if handled {
+				if err != nil {
+					logger.Printf("failed to set state via daemon: %s", err)
+				}
+				return err
+			}
+
+			locationConfig, stateStore, config, err := setup(locationKey)
 			if err != nil {
 				logger.Printf("failed to setup: %s", err)
 				return err
 			}
+			defer stateStore.Close()
 
-			instanceKey := pkg.InstanceKey(args[1])
-			operationName := pkg.OperationName(args[2])
-			err = stateStore.Set(locationKey, instanceKey, operationName, args[3])
+			err = pkg.SetState(stateStore, *locationConfig, locationKey, instanceKey, operationName, args[3])
 			if err != nil {
 				logger.Printf("failed to set state: %s", err)
 				return err
 			}
 
-			err = runPostCommands(config, logger)
+			err = pkg.RunPostCommands(config, logger, instance)
 			if err != nil {
 				logger.Printf("failed to run post commands: %s", err)
 				return err
@@ -215,12 +362,232 @@ func main() {
 		Args: cobra.ExactArgs(4),
 	}
 
+	var daemonCmd = &cobra.Command{
+		Use:   "daemon",
+		Short: "keep config and state resident and serve generate/update/set-state over a unix socket",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			logger, err := setupLogger()
+			if err != nil {
+				fmt.Println("failed to setup logger:", err)
+				return err
+			}
+
+			pkg.KeepPluginsResident(logger)
+			defer pkg.ClosePlugins()
+
+			availableOperations := pkg.LoadAvailableOperations()
+			config, err := pkg.LoadConfig(availableOperations)
+			if err != nil {
+				logger.Printf("failed to load config: %s", err)
+				return err
+			}
+
+			stateStore, err := openStateStore()
+			if err != nil {
+				logger.Printf("failed to open state: %s", err)
+				return err
+			}
+			defer stateStore.Close()
+
+			daemon, err := pkg.NewDaemon(config, stateStore, logger)
+			if err != nil {
+				logger.Printf("failed to start daemon: %s", err)
+				return err
+			}
+
+			pkg.WatchConfig(availableOperations, func(config *pkg.AllConfigs, err error) {
+				if err == nil {
+					err = daemon.Reload(config)
+				}
+				if err != nil {
+					logger.Printf("daemon: keeping previous config, reload failed: %s", err)
+					return
+				}
+				logger.Printf("daemon: config reloaded")
+			})
+
+			socketPath, err := pkg.DaemonSocketPath()
+			if err != nil {
+				return err
+			}
+			listener, err := pkg.ListenDaemonSocket(socketPath)
+			if err != nil {
+				logger.Printf("failed to listen: %s", err)
+				return err
+			}
+			defer os.Remove(socketPath)
+
+			ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			go func() {
+				<-ctx.Done()
+				listener.Close()
+			}()
+
+			logger.Printf("daemon: listening on %s", socketPath)
+			return daemon.Serve(listener)
+		},
+		Args: cobra.NoArgs,
+	}
+
+	var clearState = &cobra.Command{
+		Use:   "clear-state <instance>",
+		Short: "forget all state for an instance, e.g. once its tmux pane or shell has gone",
+		Long:  "Forget all state for an instance, e.g. once its tmux pane or shell has gone.\n\n" + instanceKeyHelp,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			logger, err := setupLogger()
+			if err != nil {
+				fmt.Println("failed to setup logger:", err)
+				return err
+			}
+
+			instance, err := parseInstanceKey(logger, args[0])
+			if err != nil {
+				logger.Printf("failed to parse instance: %s", err)
+				return err
+			}
+			instanceKey := instance.Key
+
+			_, handled, err := callDaemon(pkg.DaemonRequest{
+				Command:     pkg.DaemonClearState,
+				InstanceKey: instanceKey,
+			})
+			if handled {
+				if err != nil {
+					logger.Printf("failed to clear state via daemon: %s", err)
+				}
+				return err
+			}
+
+			stateStore, err := openStateStore()
+			if err != nil {
+				logger.Printf("failed to open state: %s", err)
+				return err
+			}
+			defer stateStore.Close()
+
+			err = stateStore.DeleteInstance(instanceKey)
+			if err != nil {
+				logger.Printf("failed to clear state: %s", err)
+				return err
+			}
+			return nil
+		},
+		Args: cobra.ExactArgs(1),
+	}
+
+	var initLocation, initRightLocation, initStatusLocation, initPaneLocation string
+	tmuxInitOptions := func() (pkg.TmuxInitOptions, error) {
+		executable, err := os.Executable()
+		if err != nil {
+			return pkg.TmuxInitOptions{}, err
+		}
+		return pkg.TmuxInitOptions{
+			Executable:     executable,
+			StatusLocation: pkg.LocationKey(initStatusLocation),
+			PaneLocation:   pkg.LocationKey(initPaneLocation),
+		}, nil
+	}
+
+	var initCmd = &cobra.Command{
+		Use:       "init <shell|tmux>",
+		Short:     "print a script wiring zsh, bash, fish or tmux up to commandline_thing, to eval or source from its rc file",
+		ValidArgs: append(pkg.ShellInitShells, "tmux"),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if args[0] == "tmux" {
+				options, err := tmuxInitOptions()
+				if err != nil {
+					return err
+				}
+				fmt.Print(pkg.TmuxInit(options))
+				return nil
+			}
+
+			executable, err := os.Executable()
+			if err != nil {
+				return err
+			}
+
+			script, err := pkg.ShellInit(args[0], pkg.ShellInitOptions{
+				Executable:    executable,
+				Location:      pkg.LocationKey(initLocation),
+				RightLocation: pkg.LocationKey(initRightLocation),
+			})
+			if err != nil {
+				return err
+			}
+
+			fmt.Print(script)
+			return nil
+		},
+		Args: cobra.ExactArgs(1),
+	}
+
+	var installCmd = &cobra.Command{
+		Use:       "install tmux",
+		Short:     "apply the tmux integration (see init tmux) to the running tmux server",
+		ValidArgs: []string{"tmux"},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			options, err := tmuxInitOptions()
+			if err != nil {
+				return err
+			}
+			return pkg.InstallTmux(cmd.Context(), options)
+		},
+		Args: cobra.MatchAll(cobra.ExactArgs(1), cobra.OnlyValidArgs),
+	}
+
+	var checkCmd = &cobra.Command{
+		Use:   "check [config file]",
+		Short: "validate the config: operations, their settings and templates",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			path, err := pkg.ConfigPath()
+			if err != nil {
+				return err
+			}
+			if len(args) > 0 {
+				path = args[0]
+			}
+
+			problems, err := pkg.CheckConfig(cmd.Context(), path, pkg.LoadAvailableOperations())
+			if err != nil {
+				return err
+			}
+			for _, problem := range problems {
+				fmt.Println(problem)
+			}
+			if len(problems) > 0 {
+				cmd.SilenceUsage = true
+				return fmt.Errorf("%d problem(s) found in %s", len(problems), path)
+			}
+			fmt.Printf("%s: ok\n", path)
+			return nil
+		},
+		Args: cobra.MaximumNArgs(1),
+	}
+
+	runUpdates.Flags().BoolVar(&asyncOnly, "async-only", false, "only recompute async operations' cached results, and only run post commands if they changed (what generate runs in the background)")
+	generateCmd.Flags().IntVar(&columns, "columns", 0, "width the output has to fit in, 0 if unknown (the scripts from init pass the tmux pane's or terminal's width)")
+
+	initCmd.Flags().StringVar(&initLocation, "location", "prompt", "location rendered as the prompt")
+	initCmd.Flags().StringVar(&initRightLocation, "right-location", "", "location rendered as the right prompt (zsh and fish)")
+	for _, c := range []*cobra.Command{initCmd, installCmd} {
+		c.Flags().StringVar(&initStatusLocation, "status-location", "status", "location rendered as tmux's second status line, empty for none")
+		c.Flags().StringVar(&initPaneLocation, "pane-location", "pane", "location rendered in tmux pane borders, empty for none")
+	}
+
 	rootCmd.AddCommand(runUpdates)
+	rootCmd.AddCommand(daemonCmd)
+	rootCmd.AddCommand(initCmd)
+	rootCmd.AddCommand(installCmd)
+	rootCmd.AddCommand(clearState)
+	rootCmd.AddCommand(checkCmd)
 	// rootCmd.AddCommand(printDefaults)
 	rootCmd.AddCommand(generateCmd)
 	rootCmd.AddCommand(setState)
 	rootCmd.AddCommand(startUpdate)
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
+		os.Exit(1)
 	}
 }
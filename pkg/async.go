@@ -0,0 +1,90 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// AsyncRefreshInterval is how old an async operation's cached result may get
+// before a render asks for it to be recomputed in the background. Renders in
+// between just reuse the cached value, so a burst of redraws (e.g. tmux
+// refreshing every pane at once) triggers at most one refresh.
+const AsyncRefreshInterval = 2 * time.Second
+
+// cachedResult is what Update stores for an async operation: the value its
+// Generate() returned and when. The value goes through JSON, and is decoded
+// back into the operation's result type if it has one (see ResultTyper), so
+// templates see the same GitResult, ints and methods as they would if it had
+// been generated during the render. If Generate() failed, Value is nil and
+// Error is what renders as {{ .errors.<name> }}.
+type cachedResult struct {
+	Value       interface{} `json:"value"`
+	Error       string      `json:"error,omitempty"`
+	GeneratedAt time.Time   `json:"generatedAt"`
+}
+
+// asyncCacheKey is the state-store key an async operation's generated value is
+// kept under, next to (not instead of) the operation's own state.
+func asyncCacheKey(operationName OperationName) OperationName {
+	return operationName + "@generated"
+}
+
+func loadCachedResult(state StateStore, locationKey LocationKey, instanceKey InstanceKey, op Operation) (*cachedResult, error) {
+	raw, err := state.Get(locationKey, instanceKey, asyncCacheKey(op.Name()))
+	if err != nil {
+		return nil, err
+	}
+	if raw == "" {
+		return nil, nil
+	}
+
+	var stored struct {
+		cachedResult
+		Value json.RawMessage `json:"value"`
+	}
+	if err := json.Unmarshal([]byte(raw), &stored); err != nil {
+		// A corrupt entry is as good as a missing one: the next refresh
+		// overwrites it.
+		return nil, nil
+	}
+	cached := stored.cachedResult
+	var typ reflect.Type
+	if typer, ok := op.(ResultTyper); ok {
+		typ = typer.ResultType()
+	}
+	cached.Value = decodeCachedValue(stored.Value, typ)
+	return &cached, nil
+}
+
+// decodeCachedValue decodes a cached value as typ, or as whatever JSON
+// gives if typ is nil or the value isn't one (e.g. nil for "nothing").
+func decodeCachedValue(raw json.RawMessage, typ reflect.Type) interface{} {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil
+	}
+	if typ != nil {
+		value := reflect.New(typ)
+		if err := json.Unmarshal(raw, value.Interface()); err == nil {
+			return value.Elem().Interface()
+		}
+	}
+	var value interface{}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return nil
+	}
+	return value
+}
+
+func storeCachedResult(state StateStore, locationKey LocationKey, instanceKey InstanceKey, operationName OperationName, cached cachedResult) error {
+	raw, err := json.Marshal(cached)
+	if err != nil {
+		return fmt.Errorf("error encoding cached result: %w", err)
+	}
+	return state.Set(locationKey, instanceKey, asyncCacheKey(operationName), string(raw))
+}
+
+func (c *cachedResult) isStale(now time.Time) bool {
+	return c == nil || now.Sub(c.GeneratedAt) >= AsyncRefreshInterval
+}
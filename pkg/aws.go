@@ -0,0 +1,193 @@
+package pkg
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// AWSResult is the effective AWS CLI profile, exposed to templates as .aws.
+// Printing it directly ({{ .aws }}) gives the profile.
+type AWSResult struct {
+	Profile string
+	Region  string
+	// Credentials is where the profile's credentials come from: "sso",
+	// "assume_role", "credential_process", "static", "environment" (keys in
+	// AWS_ACCESS_KEY_ID, which win over any profile), or "" if none are
+	// configured.
+	Credentials string
+	// Expires is when the cached SSO token behind the profile runs out, or
+	// the zero time if that can't be read locally. credential_process
+	// output isn't cached by the CLI, so it never has one.
+	Expires time.Time
+	Expired bool
+}
+
+func (r AWSResult) String() string {
+	return r.Profile
+}
+
+// awsFile is where an AWS CLI file lives: the environment variable's value,
+// or ~/.aws/<name>.
+func awsFile(getenv func(string) string, envVar, name string) (string, error) {
+	if path := getenv(envVar); path != "" {
+		return path, nil
+	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(homeDir, ".aws", name), nil
+}
+
+// readAWSFile parses an AWS CLI file, treating a missing one as empty.
+func readAWSFile(getenv func(string) string, envVar, name string) (iniFile, error) {
+	path, err := awsFile(getenv, envVar, name)
+	if err != nil {
+		return nil, err
+	}
+	file, err := parseINI(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return iniFile{}, nil
+	}
+	return file, err
+}
+
+// awsProfileSection is a profile's section name in ~/.aws/config, which
+// prefixes every profile but the default with "profile ".
+func awsProfileSection(profile string) string {
+	if profile == "default" {
+		return "default"
+	}
+	return "profile " + profile
+}
+
+// awsProfileChain is the profile followed by its source_profile ancestors,
+// stopping at the first repeat so a misconfigured cycle can't loop forever.
+func awsProfileChain(config iniFile, profile string) []string {
+	chain := []string{}
+	seen := map[string]bool{}
+	for profile != "" && !seen[profile] {
+		seen[profile] = true
+		chain = append(chain, profile)
+		profile = config.get(awsProfileSection(profile), "source_profile")
+	}
+	return chain
+}
+
+// awsSSOCacheFile is where the CLI caches the token for an SSO login: named
+// after the SHA-1 of the sso-session name, or of the start URL for legacy
+// profiles without one.
+func awsSSOCacheFile(key string) (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	sum := sha1.Sum([]byte(key))
+	return filepath.Join(homeDir, ".aws", "sso", "cache", hex.EncodeToString(sum[:])+".json"), nil
+}
+
+// awsSSOExpiry reads a cached SSO token's expiry, or the zero time if there
+// is no readable token.
+func awsSSOExpiry(key string) time.Time {
+	path, err := awsSSOCacheFile(key)
+	if err != nil {
+		return time.Time{}
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return time.Time{}
+	}
+	var token struct {
+		ExpiresAt string `json:"expiresAt"`
+	}
+	if err := json.Unmarshal(content, &token); err != nil {
+		return time.Time{}
+	}
+	// The CLI has written both RFC 3339 and "2006-01-02T15:04:05UTC".
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05UTC"} {
+		if expires, err := time.Parse(layout, token.ExpiresAt); err == nil {
+			return expires
+		}
+	}
+	return time.Time{}
+}
+
+// readAWSConfig resolves the effective profile, region and credentials the
+// way the AWS CLI would, from the environment and the CLI's config and
+// credentials files. It returns nil if there's neither a selected profile
+// nor any AWS configuration to speak of.
+func readAWSConfig(getenv func(string) string, now time.Time) (*AWSResult, error) {
+	config, err := readAWSFile(getenv, "AWS_CONFIG_FILE", "config")
+	if err != nil {
+		return nil, err
+	}
+	credentials, err := readAWSFile(getenv, "AWS_SHARED_CREDENTIALS_FILE", "credentials")
+	if err != nil {
+		return nil, err
+	}
+
+	profile := getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = getenv("AWS_DEFAULT_PROFILE")
+	}
+	if profile == "" {
+		profile = "default"
+		_, inConfig := config["default"]
+		_, inCredentials := credentials["default"]
+		if !inConfig && !inCredentials && getenv("AWS_ACCESS_KEY_ID") == "" {
+			return nil, nil
+		}
+	}
+
+	result := &AWSResult{Profile: profile}
+	chain := awsProfileChain(config, profile)
+
+	result.Region = getenv("AWS_REGION")
+	if result.Region == "" {
+		result.Region = getenv("AWS_DEFAULT_REGION")
+	}
+	for _, p := range chain {
+		if result.Region != "" {
+			break
+		}
+		result.Region = config.get(awsProfileSection(p), "region")
+	}
+
+	section := awsProfileSection(profile)
+	switch {
+	case getenv("AWS_ACCESS_KEY_ID") != "":
+		result.Credentials = "environment"
+	case config.get(section, "role_arn") != "":
+		result.Credentials = "assume_role"
+	case config.get(section, "sso_session") != "" || config.get(section, "sso_start_url") != "":
+		result.Credentials = "sso"
+	case config.get(section, "credential_process") != "":
+		result.Credentials = "credential_process"
+	case credentials.get(profile, "aws_access_key_id") != "" || config.get(section, "aws_access_key_id") != "":
+		result.Credentials = "static"
+	}
+
+	if result.Credentials == "sso" || result.Credentials == "assume_role" {
+		// A role is only as fresh as the SSO login at the root of its
+		// source_profile chain, if there is one.
+		for _, p := range chain {
+			s := awsProfileSection(p)
+			key := config.get(s, "sso_session")
+			if key == "" {
+				key = config.get(s, "sso_start_url")
+			}
+			if key != "" {
+				result.Expires = awsSSOExpiry(key)
+				break
+			}
+		}
+	}
+	result.Expired = !result.Expires.IsZero() && !now.Before(result.Expires)
+
+	return result, nil
+}
@@ -0,0 +1,115 @@
+package pkg
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// clearAWSEnv points HOME and the AWS CLI files at a fresh directory and
+// unsets the variables that would otherwise leak in from the environment.
+func clearAWSEnv(t *testing.T) string {
+	t.Helper()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(home, "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(home, "credentials"))
+	for _, name := range []string{"AWS_PROFILE", "AWS_DEFAULT_PROFILE", "AWS_REGION", "AWS_DEFAULT_REGION", "AWS_ACCESS_KEY_ID"} {
+		t.Setenv(name, "")
+	}
+	return home
+}
+
+func TestAWSNotConfigured(t *testing.T) {
+	clearAWSEnv(t)
+
+	result, err := (&AWS{}).Generate(context.Background(), "pane", testTmuxInstance, "/tmp", "")
+	require.NoError(t, err)
+	require.Nil(t, result)
+}
+
+func TestAWSStaticDefaultProfile(t *testing.T) {
+	home := clearAWSEnv(t)
+	writeTestFile(t, filepath.Join(home, "config"), "[default]\nregion = us-west-2\n")
+	writeTestFile(t, filepath.Join(home, "credentials"), "[default]\naws_access_key_id = AKIA\naws_secret_access_key = secret\n")
+
+	result, err := (&AWS{}).Generate(context.Background(), "pane", testTmuxInstance, "/tmp", "")
+	require.NoError(t, err)
+	require.Equal(t, AWSResult{Profile: "default", Region: "us-west-2", Credentials: "static"}, result)
+
+	t.Setenv("AWS_REGION", "eu-west-1")
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIAENV")
+	result, err = (&AWS{}).Generate(context.Background(), "pane", testTmuxInstance, "/tmp", "")
+	require.NoError(t, err)
+	require.Equal(t, "eu-west-1", result.(AWSResult).Region)
+	require.Equal(t, "environment", result.(AWSResult).Credentials)
+}
+
+func TestAWSRoleInheritsRegionAndSSOExpiryThroughSourceProfile(t *testing.T) {
+	home := clearAWSEnv(t)
+	t.Setenv("AWS_PROFILE", "admin")
+	writeTestFile(t, filepath.Join(home, "config"), `[profile admin]
+role_arn = arn:aws:iam::123456789012:role/admin
+source_profile = sso
+
+[profile sso]
+sso_session = corp
+sso_account_id = 123456789012
+region = ap-southeast-2
+
+[sso-session corp]
+sso_start_url = https://corp.awsapps.com/start
+`)
+	cacheFile, err := awsSSOCacheFile("corp")
+	require.NoError(t, err)
+	writeTestFile(t, cacheFile, `{"accessToken": "x", "expiresAt": "2030-01-02T03:04:05Z"}`)
+
+	result, err := readAWSConfig(os.Getenv, time.Date(2029, 1, 1, 0, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	require.Equal(t, "admin", result.String())
+	require.Equal(t, "ap-southeast-2", result.Region)
+	require.Equal(t, "assume_role", result.Credentials)
+	require.Equal(t, time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC), result.Expires)
+	require.False(t, result.Expired)
+
+	result, err = readAWSConfig(os.Getenv, time.Date(2031, 1, 1, 0, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	require.True(t, result.Expired)
+}
+
+func TestAWSLegacySSOAndCredentialProcess(t *testing.T) {
+	home := clearAWSEnv(t)
+	writeTestFile(t, filepath.Join(home, "config"), `[profile legacy]
+sso_start_url = https://legacy.awsapps.com/start
+
+[profile proc]
+credential_process = /usr/local/bin/get-creds
+`)
+	cacheFile, err := awsSSOCacheFile("https://legacy.awsapps.com/start")
+	require.NoError(t, err)
+	writeTestFile(t, cacheFile, `{"expiresAt": "2030-01-02T03:04:05UTC"}`)
+
+	t.Setenv("AWS_DEFAULT_PROFILE", "legacy")
+	result, err := readAWSConfig(os.Getenv, time.Now())
+	require.NoError(t, err)
+	require.Equal(t, "sso", result.Credentials)
+	require.Equal(t, time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC), result.Expires)
+
+	t.Setenv("AWS_PROFILE", "proc")
+	result, err = readAWSConfig(os.Getenv, time.Now())
+	require.NoError(t, err)
+	require.Equal(t, "credential_process", result.Credentials)
+	require.True(t, result.Expires.IsZero())
+}
+
+func TestAWSProfileChainStopsOnCycle(t *testing.T) {
+	config := iniFile{
+		"profile a": {"source_profile": "b"},
+		"profile b": {"source_profile": "a"},
+	}
+	require.Equal(t, []string{"a", "b"}, awsProfileChain(config, "a"))
+}
@@ -0,0 +1,309 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/mitchellh/mapstructure"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigPath is the config file LoadConfig reads.
+func ConfigPath() (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get user's home directory: %w", err)
+	}
+	dir := filepath.Join(homeDir, ".config", "commandline_thing")
+	for _, name := range []string{"config.yaml", "config.yml"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			return filepath.Join(dir, name), nil
+		}
+	}
+	return filepath.Join(dir, "config.yaml"), nil
+}
+
+// ConfigProblem is something wrong with the config found by CheckConfig.
+// Line is 0 when the problem isn't tied to one place in the file.
+type ConfigProblem struct {
+	File     string
+	Line     int
+	Column   int
+	Location LocationKey
+	Message  string
+}
+
+func (p ConfigProblem) String() string {
+	var out strings.Builder
+	out.WriteString(p.File)
+	if p.Line > 0 {
+		fmt.Fprintf(&out, ":%d", p.Line)
+		if p.Column > 0 {
+			fmt.Fprintf(&out, ":%d", p.Column)
+		}
+	}
+	out.WriteString(": ")
+	if p.Location != "" {
+		fmt.Fprintf(&out, "%s: ", p.Location)
+	}
+	out.WriteString(p.Message)
+	return out.String()
+}
+
+// configChecker collects problems while walking the config's YAML nodes, so
+// each can be reported with where it is in the file.
+type configChecker struct {
+	file       string
+	operations Operations
+	problems   []ConfigProblem
+}
+
+func (c *configChecker) report(node *yaml.Node, location LocationKey, format string, args ...interface{}) {
+	problem := ConfigProblem{File: c.file, Location: location, Message: fmt.Sprintf(format, args...)}
+	if node != nil {
+		problem.Line, problem.Column = node.Line, node.Column
+	}
+	c.problems = append(c.problems, problem)
+}
+
+// CheckConfig validates the config file at path the way LoadConfig would
+// read it, and more strictly: it reports YAML syntax errors, unknown
+// operation types, operations that fail to configure, operations sharing a
+// name within a location, template syntax errors, and templates referring to
+// operations their location doesn't have or to fields their results don't
+// have (see analyzeTemplate). An error is only returned if the file can't be
+// read at all.
+func CheckConfig(ctx context.Context, path string, loadedOperations Operations) ([]ConfigProblem, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &configChecker{file: path, operations: loadedOperations}
+
+	var document yaml.Node
+	if err := yaml.Unmarshal(content, &document); err != nil {
+		c.problems = append(c.problems, yamlProblems(path, err)...)
+		return c.problems, nil
+	}
+	if len(document.Content) == 0 {
+		c.report(nil, "", "config is empty")
+		return c.problems, nil
+	}
+	root := document.Content[0]
+	if root.Kind != yaml.MappingNode {
+		c.report(root, "", "config must be a mapping")
+		return c.problems, nil
+	}
+	c.lowercaseKeys(root)
+
+	if plugins := mappingValue(root, "plugins"); plugins != nil {
+		c.checkPlugins(ctx, plugins)
+	}
+	configs := mappingValue(root, "configs")
+	if configs == nil {
+		c.report(root, "", "no configs")
+		return c.problems, nil
+	}
+	if configs.Kind != yaml.MappingNode {
+		c.report(configs, "", "configs must be a mapping of location names to locations")
+		return c.problems, nil
+	}
+	for i := 0; i+1 < len(configs.Content); i += 2 {
+		c.checkLocation(LocationKey(configs.Content[i].Value), configs.Content[i+1])
+	}
+	return c.problems, nil
+}
+
+// yamlLineRe finds the line numbers in yaml.v3's error messages, e.g.
+// "yaml: line 3: mapping values are not allowed in this context".
+var yamlLineRe = regexp.MustCompile(`line (\d+): `)
+
+func yamlProblems(path string, err error) []ConfigProblem {
+	var typeErr *yaml.TypeError
+	messages := []string{err.Error()}
+	if errors.As(err, &typeErr) {
+		messages = typeErr.Errors
+	}
+
+	var problems []ConfigProblem
+	for _, message := range messages {
+		problem := ConfigProblem{File: path, Message: strings.TrimPrefix(message, "yaml: ")}
+		if match := yamlLineRe.FindStringSubmatchIndex(problem.Message); match != nil {
+			problem.Line, _ = strconv.Atoi(problem.Message[match[2]:match[3]])
+			problem.Message = problem.Message[:match[0]] + problem.Message[match[1]:]
+		}
+		problems = append(problems, problem)
+	}
+	return problems
+}
+
+// lowercaseKeys lowercases every mapping key under node, as viper does when
+// LoadConfig reads the file, so that the config is checked as it will be
+// loaded: `Template:` works, and `configs: {Prompt: ...}` is the location
+// "prompt". Keys that only differ in case are reported, since viper keeps
+// whichever of them it happens to see last.
+func (c *configChecker) lowercaseKeys(node *yaml.Node) {
+	switch node.Kind {
+	case yaml.MappingNode:
+		seen := map[string]*yaml.Node{}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+			original := key.Value
+			key.Value = strings.ToLower(key.Value)
+			if first, ok := seen[key.Value]; ok {
+				c.report(key, "", "%s is the same key as %s on line %d: keys are case-insensitive", original, first.Value, first.Line)
+			} else {
+				seen[key.Value] = &yaml.Node{Value: original, Line: key.Line}
+			}
+			c.lowercaseKeys(node.Content[i+1])
+		}
+	case yaml.SequenceNode:
+		for _, item := range node.Content {
+			c.lowercaseKeys(item)
+		}
+	}
+}
+
+// mappingValue returns the value for key in a mapping node, or nil.
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func (c *configChecker) checkPlugins(ctx context.Context, node *yaml.Node) {
+	var raw []map[string]interface{}
+	if err := node.Decode(&raw); err != nil {
+		c.report(node, "", "plugins must be a list of plugins")
+		return
+	}
+	configs := make([]PluginConfig, len(raw))
+	for i, entry := range raw {
+		if err := mapstructure.Decode(entry, &configs[i]); err != nil {
+			c.report(node.Content[i], "", "plugin: %s", err)
+			return
+		}
+	}
+	operations, err := registerPlugins(ctx, c.operations, configs)
+	if err != nil {
+		c.report(node, "", "%s", err)
+		return
+	}
+	c.operations = operations
+}
+
+func (c *configChecker) checkLocation(locationKey LocationKey, node *yaml.Node) {
+	if node.Kind != yaml.MappingNode {
+		c.report(node, locationKey, "location must be a mapping")
+		return
+	}
+
+	// Result types of the operations, to check the template against. One
+	// that failed to build still counts as defined (with an unknown type)
+	// so that it's reported once rather than again for each reference.
+	defined := map[string]reflect.Type{}
+	allDefined := true
+	firstDefined := map[OperationName]*yaml.Node{}
+	if operations := mappingValue(node, "operations"); operations != nil {
+		if operations.Kind != yaml.SequenceNode {
+			c.report(operations, locationKey, "operations must be a list")
+			allDefined = false
+		} else {
+			for _, entry := range operations.Content {
+				var rawOp map[string]interface{}
+				if err := entry.Decode(&rawOp); err != nil {
+					c.report(entry, locationKey, "operation must be a mapping")
+					allDefined = false
+					continue
+				}
+				wrapper, err := newOperationWrapper(c.operations, rawOp)
+				if err != nil {
+					c.report(entry, locationKey, "%s", err)
+					if name, ok := rawOp["name"].(string); ok {
+						defined[name] = nil
+					} else if typ, ok := rawOp["type"].(string); ok {
+						defined[typ] = nil
+					} else {
+						allDefined = false
+					}
+					continue
+				}
+
+				name := wrapper.Operation.Name()
+				if first, ok := firstDefined[name]; ok {
+					c.report(entry, locationKey, "operation %s is already defined on line %d; give one of them a different `name`", name, first.Line)
+					continue
+				}
+				firstDefined[name] = entry
+				defined[string(name)] = operationResultTypes([]OperationWrapper{*wrapper})[string(name)]
+			}
+		}
+	}
+
+	var location Location
+	if dialect := mappingValue(node, "dialect"); dialect != nil {
+		location.Dialect = Dialect(dialect.Value)
+		if !location.Dialect.valid() {
+			c.report(dialect, locationKey, "unknown dialect: %s", dialect.Value)
+			return
+		}
+	}
+	templateNode := mappingValue(node, "template")
+	if templateNode != nil {
+		location.Template = templateNode.Value
+	}
+	tmpl, err := CompileTemplate(location)
+	if err != nil {
+		c.reportTemplateError(templateNode, node, locationKey, err)
+		return
+	}
+	if !allDefined {
+		return
+	}
+
+	for _, problem := range analyzeTemplate(tmpl.Tree, defined) {
+		c.problems = append(c.problems, ConfigProblem{
+			File:     c.file,
+			Line:     templateLine(templateNode, problem.Line),
+			Location: locationKey,
+			Message:  "template " + problem.Message,
+		})
+	}
+}
+
+// templateErrorRe finds the line in a template parse error, e.g.
+// "template: content:2: unexpected "}" in operand".
+var templateErrorRe = regexp.MustCompile(`template: content:(\d+):(?:\d+:)? `)
+
+func (c *configChecker) reportTemplateError(templateNode, locationNode *yaml.Node, locationKey LocationKey, err error) {
+	problem := ConfigProblem{File: c.file, Location: locationKey, Message: err.Error()}
+	problem.Line, problem.Column = locationNode.Line, locationNode.Column
+	if match := templateErrorRe.FindStringSubmatchIndex(problem.Message); templateNode != nil && match != nil {
+		line, _ := strconv.Atoi(problem.Message[match[2]:match[3]])
+		problem.Line, problem.Column = templateLine(templateNode, line), 0
+		problem.Message = problem.Message[:match[0]] + problem.Message[match[1]:]
+	}
+	c.problems = append(c.problems, problem)
+}
+
+// templateLine maps a line of a template to a line of the config file.
+// Block scalars (| and >) start on the line after their key.
+func templateLine(node *yaml.Node, line int) int {
+	if node.Style&(yaml.LiteralStyle|yaml.FoldedStyle) != 0 {
+		return node.Line + line
+	}
+	return node.Line + line - 1
+}
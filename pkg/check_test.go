@@ -0,0 +1,107 @@
+package pkg
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func checkConfigString(t *testing.T, config string) []string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(config), 0644))
+
+	problems, err := CheckConfig(context.Background(), path, LoadAvailableOperations())
+	require.NoError(t, err)
+	var out []string
+	for _, problem := range problems {
+		out = append(out, problem.String()[len(path):])
+	}
+	return out
+}
+
+func TestCheckConfigValid(t *testing.T) {
+	problems := checkConfigString(t, `
+configs:
+  prompt:
+    dialect: zsh
+    operations:
+      - type: git
+      - type: cycle
+        name: nyan
+        names: [a, b]
+    template: |
+      {{ with .git }}{{ .Branch }}{{ end }}{{ $.nyan }}
+      {{ $g := .git }}{{ with $g }}{{ .ShortCommit }}{{ end }}{{ if .errors.git }}!{{ end }}
+`)
+	require.Empty(t, problems)
+}
+
+func TestCheckConfigIgnoresKeyCaseLikeLoadConfig(t *testing.T) {
+	problems := checkConfigString(t, `Configs:
+  Prompt:
+    Operations:
+      - Type: cycle
+        Names: [a, b]
+    Template: "{{ .cycle }}"
+  prompt:
+    template: "{{ .cycle }}"
+`)
+	require.Equal(t, []string{
+		":7:3: prompt is the same key as Prompt on line 2: keys are case-insensitive",
+		":8: prompt: template refers to .cycle, which isn't an operation in this location",
+	}, problems)
+}
+
+func TestCheckConfigReportsProblems(t *testing.T) {
+	problems := checkConfigString(t, `configs:
+  prompt:
+    operations:
+      - type: cycle
+        names: [a, b]
+      - type: cycle
+        names: [c]
+      - type: nope
+      - type: duration
+        threshold: soon
+    template: |
+      {{ .cycle }} {{ .nope }}
+      {{ with .duration }}{{ .Human }}{{ end }} {{ .git.Branch }} {{ .errors.kube }}
+  status:
+    template: "{{ .foo"
+  pane:
+    dialect: klingon
+`)
+	require.Equal(t, []string{
+		":6:9: prompt: operation cycle is already defined on line 4; give one of them a different `name`",
+		":8:9: prompt: unknown operation type: nope",
+		`:9:9: prompt: configuring operation duration: duration: invalid threshold "soon": time: invalid duration "soon"`,
+		":13: prompt: template refers to .git.Branch, which isn't an operation in this location",
+		":13: prompt: template refers to .errors.kube, but kube isn't an operation in this location",
+		":15: status: error parsing template: unclosed action",
+		":17:14: pane: unknown dialect: klingon",
+	}, problems)
+}
+
+func TestCheckConfigReportsTemplateErrorLine(t *testing.T) {
+	problems := checkConfigString(t, `configs:
+  prompt:
+    template: |
+      ok
+      {{ if }}{{ end }}
+`)
+	require.Len(t, problems, 1)
+	require.Regexp(t, `^:5: prompt: error parsing template: `, problems[0])
+}
+
+func TestCheckConfigReportsYAMLErrors(t *testing.T) {
+	problems := checkConfigString(t, "configs:\n  prompt:\n    template: x\n   bad: [\n")
+	require.Len(t, problems, 1)
+	require.Regexp(t, `^:\d+: `, problems[0])
+
+	problems = checkConfigString(t, "configs:\n  prompt:\n    operations: {type: git}\n")
+	require.Equal(t, []string{":3:17: prompt: operations must be a list"}, problems)
+}
@@ -0,0 +1,197 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Command runs a shell command during Update and exposes its output, so new
+// segments can be added from YAML alone:
+//
+//   - type: command
+//     name: node_version
+//     run: node --version
+//     ttl: 1m
+//     timeout: 2s
+//     cwd: ~/src
+//     parse: text
+//
+// `name` becomes the template field and state key, as with cycle. The
+// command runs under `sh -c` in `cwd`, which defaults to the location path.
+// Its output is kept in the state store and reused until `ttl` (a duration
+// string or seconds, default 0: run on every update) has passed or the
+// directory changes. `parse` decides what templates see: the trimmed output
+// as a string ("text", the default), a list of its non-empty lines
+// ("lines"), or the decoded value ("json"). A command that fails or outputs
+// something `parse` can't read leaves the previous output in place.
+type Command struct {
+	name  string
+	run   string
+	cwd   string
+	ttl   time.Duration
+	parse string
+	// now is time.Now, swapped out in tests.
+	now func() time.Time
+}
+
+// commandState is what Command keeps in the state store.
+type commandState struct {
+	Output string    `json:"output"`
+	Cwd    string    `json:"cwd"`
+	RanAt  time.Time `json:"ranAt"`
+}
+
+func (c *Command) Name() OperationName {
+	if c.name != "" {
+		return OperationName(c.name)
+	}
+	return "command"
+}
+func (*Command) IsAsync() bool { return false }
+
+// ResultType depends on `parse`; JSON output can be anything.
+func (c *Command) ResultType() reflect.Type {
+	switch c.parse {
+	case "lines":
+		return reflect.TypeOf([]string{})
+	case "json":
+		return nil
+	default:
+		return reflect.TypeOf("")
+	}
+}
+
+func (c *Command) Configure(rawConfig map[string]interface{}) error {
+	if nameRaw, ok := rawConfig["name"]; ok {
+		name, ok := nameRaw.(string)
+		if !ok {
+			return fmt.Errorf("command: name must be a string")
+		}
+		c.name = name
+	}
+
+	run, ok := rawConfig["run"].(string)
+	if !ok || strings.TrimSpace(run) == "" {
+		return fmt.Errorf("command: run is required")
+	}
+	c.run = run
+
+	if cwdRaw, ok := rawConfig["cwd"]; ok {
+		cwd, ok := cwdRaw.(string)
+		if !ok {
+			return fmt.Errorf("command: cwd must be a string")
+		}
+		if expanded, ok := substitutePrefix(cwd, "~", userHomeDir()); ok {
+			cwd = expanded
+		}
+		c.cwd = cwd
+	}
+
+	if ttlRaw, ok := rawConfig["ttl"]; ok {
+		ttl, err := parseDuration("ttl", ttlRaw)
+		if err != nil {
+			return fmt.Errorf("command: %w", err)
+		}
+		if ttl < 0 {
+			return fmt.Errorf("command: ttl must not be negative")
+		}
+		c.ttl = ttl
+	}
+
+	c.parse = "text"
+	if parseRaw, ok := rawConfig["parse"]; ok {
+		parse, _ := parseRaw.(string)
+		switch parse {
+		case "text", "lines", "json":
+			c.parse = parse
+		default:
+			return fmt.Errorf("command: parse must be one of text, lines or json")
+		}
+	}
+	return nil
+}
+
+func (c *Command) currentTime() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+	return time.Now()
+}
+
+// parseOutput turns the command's output into what templates see.
+func (c *Command) parseOutput(output string) (interface{}, error) {
+	switch c.parse {
+	case "lines":
+		lines := []string{}
+		for _, line := range strings.Split(output, "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				lines = append(lines, line)
+			}
+		}
+		return lines, nil
+	case "json":
+		var value interface{}
+		if err := json.Unmarshal([]byte(output), &value); err != nil {
+			return nil, fmt.Errorf("output is not valid JSON: %w", err)
+		}
+		return value, nil
+	default:
+		return strings.TrimSpace(output), nil
+	}
+}
+
+func (c *Command) Update(ctx context.Context, locationPath string, state string) (string, error) {
+	cwd := c.cwd
+	if cwd == "" {
+		cwd = filepath.Clean(locationPath)
+	}
+
+	var previous commandState
+	if state != "" && json.Unmarshal([]byte(state), &previous) == nil {
+		if previous.Cwd == cwd && c.currentTime().Sub(previous.RanAt) < c.ttl {
+			return state, nil
+		}
+	}
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", c.run)
+	cmd.Dir = cwd
+	cmd.Env = instanceFrom(ctx).Environ()
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return "", fmt.Errorf("%w: %s", err, message)
+		}
+		return "", err
+	}
+
+	output := stdout.String()
+	if _, err := c.parseOutput(output); err != nil {
+		return "", err
+	}
+
+	next, err := json.Marshal(commandState{Output: output, Cwd: cwd, RanAt: c.currentTime()})
+	if err != nil {
+		return "", err
+	}
+	return string(next), nil
+}
+
+func (c *Command) Generate(ctx context.Context, locationKey LocationKey, instance Instance, locationPath string, state string) (interface{}, error) {
+	if state == "" {
+		return "", nil
+	}
+	var current commandState
+	if err := json.Unmarshal([]byte(state), &current); err != nil {
+		return nil, fmt.Errorf("invalid state: %w", err)
+	}
+	return c.parseOutput(current.Output)
+}
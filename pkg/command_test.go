@@ -0,0 +1,116 @@
+package pkg
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func mustConfiguredCommand(t *testing.T, rawConfig map[string]interface{}) *Command {
+	t.Helper()
+	c := &Command{}
+	require.NoError(t, c.Configure(rawConfig))
+	return c
+}
+
+func TestCommandRunsInLocationPathAndParsesOutput(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a"), nil, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "b"), nil, 0644))
+
+	cases := map[string]interface{}{
+		"text":  "a\nb",
+		"lines": []string{"a", "b"},
+	}
+	for parse, expected := range cases {
+		op := mustConfiguredCommand(t, map[string]interface{}{"name": "files", "run": "ls", "parse": parse})
+		require.Equal(t, OperationName("files"), op.Name())
+
+		state, err := op.Update(context.Background(), dir, "")
+		require.NoError(t, err)
+		result, err := op.Generate(context.Background(), "prompt", testShellInstance, dir, state)
+		require.NoError(t, err)
+		require.Equal(t, expected, result, parse)
+	}
+
+	op := mustConfiguredCommand(t, map[string]interface{}{"run": `echo '{"version": "1.2", "count": 3}'`, "parse": "json"})
+	state, err := op.Update(context.Background(), dir, "")
+	require.NoError(t, err)
+	result, err := op.Generate(context.Background(), "prompt", testShellInstance, dir, state)
+	require.NoError(t, err)
+	require.Equal(t, map[string]interface{}{"version": "1.2", "count": float64(3)}, result)
+}
+
+func TestCommandReusesOutputWithinTTL(t *testing.T) {
+	dir := t.TempDir()
+	counter := filepath.Join(dir, "counter")
+	now := time.Unix(1000, 0)
+	op := mustConfiguredCommand(t, map[string]interface{}{"run": "echo x >> counter; wc -l < counter", "ttl": "1m"})
+	op.now = func() time.Time { return now }
+
+	run := func(path, state string) string {
+		t.Helper()
+		state, err := op.Update(context.Background(), path, state)
+		require.NoError(t, err)
+		return state
+	}
+
+	state := run(dir, "")
+	state = run(dir, state)
+	result, err := op.Generate(context.Background(), "prompt", testShellInstance, dir, state)
+	require.NoError(t, err)
+	require.Equal(t, "1", result, "within the ttl the command isn't run again")
+
+	now = now.Add(2 * time.Minute)
+	state = run(dir, state)
+	result, err = op.Generate(context.Background(), "prompt", testShellInstance, dir, state)
+	require.NoError(t, err)
+	require.Equal(t, "2", result)
+
+	other := t.TempDir()
+	state = run(other, state)
+	result, err = op.Generate(context.Background(), "prompt", testShellInstance, other, state)
+	require.NoError(t, err)
+	require.Equal(t, "1", result, "a different directory invalidates the cached output")
+
+	content, err := os.ReadFile(counter)
+	require.NoError(t, err)
+	require.Equal(t, 2, strings.Count(string(content), "x"))
+}
+
+func TestCommandFailureReportsStderr(t *testing.T) {
+	op := mustConfiguredCommand(t, map[string]interface{}{"run": "echo nope >&2; exit 3"})
+	_, err := op.Update(context.Background(), t.TempDir(), "")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "nope")
+
+	op = mustConfiguredCommand(t, map[string]interface{}{"run": "echo not json", "parse": "json"})
+	_, err = op.Update(context.Background(), t.TempDir(), "")
+	require.Error(t, err, "output that can't be parsed doesn't replace the previous output")
+}
+
+func TestCommandTimesOutThroughOperationTimeout(t *testing.T) {
+	store := NewMemoryStateStore()
+	config := Location{Operations: []OperationWrapper{{
+		Operation: mustConfiguredCommand(t, map[string]interface{}{"name": "slow", "run": "sleep 5"}),
+		Timeout:   50 * time.Millisecond,
+	}}}
+
+	err := Update(context.Background(), store, config, "prompt", testShellInstance, t.TempDir())
+	require.ErrorIs(t, err, ErrOperationTimeout)
+}
+
+func TestCommandConfigure(t *testing.T) {
+	require.Error(t, (&Command{}).Configure(map[string]interface{}{"name": "x"}), "run is required")
+	require.Error(t, (&Command{}).Configure(map[string]interface{}{"run": "true", "parse": "yaml"}))
+	require.Error(t, (&Command{}).Configure(map[string]interface{}{"run": "true", "ttl": "soon"}))
+
+	op := mustConfiguredCommand(t, map[string]interface{}{"run": "true", "cwd": "~/src", "ttl": 30})
+	require.Equal(t, filepath.Join(userHomeDir(), "src"), op.cwd)
+	require.Equal(t, 30*time.Second, op.ttl)
+}
@@ -1,15 +1,34 @@
 package pkg
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"reflect"
+	"time"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/mitchellh/mapstructure"
 	"github.com/spf13/viper"
 )
 
 type OperationWrapper struct {
 	Operation Operation
+	// Timeout bounds each Update/Generate call, from the entry's `timeout`
+	// (e.g. "500ms"). Zero means DefaultOperationTimeout.
+	Timeout time.Duration
+	// Placeholder is rendered in place of the operation's result when it
+	// times out, from the entry's `placeholder`. Nil if not configured, in
+	// which case it renders like any other failure (see zeroResult).
+	Placeholder interface{}
+}
+
+// timeout returns the effective per-call timeout for the operation.
+func (w OperationWrapper) timeout() time.Duration {
+	if w.Timeout > 0 {
+		return w.Timeout
+	}
+	return DefaultOperationTimeout
 }
 
 var availableOperations Operations
@@ -65,42 +84,67 @@ func OperationWrapperDecodeHook() mapstructure.DecodeHookFuncType {
 			return nil, fmt.Errorf("invalid input type for OperationWrapper")
 		}
 
-		typRaw, ok := rawOp["type"]
-		if !ok {
-			return nil, fmt.Errorf("operation type not specified")
-		}
+		return newOperationWrapper(availableOperations, rawOp)
+	}
+}
 
-		typ, ok := typRaw.(string)
-		if !ok {
-			return nil, fmt.Errorf("operation type is not a string")
-		}
+// newOperationWrapper builds the operation described by a config entry,
+// looking its type up in operations.
+func newOperationWrapper(operations Operations, rawOp map[string]interface{}) (*OperationWrapper, error) {
+	typRaw, ok := rawOp["type"]
+	if !ok {
+		return nil, fmt.Errorf("operation type not specified")
+	}
 
-		opName := OperationName(typ)
-		newOperation, ok := availableOperations[opName]
-		if !ok {
-			return nil, fmt.Errorf("unknown operation type: %s", typ)
-		}
+	typ, ok := typRaw.(string)
+	if !ok {
+		return nil, fmt.Errorf("operation type is not a string")
+	}
 
-		op := newOperation()
-		if configurable, ok := op.(Configurable); ok {
-			if err := configurable.Configure(rawOp); err != nil {
-				return nil, fmt.Errorf("configuring operation %s: %w", typ, err)
-			}
-		}
-		wrapper := &OperationWrapper{Operation: op}
+	opName := OperationName(typ)
+	newOperation, ok := operations[opName]
+	if !ok {
+		return nil, fmt.Errorf("unknown operation type: %s", typ)
+	}
 
-		return wrapper, nil
+	op := newOperation()
+	if configurable, ok := op.(Configurable); ok {
+		if err := configurable.Configure(rawOp); err != nil {
+			return nil, fmt.Errorf("configuring operation %s: %w", typ, err)
+		}
+	}
+	wrapper := &OperationWrapper{Operation: op}
+	if timeoutRaw, ok := rawOp["timeout"]; ok {
+		timeout, err := parseTimeout(timeoutRaw)
+		if err != nil {
+			return nil, fmt.Errorf("operation %s: %w", typ, err)
+		}
+		wrapper.Timeout = timeout
+	}
+	if placeholder, ok := rawOp["placeholder"]; ok {
+		wrapper.Placeholder = placeholder
 	}
+
+	return wrapper, nil
 }
 
 type Location struct {
 	Operations []OperationWrapper `mapstructure:"operations"`
 	Template   string             `mapstructure:"template"`
+	// Dialect is what the output is consumed by (tmux, zsh, ...), see Dialect.
+	Dialect Dialect `mapstructure:"dialect"`
+	// Strict makes reading anything the render data doesn't have an error
+	// instead of "<no value>", including fields of an operation that
+	// rendered nothing, so guard those with {{ with }}. The template is
+	// also checked against the operations' result types when compiled.
+	Strict bool `mapstructure:"strict"`
 }
 
 type AllConfigs struct {
 	Configs      map[LocationKey]Location `mapstructure:"configs"`
 	PostCommands []string                 `mapstructure:"postCommands"`
+	// Plugins are external operations, see PluginConfig.
+	Plugins []PluginConfig `mapstructure:"plugins"`
 }
 
 func LoadConfig(loadedOperations Operations) (*AllConfigs, error) {
@@ -110,15 +154,38 @@ func LoadConfig(loadedOperations Operations) (*AllConfigs, error) {
 	viper.AddConfigPath("$HOME/.config/commandline_thing")
 	err := viper.ReadInConfig()
 	if err != nil {
-		return nil, fmt.Errorf("no config file found, create one at $HOME/.config/commandline_thing")
+		var notFound viper.ConfigFileNotFoundError
+		if errors.As(err, &notFound) {
+			return nil, fmt.Errorf("no config file found, create one at $HOME/.config/commandline_thing")
+		}
+		return nil, fmt.Errorf("reading config (run `commandline_thing check` for details): %w", err)
+	}
+
+	var pluginConfigs []PluginConfig
+	if err := viper.UnmarshalKey("plugins", &pluginConfigs); err != nil {
+		return nil, fmt.Errorf("plugins: %w", err)
+	}
+	availableOperations, err = registerPlugins(context.Background(), loadedOperations, pluginConfigs)
+	if err != nil {
+		return nil, err
 	}
 
 	var config *AllConfigs
 
 	err = viper.Unmarshal(&config, viper.DecodeHook(OperationWrapperDecodeHook()))
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("loading config (run `commandline_thing check` for details): %w", err)
 	}
 
 	return config, nil
 }
+
+// WatchConfig calls onChange with the reloaded config (or the error loading
+// it) every time the config file changes on disk. It must be called after a
+// successful LoadConfig.
+func WatchConfig(loadedOperations Operations, onChange func(*AllConfigs, error)) {
+	viper.OnConfigChange(func(fsnotify.Event) {
+		onChange(LoadConfig(loadedOperations))
+	})
+	viper.WatchConfig()
+}
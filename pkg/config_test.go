@@ -3,6 +3,7 @@ package pkg
 import (
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -53,3 +54,34 @@ func TestOperationWrapperDecodeHookSkipsConfigureForNonConfigurableOperations(t
 	require.True(t, ok)
 	require.Equal(t, OperationName("git"), wrapper.Operation.Name())
 }
+
+func TestOperationWrapperDecodeHookParsesTimeoutAndPlaceholder(t *testing.T) {
+	availableOperations = LoadAvailableOperations()
+
+	hook := OperationWrapperDecodeHook()
+	raw := map[string]interface{}{"type": "git", "timeout": "250ms", "placeholder": "?"}
+
+	result, err := hook(reflect.TypeOf(raw), reflect.TypeOf(OperationWrapper{}), raw)
+	require.NoError(t, err)
+
+	wrapper, ok := result.(*OperationWrapper)
+	require.True(t, ok)
+	require.Equal(t, 250*time.Millisecond, wrapper.Timeout)
+	require.Equal(t, "?", wrapper.Placeholder)
+}
+
+func TestOperationWrapperDecodeHookRejectsInvalidTimeout(t *testing.T) {
+	availableOperations = LoadAvailableOperations()
+
+	hook := OperationWrapperDecodeHook()
+	raw := map[string]interface{}{"type": "git", "timeout": "soon"}
+
+	_, err := hook(reflect.TypeOf(raw), reflect.TypeOf(OperationWrapper{}), raw)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid timeout")
+}
+
+func TestOperationWrapperDefaultTimeout(t *testing.T) {
+	require.Equal(t, DefaultOperationTimeout, OperationWrapper{}.timeout())
+	require.Equal(t, time.Second, OperationWrapper{Timeout: time.Second}.timeout())
+}
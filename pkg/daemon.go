@@ -0,0 +1,303 @@
+package pkg
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// DaemonSocketEnvVar overrides the default socket location, mostly useful for
+// running more than one daemon (or tests) side by side.
+const DaemonSocketEnvVar = "COMMANDLINE_THING_SOCKET"
+
+// daemonDialTimeout bounds how long a client waits to connect before falling
+// back to in-process execution. It is short on purpose: a missing daemon
+// should cost close to nothing.
+const daemonDialTimeout = 50 * time.Millisecond
+
+// ErrDaemonUnavailable is returned by CallDaemon when nothing is listening on
+// the socket, signalling the caller to do the work in-process instead.
+var ErrDaemonUnavailable = errors.New("daemon not running")
+
+// Commands understood by the daemon, mirroring the CLI subcommands of the same
+// names.
+const (
+	DaemonGenerate   = "generate"
+	DaemonUpdate     = "update"
+	DaemonSetState   = "set-state"
+	DaemonClearState = "clear-state"
+)
+
+// DaemonRequest is a single newline-delimited JSON request sent over the
+// socket. Which fields are used depends on Command.
+type DaemonRequest struct {
+	Command       string        `json:"command"`
+	LocationKey   LocationKey   `json:"locationKey"`
+	InstanceKey   InstanceKey   `json:"instanceKey"`
+	LocationPath  string        `json:"locationPath,omitempty"`
+	OperationName OperationName `json:"operationName,omitempty"`
+	Value         string        `json:"value,omitempty"`
+	// Columns is the width generate's output has to fit in, 0 if unknown.
+	Columns int `json:"columns,omitempty"`
+	// Env is the client's environment, as much of it as operations read
+	// (see ClientEnvironment), and PID, UID and User the client's pid,
+	// effective uid and user name. Operations see these rather than the
+	// daemon's own, which belong to whichever shell started the daemon. A
+	// request without Env gets the daemon's, and without UID the daemon's
+	// uid and user.
+	Env  map[string]string `json:"env"`
+	PID  int               `json:"pid,omitempty"`
+	UID  *int              `json:"uid,omitempty"`
+	User string            `json:"user,omitempty"`
+	// AsyncOnly makes an update only refresh async operations (see
+	// RefreshAsync), running post commands only if their results changed.
+	AsyncOnly bool `json:"asyncOnly,omitempty"`
+}
+
+// DaemonResponse is the reply to a DaemonRequest. A non-empty Error means the
+// daemon handled the request but it failed; the client should not retry it
+// in-process.
+type DaemonResponse struct {
+	Content string `json:"content,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// DaemonSocketPath resolves the socket the daemon listens on: $COMMANDLINE_THING_SOCKET
+// if set, otherwise ~/.config/commandline_thing/daemon.sock.
+func DaemonSocketPath() (string, error) {
+	if path := os.Getenv(DaemonSocketEnvVar); path != "" {
+		return path, nil
+	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get user's home directory: %w", err)
+	}
+	return filepath.Join(homeDir, ".config", "commandline_thing", "daemon.sock"), nil
+}
+
+// Daemon keeps the parsed config, the state store and compiled templates
+// resident so that each generate/update/set-state only costs a socket round
+// trip instead of a config load, database open and template parse.
+type Daemon struct {
+	mu        sync.RWMutex
+	config    *AllConfigs
+	templates map[LocationKey]*template.Template
+
+	state  StateStore
+	logger *log.Logger
+
+	refreshMu  sync.Mutex
+	refreshing map[string]bool
+}
+
+func NewDaemon(config *AllConfigs, state StateStore, logger *log.Logger) (*Daemon, error) {
+	d := &Daemon{state: state, logger: logger, refreshing: make(map[string]bool)}
+	if err := d.Reload(config); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Reload swaps in a freshly loaded config, recompiling every location's
+// template. On error the previous config stays active.
+func (d *Daemon) Reload(config *AllConfigs) error {
+	templates := make(map[LocationKey]*template.Template, len(config.Configs))
+	for locationKey, location := range config.Configs {
+		tmpl, err := CompileTemplate(location)
+		if err != nil {
+			return fmt.Errorf("location %s: %w", locationKey, err)
+		}
+		templates[locationKey] = tmpl
+	}
+
+	d.mu.Lock()
+	d.config = config
+	d.templates = templates
+	d.mu.Unlock()
+	return nil
+}
+
+// Serve accepts connections until the listener is closed.
+func (d *Daemon) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go d.serveConn(conn)
+	}
+}
+
+func (d *Daemon) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	var req DaemonRequest
+	if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&req); err != nil {
+		d.logger.Printf("daemon: failed to decode request: %s", err)
+		return
+	}
+
+	resp := d.Handle(req)
+	if err := json.NewEncoder(conn).Encode(resp); err != nil {
+		d.logger.Printf("daemon: failed to write response: %s", err)
+	}
+}
+
+// Handle executes a single request against the resident config and state.
+func (d *Daemon) Handle(req DaemonRequest) DaemonResponse {
+	content, err := d.handle(req)
+	if err != nil {
+		d.logger.Printf("daemon: %s %s %s failed: %s", req.Command, req.LocationKey, req.InstanceKey, err)
+		return DaemonResponse{Error: err.Error()}
+	}
+	return DaemonResponse{Content: content}
+}
+
+func (d *Daemon) handle(req DaemonRequest) (string, error) {
+	d.mu.RLock()
+	config := d.config
+	tmpl := d.templates[req.LocationKey]
+	d.mu.RUnlock()
+
+	instance, err := ParseInstanceKey(req.InstanceKey)
+	if err != nil {
+		return "", err
+	}
+	instance.Env = req.Env
+	instance.ClientPID = req.PID
+	instance.ClientUID = req.UID
+	instance.ClientUser = req.User
+
+	// Clearing state spans every location, so it doesn't need one.
+	if req.Command == DaemonClearState {
+		return "", d.state.DeleteInstance(instance.Key)
+	}
+
+	locationConfig, ok := config.Configs[req.LocationKey]
+	if !ok {
+		return "", fmt.Errorf("config not found: %s", req.LocationKey)
+	}
+
+	switch req.Command {
+	case DaemonGenerate:
+		refresh := func() { d.refresh(config, locationConfig, req, instance) }
+		return RenderContent(context.Background(), d.state, locationConfig, tmpl, req.LocationKey, instance, req.LocationPath, req.Columns, refresh)
+	case DaemonUpdate:
+		if req.AsyncOnly {
+			changed, updateErr := RefreshAsync(context.Background(), d.state, locationConfig, req.LocationKey, instance, req.LocationPath)
+			if changed {
+				if err := RunPostCommands(config, d.logger, instance); err != nil {
+					return "", err
+				}
+			}
+			return "", updateErr
+		}
+		updateErr := Update(context.Background(), d.state, locationConfig, req.LocationKey, instance, req.LocationPath)
+		if err := RunPostCommands(config, d.logger, instance); err != nil {
+			return "", err
+		}
+		return "", updateErr
+	case DaemonSetState:
+		if err := SetState(d.state, locationConfig, req.LocationKey, req.InstanceKey, req.OperationName, req.Value); err != nil {
+			return "", err
+		}
+		return "", RunPostCommands(config, d.logger, instance)
+	default:
+		return "", fmt.Errorf("unknown daemon command: %s", req.Command)
+	}
+}
+
+// refresh recomputes a location instance's async operations in the
+// background, in-process, the same way `update --async-only` would. Only one refresh
+// per location instance runs at a time; requests arriving while one is in
+// flight are dropped since it will produce fresh results anyway.
+func (d *Daemon) refresh(config *AllConfigs, locationConfig Location, req DaemonRequest, instance Instance) {
+	key := string(req.LocationKey) + "\x00" + string(req.InstanceKey)
+
+	d.refreshMu.Lock()
+	if d.refreshing[key] {
+		d.refreshMu.Unlock()
+		return
+	}
+	d.refreshing[key] = true
+	d.refreshMu.Unlock()
+
+	go func() {
+		defer func() {
+			d.refreshMu.Lock()
+			delete(d.refreshing, key)
+			d.refreshMu.Unlock()
+		}()
+
+		changed, err := RefreshAsync(context.Background(), d.state, locationConfig, req.LocationKey, instance, req.LocationPath)
+		if err != nil {
+			d.logger.Printf("daemon: background update of %s %s failed: %s", req.LocationKey, req.InstanceKey, err)
+		}
+		if !changed {
+			return
+		}
+		if err := RunPostCommands(config, d.logger, instance); err != nil {
+			d.logger.Printf("daemon: failed to run post commands: %s", err)
+		}
+	}()
+}
+
+// CallDaemon sends req to the daemon listening on socketPath. It returns
+// ErrDaemonUnavailable if the daemon can't be reached, and the daemon's own
+// error if it handled the request but failed.
+func CallDaemon(socketPath string, req DaemonRequest) (string, error) {
+	conn, err := net.DialTimeout("unix", socketPath, daemonDialTimeout)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrDaemonUnavailable, err)
+	}
+	defer conn.Close()
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return "", fmt.Errorf("failed to send request to daemon: %w", err)
+	}
+
+	var resp DaemonResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return "", fmt.Errorf("failed to read response from daemon: %w", err)
+	}
+	if resp.Error != "" {
+		return "", errors.New(resp.Error)
+	}
+
+	return resp.Content, nil
+}
+
+// ListenDaemonSocket listens on socketPath, replacing a stale socket file left
+// behind by a daemon that didn't shut down cleanly. It refuses to start if
+// another daemon is already answering on it.
+func ListenDaemonSocket(socketPath string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create socket directory: %w", err)
+	}
+
+	if conn, err := net.DialTimeout("unix", socketPath, daemonDialTimeout); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("daemon already running on %s", socketPath)
+	}
+	if err := os.Remove(socketPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to remove stale socket: %w", err)
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", socketPath, err)
+	}
+	return listener, nil
+}
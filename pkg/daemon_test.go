@@ -0,0 +1,161 @@
+package pkg
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func startTestDaemon(t *testing.T, config *AllConfigs, store StateStore) string {
+	t.Helper()
+	// Unix socket paths are limited to ~104 bytes, which t.TempDir() can
+	// exceed on macOS.
+	dir, err := os.MkdirTemp("", "clt")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	socketPath := filepath.Join(dir, "daemon.sock")
+
+	daemon, err := NewDaemon(config, store, log.New(io.Discard, "", 0))
+	require.NoError(t, err)
+
+	listener, err := ListenDaemonSocket(socketPath)
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go daemon.Serve(listener)
+
+	return socketPath
+}
+
+func TestDaemonServesGenerateUpdateAndSetState(t *testing.T) {
+	config := &AllConfigs{
+		Configs: map[LocationKey]Location{
+			"prompt": {
+				Operations: []OperationWrapper{
+					{Operation: &ExitCode{}},
+					{Operation: mustConfiguredCycle(t, "nyan", "nyan1", "nyan2")},
+				},
+				Template: "{{ .exit_code }} {{ .nyan }}",
+			},
+		},
+	}
+	store := NewMemoryStateStore()
+	socketPath := startTestDaemon(t, config, store)
+
+	_, err := CallDaemon(socketPath, DaemonRequest{
+		Command:       DaemonSetState,
+		LocationKey:   "prompt",
+		InstanceKey:   "12345",
+		OperationName: "exit_code",
+		Value:         "1",
+	})
+	require.NoError(t, err)
+
+	_, err = CallDaemon(socketPath, DaemonRequest{Command: DaemonUpdate, LocationKey: "prompt", InstanceKey: "12345", LocationPath: "/tmp"})
+	require.NoError(t, err)
+
+	content, err := CallDaemon(socketPath, DaemonRequest{Command: DaemonGenerate, LocationKey: "prompt", InstanceKey: "12345", LocationPath: "/tmp"})
+	require.NoError(t, err)
+	require.Equal(t, "1 nyan2", content)
+}
+
+func TestDaemonReturnsHandlerErrors(t *testing.T) {
+	socketPath := startTestDaemon(t, &AllConfigs{Configs: map[LocationKey]Location{}}, NewMemoryStateStore())
+
+	_, err := CallDaemon(socketPath, DaemonRequest{Command: DaemonGenerate, LocationKey: "missing", InstanceKey: "12345"})
+	require.Error(t, err)
+	require.NotErrorIs(t, err, ErrDaemonUnavailable)
+	require.Contains(t, err.Error(), "config not found: missing")
+}
+
+func TestCallDaemonReportsUnavailableWhenNotRunning(t *testing.T) {
+	_, err := CallDaemon(filepath.Join(t.TempDir(), "nobody.sock"), DaemonRequest{Command: DaemonGenerate})
+	require.ErrorIs(t, err, ErrDaemonUnavailable)
+}
+
+func TestDaemonReloadKeepsPreviousConfigOnTemplateError(t *testing.T) {
+	config := &AllConfigs{Configs: map[LocationKey]Location{"pane": {Template: "ok"}}}
+	daemon, err := NewDaemon(config, NewMemoryStateStore(), log.New(io.Discard, "", 0))
+	require.NoError(t, err)
+
+	err = daemon.Reload(&AllConfigs{Configs: map[LocationKey]Location{"pane": {Template: "{{ .broken"}}})
+	require.Error(t, err)
+
+	resp := daemon.Handle(DaemonRequest{Command: DaemonGenerate, LocationKey: "pane", InstanceKey: "12345"})
+	require.Empty(t, resp.Error)
+	require.Equal(t, "ok", resp.Content)
+}
+
+func TestListenDaemonSocketRefusesWhenAlreadyRunning(t *testing.T) {
+	socketPath := startTestDaemon(t, &AllConfigs{Configs: map[LocationKey]Location{}}, NewMemoryStateStore())
+
+	_, err := ListenDaemonSocket(socketPath)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "already running")
+}
+
+func TestDaemonClearsInstanceState(t *testing.T) {
+	store := NewMemoryStateStore()
+	require.NoError(t, store.Set("prompt", "tmux.%1", "exit_code", "1"))
+	require.NoError(t, store.Set("status", "tmux.%1", "vim", "normal"))
+	require.NoError(t, store.Set("prompt", "tmux.%2", "exit_code", "2"))
+	socketPath := startTestDaemon(t, &AllConfigs{Configs: map[LocationKey]Location{}}, store)
+
+	_, err := CallDaemon(socketPath, DaemonRequest{Command: DaemonClearState, InstanceKey: "tmux.%1"})
+	require.NoError(t, err)
+
+	for _, location := range []LocationKey{"prompt", "status"} {
+		value, err := store.Get(location, "tmux.%1", "exit_code")
+		require.NoError(t, err)
+		require.Empty(t, value)
+	}
+	value, err := store.Get("prompt", "tmux.%2", "exit_code")
+	require.NoError(t, err)
+	require.Equal(t, "2", value, "other instances are untouched")
+}
+
+func TestDaemonRejectsInvalidInstanceKey(t *testing.T) {
+	daemon, err := NewDaemon(&AllConfigs{Configs: map[LocationKey]Location{"prompt": {}}}, NewMemoryStateStore(), log.New(io.Discard, "", 0))
+	require.NoError(t, err)
+
+	resp := daemon.Handle(DaemonRequest{Command: DaemonGenerate, LocationKey: "prompt", InstanceKey: "tmux.nope"})
+	require.Contains(t, resp.Error, `invalid instance key "tmux.nope"`)
+}
+
+func TestDaemonRendersWithClientEnvironment(t *testing.T) {
+	dir := t.TempDir()
+	clientConfig := writeKubeconfig(t, dir, "client", "current-context: client-context\n")
+	daemonConfig := writeKubeconfig(t, dir, "daemon", "current-context: daemon-context\n")
+	t.Setenv("KUBECONFIG", daemonConfig)
+	t.Setenv("TMUX", "")
+
+	config := &AllConfigs{
+		Configs: map[LocationKey]Location{
+			"prompt": {
+				Operations: []OperationWrapper{{Operation: &Kube{}}, {Operation: &InTmux{}}},
+				Template:   "{{ .kube }} {{ .in_tmux }}",
+			},
+		},
+	}
+	socketPath := startTestDaemon(t, config, NewMemoryStateStore())
+
+	content, err := CallDaemon(socketPath, DaemonRequest{
+		Command:     DaemonGenerate,
+		LocationKey: "prompt",
+		InstanceKey: testTmuxInstance.Key,
+		Env:         map[string]string{"KUBECONFIG": clientConfig, "TMUX": "/tmp/tmux-1000/default,1,0"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "client-context true", content)
+
+	content, err = CallDaemon(socketPath, DaemonRequest{
+		Command:     DaemonGenerate,
+		LocationKey: "prompt",
+		InstanceKey: testTmuxInstance.Key,
+	})
+	require.NoError(t, err)
+	require.Equal(t, "daemon-context false", content, "requests without an environment get the daemon's")
+}
@@ -0,0 +1,235 @@
+package pkg
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// Dialect is the markup a location's output is consumed by, set per location
+// with `dialect:` in YAML. It decides what the styling template functions
+// (fg, bg, bold, reset, ...) emit, and how escape sequences are hidden from
+// the consumer's width calculations so the cursor isn't misplaced.
+type Dialect string
+
+const (
+	// DialectPlain (the default) emits no styling at all.
+	DialectPlain Dialect = "plain"
+	// DialectTmux emits tmux style directives, e.g. #[fg=red].
+	DialectTmux Dialect = "tmux"
+	// DialectZsh emits ANSI escapes wrapped in %{ %} for zsh prompts.
+	DialectZsh Dialect = "zsh"
+	// DialectBash emits ANSI escapes wrapped in \001 \002, which readline
+	// treats as zero-width. (Bash's own \[ \] are only recognised in PS1
+	// itself, not in the output of a command substitution it expands.)
+	DialectBash Dialect = "bash"
+	// DialectFish emits bare ANSI escapes; fish measures prompts itself.
+	DialectFish Dialect = "fish"
+	// DialectANSI emits bare ANSI escapes, for anything that writes straight
+	// to a terminal.
+	DialectANSI Dialect = "ansi"
+)
+
+func (d Dialect) valid() bool {
+	switch d {
+	case "", DialectPlain, DialectTmux, DialectZsh, DialectBash, DialectFish, DialectANSI:
+		return true
+	}
+	return false
+}
+
+// ansiColours maps colour names to their SGR foreground code; background is
+// the same plus 10.
+var ansiColours = map[string]int{
+	"black":         30,
+	"red":           31,
+	"green":         32,
+	"yellow":        33,
+	"blue":          34,
+	"magenta":       35,
+	"cyan":          36,
+	"white":         37,
+	"default":       39,
+	"brightblack":   90,
+	"brightred":     91,
+	"brightgreen":   92,
+	"brightyellow":  93,
+	"brightblue":    94,
+	"brightmagenta": 95,
+	"brightcyan":    96,
+	"brightwhite":   97,
+}
+
+// colour is a parsed colour argument: a name from ansiColours, a 256-colour
+// palette index, or a #rrggbb truecolour.
+type colour struct {
+	name    string
+	index   int
+	rgb     [3]uint8
+	isIndex bool
+	isRGB   bool
+}
+
+func parseColour(raw interface{}) (colour, error) {
+	switch v := raw.(type) {
+	case int:
+		if v < 0 || v > 255 {
+			return colour{}, fmt.Errorf("colour index %d out of range 0-255", v)
+		}
+		return colour{index: v, isIndex: true}, nil
+	case string:
+		s := strings.ToLower(strings.TrimSpace(v))
+		if _, ok := ansiColours[s]; ok {
+			return colour{name: s}, nil
+		}
+		if strings.HasPrefix(s, "colour") || strings.HasPrefix(s, "color") {
+			s = strings.TrimPrefix(strings.TrimPrefix(s, "colour"), "color")
+		}
+		if n, err := strconv.Atoi(s); err == nil {
+			return parseColour(n)
+		}
+		if strings.HasPrefix(s, "#") && len(s) == 7 {
+			n, err := strconv.ParseUint(s[1:], 16, 32)
+			if err == nil {
+				return colour{rgb: [3]uint8{uint8(n >> 16), uint8(n >> 8), uint8(n)}, isRGB: true}, nil
+			}
+		}
+		return colour{}, fmt.Errorf("unknown colour %q", v)
+	default:
+		return colour{}, fmt.Errorf("colour must be a name, a 0-255 index or #rrggbb, got %T", raw)
+	}
+}
+
+func (c colour) tmux() string {
+	switch {
+	case c.isIndex:
+		return fmt.Sprintf("colour%d", c.index)
+	case c.isRGB:
+		return fmt.Sprintf("#%02x%02x%02x", c.rgb[0], c.rgb[1], c.rgb[2])
+	default:
+		return c.name
+	}
+}
+
+// sgr returns the SGR parameters for the colour as a foreground (or
+// background, if bg).
+func (c colour) sgr(bg bool) string {
+	switch {
+	case c.isIndex:
+		if bg {
+			return fmt.Sprintf("48;5;%d", c.index)
+		}
+		return fmt.Sprintf("38;5;%d", c.index)
+	case c.isRGB:
+		if bg {
+			return fmt.Sprintf("48;2;%d;%d;%d", c.rgb[0], c.rgb[1], c.rgb[2])
+		}
+		return fmt.Sprintf("38;2;%d;%d;%d", c.rgb[0], c.rgb[1], c.rgb[2])
+	default:
+		code := ansiColours[c.name]
+		if bg {
+			code += 10
+		}
+		return strconv.Itoa(code)
+	}
+}
+
+// tmuxAttributes maps the attribute template functions to tmux style names.
+var tmuxAttributes = map[string]string{
+	"bold":      "bold",
+	"dim":       "dim",
+	"italic":    "italics",
+	"underline": "underscore",
+	"reverse":   "reverse",
+}
+
+// sgrAttributes maps the attribute template functions to SGR parameters.
+var sgrAttributes = map[string]string{
+	"bold":      "1",
+	"dim":       "2",
+	"italic":    "3",
+	"underline": "4",
+	"reverse":   "7",
+}
+
+// sgr wraps SGR parameters in an escape sequence, hidden from the consumer's
+// width calculation as the dialect requires.
+func (d Dialect) sgr(params string) Markup {
+	seq := "\x1b[" + params + "m"
+	switch d {
+	case DialectZsh:
+		return Markup("%{" + seq + "%}")
+	case DialectBash:
+		return Markup("\x01" + seq + "\x02")
+	case DialectFish, DialectANSI:
+		return Markup(seq)
+	default:
+		return ""
+	}
+}
+
+func (d Dialect) colour(raw interface{}, bg bool) (Markup, error) {
+	c, err := parseColour(raw)
+	if err != nil {
+		return "", err
+	}
+	switch d {
+	case DialectTmux:
+		if bg {
+			return Markup("#[bg=" + c.tmux() + "]"), nil
+		}
+		return Markup("#[fg=" + c.tmux() + "]"), nil
+	default:
+		return d.sgr(c.sgr(bg)), nil
+	}
+}
+
+func (d Dialect) attribute(name string) Markup {
+	if d == DialectTmux {
+		return Markup("#[" + tmuxAttributes[name] + "]")
+	}
+	return d.sgr(sgrAttributes[name])
+}
+
+func (d Dialect) reset() Markup {
+	if d == DialectTmux {
+		return "#[default]"
+	}
+	return d.sgr("0")
+}
+
+// FuncMap returns the functions available to templates: templateFuncs, and
+// the styling functions
+//
+//	{{ fg "red" }} {{ bg 236 }} {{ fg "#ff8800" }}  colours: names, 0-255, #rrggbb
+//	{{ bold }} {{ dim }} {{ italic }} {{ underline }} {{ reverse }}
+//	{{ reset }}  back to the default style
+//	{{ raw .x }} output .x verbatim instead of escaping it (see Markup)
+//
+// so one template renders correctly in every dialect. In DialectPlain the
+// styling functions all render as nothing.
+func (d Dialect) FuncMap() template.FuncMap {
+	funcs := template.FuncMap{
+		"fg":    func(c interface{}) (Markup, error) { return d.colour(c, false) },
+		"bg":    func(c interface{}) (Markup, error) { return d.colour(c, true) },
+		"reset": d.reset,
+		"raw":   func(v interface{}) Markup { return Markup(fmt.Sprint(v)) },
+
+		escapeFuncName: d.escapeValue,
+	}
+	for name, f := range templateFuncs {
+		funcs[name] = f
+	}
+	for name := range sgrAttributes {
+		name := name
+		funcs[name] = func() Markup { return d.attribute(name) }
+	}
+	return funcs
+}
+
+// escapes reports whether output in this dialect needs escaping at all.
+// Plain output isn't interpreted by anything, so it's written as-is.
+func (d Dialect) escapes() bool {
+	return d != "" && d != DialectPlain
+}
@@ -0,0 +1,46 @@
+package pkg
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func renderDialect(t *testing.T, dialect Dialect, tmpl string) string {
+	t.Helper()
+	config := Location{Template: tmpl, Dialect: dialect}
+	content, err := GenerateContent(context.Background(), NewMemoryStateStore(), config, "pane", testTmuxInstance, "/tmp", 0, nil)
+	require.NoError(t, err)
+	return content
+}
+
+func TestDialectStylingPerDialect(t *testing.T) {
+	tmpl := `{{ fg "red" }}{{ bold }}x{{ reset }}`
+
+	require.Equal(t, "#[fg=red]#[bold]x#[default]", renderDialect(t, DialectTmux, tmpl))
+	require.Equal(t, "%{\x1b[31m%}%{\x1b[1m%}x%{\x1b[0m%}", renderDialect(t, DialectZsh, tmpl))
+	require.Equal(t, "\x01\x1b[31m\x02\x01\x1b[1m\x02x\x01\x1b[0m\x02", renderDialect(t, DialectBash, tmpl))
+	require.Equal(t, "\x1b[31m\x1b[1mx\x1b[0m", renderDialect(t, DialectFish, tmpl))
+	require.Equal(t, "\x1b[31m\x1b[1mx\x1b[0m", renderDialect(t, DialectANSI, tmpl))
+	require.Equal(t, "x", renderDialect(t, DialectPlain, tmpl))
+	require.Equal(t, "x", renderDialect(t, "", tmpl), "plain is the default")
+}
+
+func TestDialectColourForms(t *testing.T) {
+	require.Equal(t, "#[fg=colour208]#[bg=#ff8800]#[fg=brightblue]", renderDialect(t, DialectTmux, `{{ fg 208 }}{{ bg "#FF8800" }}{{ fg "brightblue" }}`))
+	require.Equal(t, "\x1b[38;5;208m\x1b[48;2;255;136;0m\x1b[104m", renderDialect(t, DialectANSI, `{{ fg "colour208" }}{{ bg "#ff8800" }}{{ bg "brightblue" }}`))
+}
+
+func TestDialectRejectsUnknownColour(t *testing.T) {
+	config := Location{Template: `{{ fg "mauve" }}`, Dialect: DialectTmux}
+	_, err := GenerateContent(context.Background(), NewMemoryStateStore(), config, "pane", testTmuxInstance, "/tmp", 0, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `unknown colour "mauve"`)
+}
+
+func TestCompileTemplateRejectsUnknownDialect(t *testing.T) {
+	_, err := CompileTemplate(Location{Template: "x", Dialect: "powershell"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unknown dialect")
+}
@@ -0,0 +1,160 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultDurationThreshold is how long a command must take before duration
+// renders anything, for entries that don't set `threshold`.
+const DefaultDurationThreshold = 2 * time.Second
+
+// DurationResult is how long the last command took, exposed to templates as
+// .duration. Printing it directly ({{ .duration }}) gives Human.
+type DurationResult struct {
+	Milliseconds int64
+	// Human is the elapsed time as e.g. "350ms", "4.2s", "1m05s" or "2h03m".
+	Human string
+}
+
+func (r DurationResult) String() string {
+	return r.Human
+}
+
+// humanizeDuration formats d compactly, keeping only the two most
+// significant units past a minute.
+func humanizeDuration(d time.Duration) string {
+	if d >= time.Second && d < 10*time.Second {
+		// Rounded before picking a format, so that 9.96s is "10s" rather
+		// than "10.0s".
+		d = d.Round(100 * time.Millisecond)
+	}
+	switch {
+	case d < time.Second:
+		return fmt.Sprintf("%dms", d.Milliseconds())
+	case d < 10*time.Second:
+		return fmt.Sprintf("%.1fs", d.Seconds())
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm%02ds", int(d.Minutes()), int(d.Seconds())%60)
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%dh%02dm", int(d.Hours()), int(d.Minutes())%60)
+	default:
+		return fmt.Sprintf("%dd%02dh", int(d.Hours())/24, int(d.Hours())%24)
+	}
+}
+
+// Duration times the last command. Its state is fed from shell hooks through
+// set-state: "start" from preexec and "end" from precmd, each optionally
+// followed by the epoch time in (fractional) seconds, e.g. zsh's
+// $EPOCHREALTIME; without one the time the event arrives is used.
+//
+//	commandline_thing set-state prompt "$id" duration "start $EPOCHREALTIME"
+//	commandline_thing set-state prompt "$id" duration "end $EPOCHREALTIME"
+//
+// Commands shorter than `threshold` (a duration string or seconds, default
+// 2s) render as empty, so guard field access with {{ with .duration }}.
+//
+//   - type: duration
+//     threshold: 500ms
+type Duration struct {
+	threshold *time.Duration
+	// now is time.Now, swapped out in tests.
+	now func() time.Time
+}
+
+func (*Duration) Name() OperationName      { return "duration" }
+func (*Duration) IsAsync() bool            { return false }
+func (*Duration) ResultType() reflect.Type { return reflect.TypeOf(DurationResult{}) }
+
+func (d *Duration) Configure(rawConfig map[string]interface{}) error {
+	thresholdRaw, ok := rawConfig["threshold"]
+	if !ok {
+		return nil
+	}
+	threshold, err := parseDuration("threshold", thresholdRaw)
+	if err != nil {
+		return fmt.Errorf("duration: %w", err)
+	}
+	if threshold < 0 {
+		return fmt.Errorf("duration: threshold must not be negative")
+	}
+	d.threshold = &threshold
+	return nil
+}
+
+func (d *Duration) currentTime() time.Time {
+	if d.now != nil {
+		return d.now()
+	}
+	return time.Now()
+}
+
+// parseDurationState splits the state into the command's start and end in
+// epoch milliseconds; either is 0 when unset.
+func parseDurationState(state string) (start, end int64) {
+	fields := strings.Fields(state)
+	if len(fields) > 0 {
+		start, _ = strconv.ParseInt(fields[0], 10, 64)
+	}
+	if len(fields) > 1 {
+		end, _ = strconv.ParseInt(fields[1], 10, 64)
+	}
+	return start, end
+}
+
+// ReduceState records a "start" or "end" event. An "end" without a "start"
+// since the previous one (e.g. the user just pressed return, so preexec
+// never ran) clears the duration rather than timing from the last command.
+func (d *Duration) ReduceState(state string, input string) (string, error) {
+	event, timestamp, _ := strings.Cut(strings.TrimSpace(input), " ")
+
+	at := d.currentTime().UnixMilli()
+	if timestamp = strings.TrimSpace(timestamp); timestamp != "" {
+		// $EPOCHREALTIME uses the locale's decimal separator.
+		seconds, err := strconv.ParseFloat(strings.Replace(timestamp, ",", ".", 1), 64)
+		if err != nil {
+			return "", fmt.Errorf("invalid timestamp %q: %w", timestamp, err)
+		}
+		at = int64(seconds * 1000)
+	}
+
+	switch event {
+	case "start":
+		return strconv.FormatInt(at, 10), nil
+	case "end":
+		start, end := parseDurationState(state)
+		if start == 0 || end != 0 {
+			return "", nil
+		}
+		return fmt.Sprintf("%d %d", start, at), nil
+	default:
+		return "", fmt.Errorf("expected \"start\" or \"end\", got %q", input)
+	}
+}
+
+func (*Duration) Update(_ context.Context, _ string, state string) (string, error) {
+	return state, nil
+}
+func (d *Duration) Generate(ctx context.Context, locationKey LocationKey, instance Instance, locationPath string, state string) (interface{}, error) {
+	start, end := parseDurationState(state)
+	if start == 0 || end < start {
+		return "", nil
+	}
+
+	threshold := DefaultDurationThreshold
+	if d.threshold != nil {
+		threshold = *d.threshold
+	}
+	elapsed := time.Duration(end-start) * time.Millisecond
+	if elapsed < threshold {
+		return "", nil
+	}
+
+	return DurationResult{Milliseconds: elapsed.Milliseconds(), Human: humanizeDuration(elapsed)}, nil
+}
@@ -0,0 +1,69 @@
+package pkg
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHumanizeDuration(t *testing.T) {
+	cases := map[time.Duration]string{
+		350 * time.Millisecond:                      "350ms",
+		4200 * time.Millisecond:                     "4.2s",
+		9940 * time.Millisecond:                     "9.9s",
+		9950 * time.Millisecond:                     "10s",
+		9960 * time.Millisecond:                     "10s",
+		9990 * time.Millisecond:                     "10s",
+		42 * time.Second:                            "42s",
+		time.Minute + 5*time.Second:                 "1m05s",
+		2*time.Hour + 3*time.Minute + 4*time.Second: "2h03m",
+		50 * time.Hour:                              "2d02h",
+	}
+	for d, expected := range cases {
+		require.Equal(t, expected, humanizeDuration(d), d.String())
+	}
+}
+
+func TestDurationReduceState(t *testing.T) {
+	op := &Duration{now: func() time.Time { return time.UnixMilli(5000) }}
+
+	state, err := op.ReduceState("", "start")
+	require.NoError(t, err)
+	require.Equal(t, "5000", state, "without a timestamp the event's arrival time is used")
+
+	state, err = op.ReduceState(state, "end 8.25")
+	require.NoError(t, err)
+	require.Equal(t, "5000 8250", state)
+
+	state, err = op.ReduceState(state, "end 9")
+	require.NoError(t, err)
+	require.Empty(t, state, "an end with no start since the last one clears the duration")
+
+	_, err = op.ReduceState("", "end nope")
+	require.Error(t, err)
+}
+
+func TestDurationGenerateRespectsThreshold(t *testing.T) {
+	op := &Duration{}
+	result, err := op.Generate(context.Background(), "prompt", testShellInstance, "/tmp", "1000 2500")
+	require.NoError(t, err)
+	require.Equal(t, "", result, "1.5s is under the default 2s threshold")
+
+	require.NoError(t, op.Configure(map[string]interface{}{"threshold": "1s"}))
+	result, err = op.Generate(context.Background(), "prompt", testShellInstance, "/tmp", "1000 2500")
+	require.NoError(t, err)
+	require.Equal(t, DurationResult{Milliseconds: 1500, Human: "1.5s"}, result)
+
+	result, err = op.Generate(context.Background(), "prompt", testShellInstance, "/tmp", "1000")
+	require.NoError(t, err)
+	require.Equal(t, "", result, "a command still running has no duration yet")
+
+	require.NoError(t, op.Configure(map[string]interface{}{"threshold": 0}))
+	result, err = op.Generate(context.Background(), "prompt", testShellInstance, "/tmp", "1000 1001")
+	require.NoError(t, err)
+	require.Equal(t, "1ms", result.(DurationResult).String())
+
+	require.Error(t, op.Configure(map[string]interface{}{"threshold": "-1s"}))
+}
@@ -0,0 +1,122 @@
+package pkg
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"unicode"
+)
+
+// Markup is template output that is trusted to contain dialect markup, and so
+// is written out verbatim. The styling functions (fg, bold, ...) return it,
+// and `raw` turns any value into it:
+//
+//	{{ raw "#[fg=red]" }}
+//
+// Everything else an action outputs — operation data such as branch names,
+// paths, or values stored with set-state — is escaped for the location's
+// dialect, the same way html/template escapes values for HTML, so that a
+// branch named `#[fg=red]#(rm -rf ~)` renders as text instead of being
+// interpreted by tmux.
+type Markup string
+
+// escapeFuncName is appended to every output action's pipeline by
+// escapeTemplate. The leading underscore keeps it out of the way of anything
+// a template would reasonably call.
+const escapeFuncName = "_escape"
+
+// escape makes s inert for the dialect:
+//
+//   - tmux: # starts every format (#[style], #(command), #{variable}), so it
+//     is doubled.
+//   - zsh: % starts every prompt escape, so it is doubled. Command and
+//     parameter substitutions aren't escaped: output is expected to be
+//     spliced into the prompt through a parameter (as `init zsh` does), whose
+//     value zsh doesn't expand again.
+//   - bash, fish, ansi: nothing is interpreted beyond terminal control
+//     sequences.
+//
+// Control characters (escape sequences, readline's \001/\002 markers,
+// newlines) are dropped in every dialect.
+func (d Dialect) escape(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, s)
+
+	switch d {
+	case DialectTmux:
+		return strings.ReplaceAll(s, "#", "##")
+	case DialectZsh:
+		return strings.ReplaceAll(s, "%", "%%")
+	default:
+		return s
+	}
+}
+
+// escapeValue formats v the way text/template would print it and escapes the
+// result, unless it is Markup.
+func (d Dialect) escapeValue(v interface{}) string {
+	switch v := v.(type) {
+	case Markup:
+		return string(v)
+	case nil:
+		return "<no value>"
+	default:
+		return d.escape(fmt.Sprint(v))
+	}
+}
+
+// escapeTemplate rewrites every output action in tmpl (and any templates it
+// defines) from {{ pipeline }} to {{ pipeline | _escape }}. Actions that only
+// declare or assign variables produce no output and are left alone.
+func escapeTemplate(tmpl *template.Template) {
+	for _, t := range tmpl.Templates() {
+		if t.Tree != nil && t.Tree.Root != nil {
+			escapeNode(t.Tree.Root)
+		}
+	}
+}
+
+func escapeNode(node parse.Node) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			escapeNode(child)
+		}
+	case *parse.ActionNode:
+		escapePipe(n.Pipe)
+	case *parse.IfNode:
+		escapeNode(n.List)
+		escapeNode(n.ElseList)
+	case *parse.RangeNode:
+		escapeNode(n.List)
+		escapeNode(n.ElseList)
+	case *parse.WithNode:
+		escapeNode(n.List)
+		escapeNode(n.ElseList)
+	}
+}
+
+func escapePipe(pipe *parse.PipeNode) {
+	if pipe == nil || len(pipe.Decl) > 0 || len(pipe.Cmds) == 0 {
+		return
+	}
+	last := pipe.Cmds[len(pipe.Cmds)-1]
+	if len(last.Args) == 1 {
+		if ident, ok := last.Args[0].(*parse.IdentifierNode); ok && ident.Ident == escapeFuncName {
+			return
+		}
+	}
+	pipe.Cmds = append(pipe.Cmds, &parse.CommandNode{
+		NodeType: parse.NodeCommand,
+		Pos:      pipe.Pos,
+		Args:     []parse.Node{parse.NewIdentifier(escapeFuncName).SetPos(pipe.Pos)},
+	})
+}
@@ -0,0 +1,58 @@
+package pkg
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func renderWithData(t *testing.T, dialect Dialect, tmpl string, state string) string {
+	t.Helper()
+	store := NewMemoryStateStore()
+	require.NoError(t, store.Set("pane", "tmux.%1", "venv", state))
+	config := Location{
+		Operations: []OperationWrapper{{Operation: &PythonVirtualEnv{}}},
+		Template:   tmpl,
+		Dialect:    dialect,
+	}
+	content, err := GenerateContent(context.Background(), store, config, "pane", testTmuxInstance, "/tmp", 0, nil)
+	require.NoError(t, err)
+	return content
+}
+
+func TestEscapeNeutralisesTmuxFormats(t *testing.T) {
+	content := renderWithData(t, DialectTmux, `{{ fg "red" }}{{ .venv }}{{ reset }}`, "#[fg=red]#(rm -rf ~)")
+	require.Equal(t, "#[fg=red]##[fg=red]##(rm -rf ~)#[default]", content)
+}
+
+func TestEscapeNeutralisesZshPromptEscapes(t *testing.T) {
+	content := renderWithData(t, DialectZsh, `{{ .venv }}`, "100%F{red}")
+	require.Equal(t, "100%%F{red}", content)
+}
+
+func TestEscapeDropsControlCharacters(t *testing.T) {
+	content := renderWithData(t, DialectANSI, `{{ .venv }}`, "a\x1b[31mb\nc")
+	require.Equal(t, "a[31mbc", content)
+}
+
+func TestEscapeAppliesInsideNestedActionsAndDefinedTemplates(t *testing.T) {
+	tmpl := `{{ define "v" }}<{{ . }}>{{ end }}{{ with .venv }}{{ if . }}{{ template "v" . }}{{ else }}empty{{ end }}{{ end }}`
+	content := renderWithData(t, DialectTmux, tmpl, "#x")
+	require.Equal(t, "<##x>", content)
+}
+
+func TestRawSkipsEscaping(t *testing.T) {
+	content := renderWithData(t, DialectTmux, `{{ raw .venv }}|{{ .venv | raw }}`, "#[bold]")
+	require.Equal(t, "#[bold]|#[bold]", content)
+}
+
+func TestEscapeLeavesVariableDeclarationsAlone(t *testing.T) {
+	content := renderWithData(t, DialectTmux, `{{ $v := .venv }}{{ $v = printf "%s!" $v }}{{ $v }}`, "#")
+	require.Equal(t, "##!", content)
+}
+
+func TestPlainDialectIsNotEscaped(t *testing.T) {
+	content := renderWithData(t, DialectPlain, `{{ .venv }}`, "#[fg=red]")
+	require.Equal(t, "#[fg=red]", content)
+}
@@ -0,0 +1,70 @@
+package pkg
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// ExitCodeResult is the status of the last command line, exposed to
+// templates as .exit_code. Printing it directly ({{ .exit_code }}) gives the
+// status as it was stored.
+type ExitCodeResult struct {
+	// Code is the status of the pipeline's last stage, i.e. $?.
+	Code int
+	// Codes is every stage's status, from $pipestatus / $PIPESTATUS.
+	Codes []int
+	// Failed is true when Code is non-zero; AnyFailed when any stage's is.
+	Failed    bool
+	AnyFailed bool
+	// Signal names the signal that killed the last stage ("SIGINT" for 130),
+	// or is "" if it exited normally.
+	Signal string
+	// Signals is Signal for every stage.
+	Signals []string
+
+	raw string
+}
+
+func (r ExitCodeResult) String() string {
+	return r.raw
+}
+
+// exitSignal decodes the shell's 128+n convention for a process killed by
+// signal n.
+func exitSignal(code int) string {
+	if code <= 128 || code > 128+64 {
+		return ""
+	}
+	return unix.SignalName(syscall.Signal(code - 128))
+}
+
+// parseExitCodes reads a space-separated pipestatus list; a single code is
+// just a one-stage pipeline. Commas and pipes are accepted as separators too.
+func parseExitCodes(state string) (*ExitCodeResult, error) {
+	fields := strings.FieldsFunc(state, func(r rune) bool {
+		return r == ' ' || r == '\t' || r == '\n' || r == ',' || r == '|'
+	})
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	result := &ExitCodeResult{raw: strings.TrimSpace(state)}
+	for _, field := range fields {
+		code, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exit code %q", field)
+		}
+		signal := exitSignal(code)
+		result.Codes = append(result.Codes, code)
+		result.Signals = append(result.Signals, signal)
+		result.AnyFailed = result.AnyFailed || code != 0
+	}
+	result.Code = result.Codes[len(result.Codes)-1]
+	result.Signal = result.Signals[len(result.Signals)-1]
+	result.Failed = result.Code != 0
+	return result, nil
+}
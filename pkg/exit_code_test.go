@@ -0,0 +1,53 @@
+package pkg
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExitCodePipestatus(t *testing.T) {
+	result, err := (&ExitCode{}).Generate(context.Background(), "prompt", testShellInstance, "/tmp", "0 1 0")
+	require.NoError(t, err)
+	exitCode := result.(ExitCodeResult)
+	require.Equal(t, 0, exitCode.Code)
+	require.Equal(t, []int{0, 1, 0}, exitCode.Codes)
+	require.False(t, exitCode.Failed)
+	require.True(t, exitCode.AnyFailed)
+	require.Empty(t, exitCode.Signal)
+	require.Equal(t, "0 1 0", exitCode.String())
+}
+
+func TestExitCodeSignals(t *testing.T) {
+	cases := map[string]string{"130": "SIGINT", "137": "SIGKILL", "143": "SIGTERM", "141": "SIGPIPE", "1": "", "255": ""}
+	for state, signal := range cases {
+		result, err := parseExitCodes(state)
+		require.NoError(t, err)
+		require.Equal(t, signal, result.Signal, state)
+		require.True(t, result.Failed, state)
+	}
+
+	result, err := parseExitCodes("141|0")
+	require.NoError(t, err)
+	require.Equal(t, []string{"SIGPIPE", ""}, result.Signals)
+}
+
+func TestExitCodeRendersInTemplate(t *testing.T) {
+	tmpl, err := CompileTemplate(Location{Template: `{{ with .exit_code }}{{ if .Failed }}✘ {{ or .Signal .Code }}{{ end }}{{ end }}`})
+	require.NoError(t, err)
+
+	for state, expected := range map[string]string{"130": "✘ SIGINT", "2": "✘ 2", "0": "", "": ""} {
+		store := NewMemoryStateStore()
+		require.NoError(t, store.Set("prompt", testShellInstance.Key, "exit_code", state))
+		config := Location{Operations: []OperationWrapper{{Operation: &ExitCode{}}}}
+		content, err := RenderContent(context.Background(), store, config, tmpl, "prompt", testShellInstance, "/tmp", 0, nil)
+		require.NoError(t, err)
+		require.Equal(t, expected, content, state)
+	}
+}
+
+func TestExitCodeRejectsGarbage(t *testing.T) {
+	_, err := parseExitCodes("0 oops")
+	require.Error(t, err)
+}
@@ -0,0 +1,327 @@
+package pkg
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// templateFuncs are the functions every template gets regardless of dialect,
+// for fitting data into one line of status output. The value being worked on
+// always comes last, so they chain in pipelines:
+//
+//	{{ .git.Branch | truncate 20 | padRight 20 }}
+//	{{ .venv | default "system" | upper }}
+//	{{ ternary "root" .host_details.User .host_details.IsRoot }}
+//	{{ .command | join ", " }}   {{ .size | bytes }}   {{ now | date "15:04" }}
+//
+// Fields of an operation that renders as nil when it has nothing to show
+// (e.g. .kube without a current context) fail before default is reached,
+// so guard those with `with` instead:
+//
+//	{{ with .kube }}{{ .Namespace | upper }}{{ else }}no cluster{{ end }}
+//
+// Widths are in terminal cells, so wide characters (CJK, emoji, memes)
+// count as two; see runeWidth. The full list:
+//
+//	truncate n s       s cut to n cells, ending in "…" if it was cut
+//	padLeft n s        s right-aligned in n cells
+//	padRight n s       s left-aligned in n cells
+//	width s            how many cells s takes up
+//	upper s, lower s, trim s
+//	replace old new s  every old in s replaced with new
+//	default d v        v, or d if v is empty (nil, "", 0, false, or no elements)
+//	coalesce v...      the first non-empty v
+//	ternary a b cond   a if cond is true, otherwise b
+//	round places n     n rounded to places decimals
+//	si n               n with an SI suffix: 950, 1.2k, 34M
+//	bytes n            n bytes in binary units: 512B, 1.5K, 20M, 3.1G
+//	duration d         d (a time.Duration, a duration string or seconds) as
+//	                   duration renders it: 350ms, 4.2s, 1m05s
+//	join sep list      list's elements joined with sep
+//	regexMatch re s    whether s matches re
+//	regexFind re s     the first match of re in s (or its first group, if it
+//	                   has one), "" if none
+//	now                the current time
+//	date layout t      t (a time or epoch seconds) formatted with a Go layout
+//	segment priority   whether to render a segment; see below
+//
+// When the output has to fit in a known number of columns (.columns), parts
+// of the template can be made droppable:
+//
+//	{{ .working_directory }}{{ if segment 2 }} {{ .git.Branch }}{{ end }}{{ if segment 1 }} {{ .kube }}{{ end }}
+//
+// If the output is too wide, segments are dropped lowest priority first
+// (kube, then the branch) until it fits. Width ignores dialect markup.
+var templateFuncs = template.FuncMap{
+	"truncate":   truncateString,
+	"padLeft":    func(n int, v interface{}) string { return padString(n, v, true) },
+	"padRight":   func(n int, v interface{}) string { return padString(n, v, false) },
+	"width":      func(v interface{}) int { return displayWidth(toString(v)) },
+	"upper":      func(v interface{}) string { return strings.ToUpper(toString(v)) },
+	"lower":      func(v interface{}) string { return strings.ToLower(toString(v)) },
+	"trim":       func(v interface{}) string { return strings.TrimSpace(toString(v)) },
+	"replace":    func(old, new string, v interface{}) string { return strings.ReplaceAll(toString(v), old, new) },
+	"default":    defaultValue,
+	"coalesce":   coalesce,
+	"ternary":    ternary,
+	"round":      round,
+	"si":         siNumber,
+	"bytes":      byteSize,
+	"duration":   formatDuration,
+	"join":       join,
+	"regexMatch": regexMatch,
+	"regexFind":  regexFind,
+	"now":        time.Now,
+	"date":       formatDate,
+
+	// Replaced per render by executeFitted when it's fitting to a width.
+	segmentFuncName: func(priority int) bool { return true },
+}
+
+const segmentFuncName = "segment"
+
+// toString formats v the way text/template would print it, except that nil
+// is empty rather than "<no value>".
+func toString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case Markup:
+		return string(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// toFloat converts any number, or a string holding one, to a float64.
+func toFloat(v interface{}) (float64, error) {
+	switch v := v.(type) {
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return 0, fmt.Errorf("%q is not a number", v)
+		}
+		return f, nil
+	case time.Duration:
+		return v.Seconds(), nil
+	}
+	value := reflect.ValueOf(v)
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(value.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(value.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return value.Float(), nil
+	}
+	return 0, fmt.Errorf("%v (%T) is not a number", v, v)
+}
+
+func truncateString(n int, v interface{}) string {
+	return truncateWidth(toString(v), n)
+}
+
+func padString(n int, v interface{}, left bool) string {
+	s := toString(v)
+	padding := n - displayWidth(s)
+	if padding <= 0 {
+		return s
+	}
+	if left {
+		return strings.Repeat(" ", padding) + s
+	}
+	return s + strings.Repeat(" ", padding)
+}
+
+// isEmpty is text/template's notion of false, with nil pointers and
+// interfaces looked through.
+func isEmpty(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	value := reflect.ValueOf(v)
+	switch value.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		return value.IsNil()
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array, reflect.Chan:
+		return value.Len() == 0
+	case reflect.Struct:
+		return false
+	}
+	return value.IsZero()
+}
+
+func defaultValue(d interface{}, v ...interface{}) interface{} {
+	// v is variadic so that a missing value ({{ default "x" }} at the end
+	// of a pipeline that rendered nothing) counts as empty.
+	if len(v) == 0 || isEmpty(v[0]) {
+		return d
+	}
+	return v[0]
+}
+
+func coalesce(values ...interface{}) interface{} {
+	for _, v := range values {
+		if !isEmpty(v) {
+			return v
+		}
+	}
+	return nil
+}
+
+func ternary(a, b interface{}, cond interface{}) interface{} {
+	if !isEmpty(cond) {
+		return a
+	}
+	return b
+}
+
+func round(places int, v interface{}) (float64, error) {
+	f, err := toFloat(v)
+	if err != nil {
+		return 0, err
+	}
+	scale := math.Pow(10, float64(places))
+	return math.Round(f*scale) / scale, nil
+}
+
+// scaleNumber formats n with the largest of units it reaches, one decimal
+// place below 10 and none above.
+func scaleNumber(n float64, base float64, units []string) string {
+	sign := ""
+	if n < 0 {
+		sign, n = "-", -n
+	}
+	unit := 0
+	for n >= base && unit < len(units)-1 {
+		n /= base
+		unit++
+	}
+	if unit == 0 || n >= 10 {
+		return fmt.Sprintf("%s%.0f%s", sign, math.Floor(n), units[unit])
+	}
+	return fmt.Sprintf("%s%.1f%s", sign, math.Floor(n*10)/10, units[unit])
+}
+
+func siNumber(v interface{}) (string, error) {
+	f, err := toFloat(v)
+	if err != nil {
+		return "", err
+	}
+	return scaleNumber(f, 1000, []string{"", "k", "M", "G", "T", "P"}), nil
+}
+
+func byteSize(v interface{}) (string, error) {
+	f, err := toFloat(v)
+	if err != nil {
+		return "", err
+	}
+	return scaleNumber(f, 1024, []string{"B", "K", "M", "G", "T", "P"}), nil
+}
+
+func formatDuration(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case time.Duration:
+		return humanizeDuration(v), nil
+	case DurationResult:
+		return v.Human, nil
+	case string:
+		if d, err := time.ParseDuration(v); err == nil {
+			return humanizeDuration(d), nil
+		}
+	}
+	seconds, err := toFloat(v)
+	if err != nil {
+		return "", err
+	}
+	return humanizeDuration(time.Duration(seconds * float64(time.Second))), nil
+}
+
+func join(sep string, list interface{}) (string, error) {
+	switch list := list.(type) {
+	case nil:
+		return "", nil
+	case []string:
+		return strings.Join(list, sep), nil
+	}
+	value := reflect.ValueOf(list)
+	if value.Kind() != reflect.Slice && value.Kind() != reflect.Array {
+		return "", fmt.Errorf("join: %T is not a list", list)
+	}
+	parts := make([]string, value.Len())
+	for i := range parts {
+		parts[i] = toString(value.Index(i).Interface())
+	}
+	return strings.Join(parts, sep), nil
+}
+
+// templateRegexps caches compiled patterns, since the same template (and
+// so the same patterns) is rendered over and over.
+var templateRegexps sync.Map
+
+func compileTemplateRegexp(pattern string) (*regexp.Regexp, error) {
+	if re, ok := templateRegexps.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	templateRegexps.Store(pattern, re)
+	return re, nil
+}
+
+func regexMatch(pattern string, v interface{}) (bool, error) {
+	re, err := compileTemplateRegexp(pattern)
+	if err != nil {
+		return false, err
+	}
+	return re.MatchString(toString(v)), nil
+}
+
+func regexFind(pattern string, v interface{}) (string, error) {
+	re, err := compileTemplateRegexp(pattern)
+	if err != nil {
+		return "", err
+	}
+	match := re.FindStringSubmatch(toString(v))
+	switch {
+	case match == nil:
+		return "", nil
+	case len(match) > 1:
+		return match[1], nil
+	default:
+		return match[0], nil
+	}
+}
+
+func formatDate(layout string, v interface{}) (string, error) {
+	switch t := v.(type) {
+	case time.Time:
+		return t.Format(layout), nil
+	case *time.Time:
+		if t == nil {
+			return "", nil
+		}
+		return t.Format(layout), nil
+	case nil:
+		return "", nil
+	}
+	seconds, err := toFloat(v)
+	if err != nil {
+		return "", fmt.Errorf("date: %w", err)
+	}
+	whole, fraction := math.Modf(seconds)
+	return time.Unix(int64(whole), int64(fraction*1e9)).Format(layout), nil
+}
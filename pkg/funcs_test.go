@@ -0,0 +1,53 @@
+package pkg
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTemplateStringFuncs(t *testing.T) {
+	require.Equal(t, "feature/lon…", renderDialect(t, DialectPlain, `{{ "feature/long-branch" | truncate 12 }}`))
+	require.Equal(t, "short", renderDialect(t, DialectPlain, `{{ "short" | truncate 12 }}`))
+	require.Equal(t, "   ab|ab   |abcd", renderDialect(t, DialectPlain, `{{ "ab" | padLeft 5 }}|{{ "ab" | padRight 5 }}|{{ "abcd" | padLeft 2 }}`))
+	require.Equal(t, "MAIN dev x", renderDialect(t, DialectPlain, `{{ "main" | upper }} {{ "DEV" | lower }} {{ "  x  " | trim }}`))
+	require.Equal(t, "feature-x", renderDialect(t, DialectPlain, `{{ "feature/x" | replace "/" "-" }}`))
+	require.Equal(t, "", renderDialect(t, DialectPlain, `{{ truncate 0 "x" }}{{ upper nil }}`))
+}
+
+func TestTemplateDefaultingFuncs(t *testing.T) {
+	require.Equal(t, "default|x|0|none", renderDialect(t, DialectPlain, `{{ "" | default "default" }}|{{ "x" | default "y" }}|{{ 0 | default 0 }}|{{ default "none" nil }}`))
+	require.Equal(t, "b", renderDialect(t, DialectPlain, `{{ coalesce "" nil "b" "c" }}`))
+	require.Equal(t, "yes no", renderDialect(t, DialectPlain, `{{ true | ternary "yes" "no" }} {{ ternary "yes" "no" "" }}`))
+}
+
+func TestTemplateNumberFuncs(t *testing.T) {
+	require.Equal(t, "3.14 950 1.2k 34M -1.5k", renderDialect(t, DialectPlain, `{{ round 2 3.14159 }} {{ si 950 }} {{ si 1234 }} {{ si 34000000 }} {{ si -1500 }}`))
+	require.Equal(t, "512B 1.5K 20M 3.2G", renderDialect(t, DialectPlain, `{{ bytes 512 }} {{ bytes 1536 }} {{ bytes 20971520 }} {{ bytes "3435973837" }}`))
+	require.Equal(t, "350ms 4.2s 1m05s 2h03m", renderDialect(t, DialectPlain, `{{ duration "350ms" }} {{ duration 4.2 }} {{ duration 65 }} {{ duration "2h3m" }}`))
+
+	_, err := GenerateContent(context.Background(), NewMemoryStateStore(), Location{Template: `{{ bytes "lots" }}`}, "pane", testTmuxInstance, "/tmp", 0, nil)
+	require.ErrorContains(t, err, `"lots" is not a number`)
+}
+
+func TestTemplateListAndRegexFuncs(t *testing.T) {
+	joined, err := join(", ", []interface{}{"a", "b", 3})
+	require.NoError(t, err)
+	require.Equal(t, "a, b, 3", joined)
+	_, err = join(", ", "a")
+	require.Error(t, err)
+
+	require.Equal(t, "true false", renderDialect(t, DialectPlain, `{{ regexMatch "^feat" "feature/x" }} {{ "main" | regexMatch "^feat" }}`))
+	require.Equal(t, "ABC-123|ABC-123|", renderDialect(t, DialectPlain, `{{ "pj/ABC-123-fix" | regexFind "[A-Z]+-[0-9]+" }}|{{ "x/ABC-123" | regexFind "/(.*)" }}|{{ "main" | regexFind "[0-9]+" }}`))
+}
+
+func TestTemplateDateFuncs(t *testing.T) {
+	local := time.Local
+	time.Local = time.UTC
+	t.Cleanup(func() { time.Local = local })
+
+	require.Equal(t, "2023-11-14 22:13", renderDialect(t, DialectPlain, `{{ 1700000000 | date "2006-01-02 15:04" }}`))
+	require.Equal(t, time.Now().Format("2006"), renderDialect(t, DialectPlain, `{{ now | date "2006" }}`))
+}
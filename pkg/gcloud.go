@@ -0,0 +1,92 @@
+package pkg
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// GCloudResult is the active gcloud configuration, exposed to templates as
+// .gcloud. Printing it directly ({{ .gcloud }}) gives the project.
+type GCloudResult struct {
+	// Configuration is the name of the active named configuration.
+	Configuration string
+	Account       string
+	Project       string
+	Region        string
+	Zone          string
+}
+
+func (r GCloudResult) String() string {
+	return r.Project
+}
+
+// gcloudConfigDir is where gcloud keeps its configuration: $CLOUDSDK_CONFIG,
+// or ~/.config/gcloud.
+func gcloudConfigDir(getenv func(string) string) (string, error) {
+	if dir := getenv("CLOUDSDK_CONFIG"); dir != "" {
+		return dir, nil
+	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(homeDir, ".config", "gcloud"), nil
+}
+
+// gcloudActiveConfigName resolves the active configuration the way gcloud
+// does: $CLOUDSDK_ACTIVE_CONFIG_NAME, then the active_config file, then
+// "default".
+func gcloudActiveConfigName(getenv func(string) string, configDir string) string {
+	if name := getenv("CLOUDSDK_ACTIVE_CONFIG_NAME"); name != "" {
+		return name
+	}
+	content, err := os.ReadFile(filepath.Join(configDir, "active_config"))
+	if err == nil {
+		if name := strings.TrimSpace(string(content)); name != "" {
+			return name
+		}
+	}
+	return "default"
+}
+
+// gcloudProperty reads section/key from the configuration, letting a
+// CLOUDSDK_<SECTION>_<KEY> environment variable override it like gcloud does.
+func gcloudProperty(getenv func(string) string, config iniFile, section, key string) string {
+	if value := getenv("CLOUDSDK_" + strings.ToUpper(section) + "_" + strings.ToUpper(key)); value != "" {
+		return value
+	}
+	return config.get(section, key)
+}
+
+// readGCloudConfig resolves the active gcloud configuration from its files,
+// without running the (slow) gcloud CLI. It returns nil if gcloud has never
+// been configured on this machine.
+func readGCloudConfig(getenv func(string) string) (*GCloudResult, error) {
+	configDir, err := gcloudConfigDir(getenv)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(configDir); errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+
+	name := gcloudActiveConfigName(getenv, configDir)
+	config, err := parseINI(filepath.Join(configDir, "configurations", "config_"+name))
+	if errors.Is(err, os.ErrNotExist) {
+		// A configuration that was activated but never had anything set
+		// has no file yet; environment overrides still apply.
+		config = iniFile{}
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &GCloudResult{
+		Configuration: name,
+		Account:       gcloudProperty(getenv, config, "core", "account"),
+		Project:       gcloudProperty(getenv, config, "core", "project"),
+		Region:        gcloudProperty(getenv, config, "compute", "region"),
+		Zone:          gcloudProperty(getenv, config, "compute", "zone"),
+	}, nil
+}
@@ -0,0 +1,78 @@
+package pkg
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func clearGCloudEnv(t *testing.T, configDir string) {
+	t.Helper()
+	t.Setenv("CLOUDSDK_CONFIG", configDir)
+	for _, name := range []string{"CLOUDSDK_ACTIVE_CONFIG_NAME", "CLOUDSDK_CORE_PROJECT", "CLOUDSDK_CORE_ACCOUNT", "CLOUDSDK_COMPUTE_REGION", "CLOUDSDK_COMPUTE_ZONE"} {
+		t.Setenv(name, "")
+	}
+}
+
+func TestGCloudProjectReadsActiveConfiguration(t *testing.T) {
+	dir := t.TempDir()
+	clearGCloudEnv(t, dir)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "active_config"), []byte("work\n"), 0644))
+	writeTestFile(t, filepath.Join(dir, "configurations", "config_default"), "[core]\nproject = personal\n")
+	writeTestFile(t, filepath.Join(dir, "configurations", "config_work"), `[core]
+account = pj@example.com
+project = prod-project
+
+[compute]
+region = europe-west2
+zone = europe-west2-b
+`)
+
+	result, err := (&GCloudProject{}).Generate(context.Background(), "pane", testTmuxInstance, "/tmp", "")
+	require.NoError(t, err)
+	require.Equal(t, GCloudResult{
+		Configuration: "work",
+		Account:       "pj@example.com",
+		Project:       "prod-project",
+		Region:        "europe-west2",
+		Zone:          "europe-west2-b",
+	}, result)
+}
+
+func TestGCloudProjectHonoursEnvironmentOverrides(t *testing.T) {
+	dir := t.TempDir()
+	clearGCloudEnv(t, dir)
+	writeTestFile(t, filepath.Join(dir, "configurations", "config_default"), "[core]\nproject = personal\n")
+	writeTestFile(t, filepath.Join(dir, "configurations", "config_other"), "[core]\nproject = other-project\naccount = other@example.com\n")
+	t.Setenv("CLOUDSDK_ACTIVE_CONFIG_NAME", "other")
+	t.Setenv("CLOUDSDK_CORE_PROJECT", "override")
+
+	result, err := (&GCloudProject{}).Generate(context.Background(), "pane", testTmuxInstance, "/tmp", "")
+	require.NoError(t, err)
+	gcloud := result.(GCloudResult)
+	require.Equal(t, "other", gcloud.Configuration)
+	require.Equal(t, "override", gcloud.Project)
+	require.Equal(t, "other@example.com", gcloud.Account)
+	require.Equal(t, "override", gcloud.String())
+}
+
+func TestGCloudProjectDefaultsToDefaultConfiguration(t *testing.T) {
+	dir := t.TempDir()
+	clearGCloudEnv(t, dir)
+	writeTestFile(t, filepath.Join(dir, "configurations", "config_default"), "[core]\nproject = personal\n")
+
+	result, err := (&GCloudProject{}).Generate(context.Background(), "pane", testTmuxInstance, "/tmp", "")
+	require.NoError(t, err)
+	require.Equal(t, "personal", result.(GCloudResult).Project)
+}
+
+func TestGCloudProjectNotConfigured(t *testing.T) {
+	clearGCloudEnv(t, filepath.Join(t.TempDir(), "missing"))
+
+	result, err := (&GCloudProject{}).Generate(context.Background(), "pane", testTmuxInstance, "/tmp", "")
+	require.NoError(t, err)
+	require.Nil(t, result)
+}
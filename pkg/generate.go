@@ -2,45 +2,250 @@ package pkg
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"math"
+	"reflect"
+	"sync"
 	"text/template"
+	"time"
 )
 
-// GenerateContent takes a LocationConfig and generates content based on the operations and template
-func GenerateContent(state StateStore, config Location, locationKey LocationKey, instanceKey InstanceKey, locationPath string) (string, error) {
+// CompileTemplate parses a location's template. Callers that render the same
+// location repeatedly (e.g. the daemon) can compile once and reuse the result
+// with RenderContent.
+func CompileTemplate(config Location) (*template.Template, error) {
+	if !config.Dialect.valid() {
+		return nil, fmt.Errorf("unknown dialect: %s", config.Dialect)
+	}
+
+	tmpl, err := template.New("content").Funcs(config.Dialect.FuncMap()).Parse(config.Template)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing template: %w", err)
+	}
+	if config.Strict {
+		tmpl.Option("missingkey=error")
+		var problems []error
+		for _, problem := range analyzeTemplate(tmpl.Tree, operationResultTypes(config.Operations)) {
+			problems = append(problems, problem)
+		}
+		if len(problems) > 0 {
+			return nil, fmt.Errorf("error checking template: %w", errors.Join(problems...))
+		}
+	}
+	if config.Dialect.escapes() {
+		escapeTemplate(tmpl)
+	}
+
+	return tmpl, nil
+}
+
+// GenerateContent takes a LocationConfig and generates content based on the operations and template.
+//
+// Operations are generated concurrently, each bounded by its timeout; one that
+// times out renders as its configured placeholder instead of failing the
+// render. Any other failure is isolated the same way: the operation renders
+// as the zero value of its result type (see zeroResult) and its error is
+// available as {{ .errors.<name> }} (see ErrorsTemplateKey). Only a template error fails the render as a whole.
+//
+// Async operations (IsAsync() == true) render from the result Update last
+// cached for them, and if that is older than AsyncRefreshInterval, refresh is
+// called once after rendering so the caller can recompute it in the
+// background (e.g. via update --async-only). refresh may be nil. Only when
+// there is no cached result at all (a new pane, or after clear-state) is an
+// async operation generated during the render, and its result cached.
+func GenerateContent(ctx context.Context, state StateStore, config Location, locationKey LocationKey, instance Instance, locationPath string, columns int, refresh func()) (string, error) {
+	tmpl, err := CompileTemplate(config)
+	if err != nil {
+		return "", err
+	}
+
+	return RenderContent(ctx, state, config, tmpl, locationKey, instance, locationPath, columns, refresh)
+}
+
+// ErrorsTemplateKey is the template field operation failures are exposed
+// under: {{ .errors.git }} is the error the git operation failed with, or nil.
+// Every operation in the location has an entry, so the field is always safe to
+// reference. An operation named "errors" would be shadowed by it.
+const ErrorsTemplateKey = "errors"
+
+// ColumnsTemplateKey is the template field holding how many columns the
+// output has to fit in, 0 if unknown. Like .errors, it shadows an operation
+// of the same name.
+const ColumnsTemplateKey = "columns"
+
+// zeroResult is what an operation renders as when it failed: the zero value
+// of its result type (see ResultTyper), so that field access such as
+// {{ .kube.Namespace }} renders empty rather than failing the whole template,
+// or nil if the type isn't known.
+func zeroResult(op Operation) interface{} {
+	typer, ok := op.(ResultTyper)
+	if !ok || typer.ResultType() == nil {
+		return nil
+	}
+	return reflect.Zero(typer.ResultType()).Interface()
+}
+
+// RenderContent is GenerateContent with an already compiled template.
+func RenderContent(ctx context.Context, state StateStore, config Location, tmpl *template.Template, locationKey LocationKey, instance Instance, locationPath string, columns int, refresh func()) (string, error) {
+	ctx = withStateStore(ctx, state)
+	ctx = withInstance(ctx, instance)
 	// Create a map to store data from operations
 	data := make(map[string]interface{})
+	// A failing operation renders as its zero result (see zeroResult) with
+	// its error exposed to the template, rather than blanking the whole
+	// render.
+	operationErrors := make(map[string]error, len(config.Operations))
+	needsRefresh := false
+	now := time.Now()
 
-	// Load data from each operation
-	for _, opWrapper := range config.Operations {
+	// State is read up front, sequentially, so that only the operations
+	// themselves run concurrently and the state store never sees concurrent
+	// access from a single render.
+	operationStates := make([]string, len(config.Operations))
+	skip := make([]bool, len(config.Operations))
+	// Async operations with nothing cached yet, which are generated here
+	// like any other.
+	uncached := make([]bool, len(config.Operations))
+	for i, opWrapper := range config.Operations {
 		op := opWrapper.Operation
 		operationName := op.Name()
-		operationState, err := state.Get(locationKey, instanceKey, operationName)
+
+		data[string(operationName)] = zeroResult(op)
+		operationErrors[string(operationName)] = nil
+
+		if op.IsAsync() {
+			cached, err := loadCachedResult(state, locationKey, instance.Key, op)
+			if err != nil {
+				operationErrors[string(operationName)] = fmt.Errorf("error getting cached result: %w", err)
+				continue
+			}
+			if cached == nil {
+				uncached[i] = true
+			} else {
+				if cached.isStale(now) {
+					needsRefresh = true
+				}
+				if cached.Error != "" {
+					operationErrors[string(operationName)] = errors.New(cached.Error)
+				} else {
+					data[string(operationName)] = cached.Value
+				}
+				continue
+			}
+		}
+
+		operationState, err := state.Get(locationKey, instance.Key, operationName)
 		if err != nil {
-			return "", fmt.Errorf("error getting state for operation %s: %w", op.Name(), err)
+			operationErrors[string(operationName)] = fmt.Errorf("error getting state: %w", err)
+			skip[i] = true
+			continue
+		}
+		operationStates[i] = operationState
+	}
+
+	// Load data from each operation
+	results := make([]interface{}, len(config.Operations))
+	errs := make([]error, len(config.Operations))
+	var wg sync.WaitGroup
+	for i, opWrapper := range config.Operations {
+		if (opWrapper.Operation.IsAsync() && !uncached[i]) || skip[i] {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, opWrapper OperationWrapper) {
+			defer wg.Done()
+			results[i], errs[i] = runWithTimeout(ctx, opWrapper.timeout(), func(ctx context.Context) (interface{}, error) {
+				return opWrapper.Operation.Generate(ctx, locationKey, instance, locationPath, operationStates[i])
+			})
+		}(i, opWrapper)
+	}
+	wg.Wait()
+
+	for i, opWrapper := range config.Operations {
+		op := opWrapper.Operation
+		if (op.IsAsync() && !uncached[i]) || skip[i] {
+			continue
+		}
+		err := errs[i]
+		if uncached[i] {
+			if errors.Is(err, ErrOperationTimeout) {
+				// Left for the background refresh to finish.
+				needsRefresh = true
+			} else {
+				cached := cachedResult{Value: results[i], GeneratedAt: now}
+				if err != nil {
+					cached.Value = nil
+					cached.Error = err.Error()
+				}
+				if err := storeCachedResult(state, locationKey, instance.Key, op.Name(), cached); err != nil {
+					needsRefresh = true
+				}
+			}
 		}
-		// var operationStateInterface interface{}
-		// if err := json.Unmarshal([]byte(operationState), &operationStateInterface); err != nil {
-		// 	return "", fmt.Errorf("error unmarshaling state for operation %s: %w", op.Name(), err)
-		// }
-		result, err := op.Generate(locationKey, instanceKey, locationPath, operationState)
 		if err != nil {
-			return "", fmt.Errorf("error generating data for operation %s: %w", op.Name(), err)
+			operationErrors[string(op.Name())] = err
+			if errors.Is(err, ErrOperationTimeout) && opWrapper.Placeholder != nil {
+				data[string(op.Name())] = opWrapper.Placeholder
+			}
+			continue
 		}
-		data[string(op.Name())] = result
+		data[string(op.Name())] = results[i]
 	}
 
-	// Parse the template
-	tmpl, err := template.New("content").Parse(config.Template)
-	if err != nil {
-		return "", fmt.Errorf("error parsing template: %w", err)
+	data[ErrorsTemplateKey] = operationErrors
+	data[ColumnsTemplateKey] = columns
+
+	if needsRefresh && refresh != nil {
+		refresh()
+	}
+
+	return executeFitted(tmpl, data, config.Dialect, columns)
+}
+
+// executeFitted executes the template, and if the output is wider than
+// columns, executes it again without its least important segments ({{ if
+// segment N }}, lowest N first) until it fits or there are none left.
+func executeFitted(tmpl *template.Template, data map[string]interface{}, dialect Dialect, columns int) (string, error) {
+	execute := func(tmpl *template.Template) (string, error) {
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return "", fmt.Errorf("error executing template: %w", err)
+		}
+		return buf.String(), nil
+	}
+	if columns <= 0 {
+		return execute(tmpl)
 	}
 
-	// Execute the template with the data
-	var buf bytes.Buffer
-	if err := tmpl.Execute(&buf, data); err != nil {
-		return "", fmt.Errorf("error executing template: %w", err)
+	// Priorities are only known once the template has asked for them,
+	// and a dropped segment can hide others nested inside it.
+	dropped := math.MinInt
+	priorities := map[int]bool{}
+	fitted, err := tmpl.Clone()
+	if err != nil {
+		return "", err
 	}
+	fitted.Funcs(template.FuncMap{segmentFuncName: func(priority int) bool {
+		priorities[priority] = true
+		return priority > dropped
+	}})
 
-	return buf.String(), nil
+	for {
+		out, err := execute(fitted)
+		if err != nil || visibleWidth(dialect, out) <= columns {
+			return out, err
+		}
+		next := math.MaxInt
+		for priority := range priorities {
+			if priority > dropped && priority < next {
+				next = priority
+			}
+		}
+		if next == math.MaxInt {
+			return out, nil
+		}
+		dropped = next
+	}
 }
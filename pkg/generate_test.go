@@ -1,8 +1,12 @@
 package pkg
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -15,7 +19,7 @@ type MockOperationState struct {
 	Bar string `json:"bar"`
 }
 
-func (m *MockOperation) Generate(locationKey LocationKey, instanceKey InstanceKey, locationPath string, state string) (interface{}, error) {
+func (m *MockOperation) Generate(ctx context.Context, locationKey LocationKey, instance Instance, locationPath string, state string) (interface{}, error) {
 	var mockState MockOperationState
 	err := json.Unmarshal([]byte(state), &mockState)
 	if err != nil {
@@ -36,7 +40,7 @@ func (m *MockOperation) IsAsync() bool {
 	return false
 }
 
-func (m *MockOperation) Update(string, string) (string, error) {
+func (m *MockOperation) Update(context.Context, string, string) (string, error) {
 	return "", nil
 }
 
@@ -44,7 +48,7 @@ type MockOperation2 struct {
 	Baz string
 }
 
-func (m *MockOperation2) Generate(locationKey LocationKey, instanceKey InstanceKey, locationPath string, state string) (interface{}, error) {
+func (m *MockOperation2) Generate(ctx context.Context, locationKey LocationKey, instance Instance, locationPath string, state string) (interface{}, error) {
 	return map[string]string{
 		"baz": m.Baz,
 	}, nil
@@ -58,7 +62,7 @@ func (m *MockOperation2) IsAsync() bool {
 	return false
 }
 
-func (m *MockOperation2) Update(string, string) (string, error) {
+func (m *MockOperation2) Update(context.Context, string, string) (string, error) {
 	return "", nil
 }
 
@@ -85,8 +89,242 @@ func TestGenerateContent(t *testing.T) {
 
 	memoryStateStore := NewMemoryStateStore()
 
-	memoryStateStore.Set(LocationKey("pane"), InstanceKey("test"), OperationName("test"), `{"bar": "bar"}`)
-	content, err := GenerateContent(memoryStateStore, config.Configs["pane"], LocationKey("pane"), InstanceKey("test"), "/Users/pauljohnson/Programming/commandline_thing")
+	memoryStateStore.Set(LocationKey("pane"), testShellInstance.Key, OperationName("test"), `{"bar": "bar"}`)
+	content, err := GenerateContent(context.Background(), memoryStateStore, config.Configs["pane"], LocationKey("pane"), testShellInstance, "/Users/pauljohnson/Programming/commandline_thing", 0, nil)
 	require.NoError(t, err)
 	require.Equal(t, "test > foo > bar > baz", content)
 }
+
+type MockAsyncOperation struct {
+	generated int
+}
+
+func (m *MockAsyncOperation) Generate(ctx context.Context, locationKey LocationKey, instance Instance, locationPath string, state string) (interface{}, error) {
+	m.generated++
+	return map[string]string{"value": state}, nil
+}
+
+func (m *MockAsyncOperation) Name() OperationName {
+	return "slow"
+}
+
+func (m *MockAsyncOperation) IsAsync() bool {
+	return true
+}
+
+func (m *MockAsyncOperation) Update(_ context.Context, _ string, state string) (string, error) {
+	return state + "x", nil
+}
+
+func TestGenerateContentRendersAsyncOperationFromCache(t *testing.T) {
+	op := &MockAsyncOperation{}
+	config := Location{
+		Operations: []OperationWrapper{{Operation: op}},
+		Template:   "[{{ with .slow }}{{ .value }}{{ end }}]",
+	}
+	store := NewMemoryStateStore()
+
+	refreshes := 0
+	refresh := func() { refreshes++ }
+
+	// Nothing cached yet: the operation is generated during the render, and
+	// its result cached.
+	content, err := GenerateContent(context.Background(), store, config, "pane", testTmuxInstance, "/tmp", 0, refresh)
+	require.NoError(t, err)
+	require.Equal(t, "[]", content)
+	require.Equal(t, 0, refreshes)
+	require.Equal(t, 1, op.generated)
+
+	require.NoError(t, Update(context.Background(), store, config, "pane", testTmuxInstance, "/tmp"))
+	require.Equal(t, 2, op.generated)
+
+	// Fresh cache: served as-is, no refresh.
+	content, err = GenerateContent(context.Background(), store, config, "pane", testTmuxInstance, "/tmp", 0, refresh)
+	require.NoError(t, err)
+	require.Equal(t, "[x]", content)
+	require.Equal(t, 0, refreshes)
+	require.Equal(t, 2, op.generated)
+}
+
+func TestGenerateContentRefreshesStaleAsyncResult(t *testing.T) {
+	config := Location{
+		Operations: []OperationWrapper{{Operation: &MockAsyncOperation{}}},
+		Template:   "{{ .slow.value }}",
+	}
+	store := NewMemoryStateStore()
+	require.NoError(t, storeCachedResult(store, "pane", "tmux.%1", "slow", cachedResult{
+		Value:       map[string]string{"value": "old"},
+		GeneratedAt: time.Now().Add(-2 * AsyncRefreshInterval),
+	}))
+
+	refreshes := 0
+	content, err := GenerateContent(context.Background(), store, config, "pane", testTmuxInstance, "/tmp", 0, func() { refreshes++ })
+	require.NoError(t, err)
+	require.Equal(t, "old", content, "stale results are still rendered while the refresh runs")
+	require.Equal(t, 1, refreshes)
+}
+
+func TestGenerateContentRendersCachedResultAsItsType(t *testing.T) {
+	config := Location{
+		Operations: []OperationWrapper{{Operation: &Git{}}},
+		Template:   "{{ with .git }}{{ .Branch }}{{ if gt .Ahead 0 }} ↑{{ .Ahead }}{{ end }}{{ end }}",
+	}
+	store := NewMemoryStateStore()
+	require.NoError(t, storeCachedResult(store, "pane", testTmuxInstance.Key, "git", cachedResult{
+		Value:       GitResult{Branch: "main", Ahead: 2},
+		GeneratedAt: time.Now(),
+	}))
+
+	content, err := GenerateContent(context.Background(), store, config, "pane", testTmuxInstance, "/tmp", 0, nil)
+	require.NoError(t, err)
+	require.Equal(t, "main ↑2", content)
+
+	// Outside a repository Git generates nil, which has to stay nil rather
+	// than become an empty GitResult.
+	require.NoError(t, storeCachedResult(store, "pane", testTmuxInstance.Key, "git", cachedResult{GeneratedAt: time.Now()}))
+	content, err = GenerateContent(context.Background(), store, config, "pane", testTmuxInstance, "/tmp", 0, nil)
+	require.NoError(t, err)
+	require.Equal(t, "", content)
+}
+
+// MockHangingOperation ignores its context entirely, like an operation stuck
+// in a syscall on a dead network mount.
+type MockHangingOperation struct {
+	release chan struct{}
+}
+
+func (m *MockHangingOperation) Generate(ctx context.Context, locationKey LocationKey, instance Instance, locationPath string, state string) (interface{}, error) {
+	<-m.release
+	return "too late", nil
+}
+
+func (m *MockHangingOperation) Name() OperationName {
+	return "hang"
+}
+
+func (m *MockHangingOperation) IsAsync() bool {
+	return false
+}
+
+func (m *MockHangingOperation) Update(_ context.Context, _ string, state string) (string, error) {
+	<-m.release
+	return state, nil
+}
+
+func TestGenerateContentRendersPlaceholderForTimedOutOperation(t *testing.T) {
+	hanging := &MockHangingOperation{release: make(chan struct{})}
+	defer close(hanging.release)
+
+	config := Location{
+		Operations: []OperationWrapper{
+			{Operation: hanging, Timeout: 20 * time.Millisecond, Placeholder: "…"},
+			{Operation: &MockOperation2{Baz: "baz"}},
+		},
+		Template: "{{ .hang }} {{ .test2.baz }}",
+	}
+
+	start := time.Now()
+	content, err := GenerateContent(context.Background(), NewMemoryStateStore(), config, "pane", testTmuxInstance, "/tmp", 0, nil)
+	require.NoError(t, err)
+	require.Equal(t, "… baz", content)
+	require.Less(t, time.Since(start), time.Second)
+}
+
+func TestUpdateReportsTimedOutOperation(t *testing.T) {
+	hanging := &MockHangingOperation{release: make(chan struct{})}
+	defer close(hanging.release)
+
+	config := Location{
+		Operations: []OperationWrapper{{Operation: hanging, Timeout: 20 * time.Millisecond}},
+	}
+
+	err := Update(context.Background(), NewMemoryStateStore(), config, "pane", testTmuxInstance, "/tmp")
+	require.ErrorIs(t, err, ErrOperationTimeout)
+}
+
+type MockFailingOperation struct{}
+
+func (m *MockFailingOperation) Generate(ctx context.Context, locationKey LocationKey, instance Instance, locationPath string, state string) (interface{}, error) {
+	return nil, errors.New("boom")
+}
+
+func (m *MockFailingOperation) Name() OperationName {
+	return "broken"
+}
+
+func (m *MockFailingOperation) IsAsync() bool {
+	return false
+}
+
+func (m *MockFailingOperation) Update(context.Context, string, string) (string, error) {
+	return "", errors.New("update boom")
+}
+
+func TestGenerateContentIsolatesFailingOperation(t *testing.T) {
+	config := Location{
+		Operations: []OperationWrapper{
+			{Operation: &MockFailingOperation{}},
+			{Operation: &MockOperation2{Baz: "baz"}},
+		},
+		Template: "{{ .test2.baz }}{{ with .errors.broken }} ({{ . }}){{ end }}{{ if .errors.test2 }} unexpected{{ end }}",
+	}
+
+	content, err := GenerateContent(context.Background(), NewMemoryStateStore(), config, "pane", testTmuxInstance, "/tmp", 0, nil)
+	require.NoError(t, err)
+	require.Equal(t, "baz (boom)", content)
+}
+
+// MockFailingTypedOperation fails like MockFailingOperation, but declares a
+// result type whose fields templates read.
+type MockFailingTypedOperation struct{ MockFailingOperation }
+
+func (*MockFailingTypedOperation) ResultType() reflect.Type { return reflect.TypeOf(KubeResult{}) }
+
+func TestGenerateContentRendersFailedOperationAsZeroResult(t *testing.T) {
+	config := Location{
+		Operations: []OperationWrapper{
+			{Operation: &MockFailingTypedOperation{}},
+			{Operation: &MockOperation2{Baz: "baz"}},
+		},
+		Template: "[{{ .broken.Namespace }}] {{ .test2.baz }}{{ with .errors.broken }} ({{ . }}){{ end }}",
+	}
+
+	content, err := GenerateContent(context.Background(), NewMemoryStateStore(), config, "pane", testTmuxInstance, "/tmp", 0, nil)
+	require.NoError(t, err, "field access on a failed operation doesn't fail the render")
+	require.Equal(t, "[] baz (boom)", content)
+}
+
+func TestGenerateContentExposesCachedAsyncError(t *testing.T) {
+	config := Location{
+		Operations: []OperationWrapper{{Operation: &MockAsyncOperation{}}},
+		Template:   "{{ .errors.slow }}",
+	}
+	store := NewMemoryStateStore()
+	require.NoError(t, storeCachedResult(store, "pane", "tmux.%1", "slow", cachedResult{
+		Error:       "not a git repository",
+		GeneratedAt: time.Now(),
+	}))
+
+	content, err := GenerateContent(context.Background(), store, config, "pane", testTmuxInstance, "/tmp", 0, nil)
+	require.NoError(t, err)
+	require.Equal(t, "not a git repository", content)
+}
+
+func TestGenerateContentDropsSegmentsToFit(t *testing.T) {
+	config := Location{
+		Dialect:  DialectTmux,
+		Template: `{{ fg "red" }}main{{ if segment 3 }} ~/src/project{{ end }}{{ if segment 1 }} ctx:prod{{ if segment 5 }}!{{ end }}{{ end }}{{ if segment 2 }} 12:00{{ end }} [{{ .columns }}]`,
+	}
+	render := func(columns int) string {
+		content, err := GenerateContent(context.Background(), NewMemoryStateStore(), config, "pane", testTmuxInstance, "/tmp", columns, nil)
+		require.NoError(t, err)
+		return content
+	}
+
+	require.Equal(t, "#[fg=red]main ~/src/project ctx:prod! 12:00 [0]", render(0), "unknown width renders everything")
+	require.Equal(t, "#[fg=red]main ~/src/project ctx:prod! 12:00 [40]", render(40))
+	require.Equal(t, "#[fg=red]main ~/src/project 12:00 [30]", render(30), "priority 1 goes first, taking what's nested in it")
+	require.Equal(t, "#[fg=red]main ~/src/project [25]", render(25))
+	require.Equal(t, "#[fg=red]main [10]", render(10))
+	require.Equal(t, "#[fg=red]main [5]", render(5), "without segments left it renders as is")
+}
@@ -0,0 +1,473 @@
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GitResult is what the git operation exposes to templates as .git. It's nil
+// outside a git repository.
+type GitResult struct {
+	// Branch is the checked out branch, or "HEAD" when detached.
+	Branch string
+	// Commit is the full object name of HEAD, empty before the first commit.
+	Commit      string
+	ShortCommit string
+	Detached    bool
+
+	// Upstream is the tracked branch (e.g. "origin/main"), empty if none;
+	// Ahead/Behind count commits relative to it.
+	Upstream string
+	Ahead    int
+	Behind   int
+
+	Staged     int
+	Modified   int
+	Untracked  int
+	Conflicted int
+	Stashes    int
+
+	// Operation is the operation in progress, if any: "rebase", "am",
+	// "merge", "cherry-pick", "revert" or "bisect".
+	Operation string
+
+	// Status is the working tree status as `git status -s` prints it
+	// ("XY path" per changed path), so it's empty exactly when the working
+	// tree is clean.
+	Status string
+	// Entries are the same changes as `git status --porcelain=v2` records,
+	// one per changed path, for templates that need more than Status has.
+	Entries []string
+}
+
+// errNotGitRepository is returned by findGitDir when path isn't inside a
+// working tree.
+var errNotGitRepository = errors.New("not a git repository")
+
+// findGitDir walks up from path to the enclosing working tree, returning its
+// root and git directory. A `.git` file (as used by worktrees and submodules)
+// is followed to the directory it points at.
+func findGitDir(path string) (workTree string, gitDir string, err error) {
+	dir, err := filepath.Abs(path)
+	if err != nil {
+		return "", "", err
+	}
+
+	for {
+		dotGit := filepath.Join(dir, ".git")
+		info, err := os.Stat(dotGit)
+		if err == nil {
+			if info.IsDir() {
+				return dir, dotGit, nil
+			}
+			gitDir, err := readGitFile(dotGit)
+			if err != nil {
+				return "", "", err
+			}
+			return dir, gitDir, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return "", "", err
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", "", errNotGitRepository
+		}
+		dir = parent
+	}
+}
+
+// readGitFile resolves a `.git` file's "gitdir: <path>" line, relative to the
+// file's own directory.
+func readGitFile(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	line := strings.TrimSpace(string(content))
+	gitDir, ok := strings.CutPrefix(line, "gitdir: ")
+	if !ok {
+		return "", fmt.Errorf("invalid .git file %s", path)
+	}
+	if !filepath.IsAbs(gitDir) {
+		gitDir = filepath.Join(filepath.Dir(path), gitDir)
+	}
+	return filepath.Clean(gitDir), nil
+}
+
+// gitOperationInProgress detects an interrupted rebase, merge, etc. the same
+// way git's own prompt script (git-prompt.sh) does: by the marker files it
+// leaves in the git directory.
+func gitOperationInProgress(gitDir string) string {
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(gitDir, name))
+		return err == nil
+	}
+
+	switch {
+	case exists("rebase-merge"):
+		return "rebase"
+	case exists("rebase-apply"):
+		if exists(filepath.Join("rebase-apply", "applying")) {
+			return "am"
+		}
+		return "rebase"
+	case exists("MERGE_HEAD"):
+		return "merge"
+	case exists("CHERRY_PICK_HEAD"):
+		return "cherry-pick"
+	case exists("REVERT_HEAD"):
+		return "revert"
+	case exists("BISECT_LOG"):
+		return "bisect"
+	}
+	return ""
+}
+
+// gitCommonDir is where refs shared by every worktree live: the main
+// repository's git directory. A linked worktree's git directory points at it
+// with a `commondir` file.
+func gitCommonDir(gitDir string) string {
+	content, err := os.ReadFile(filepath.Join(gitDir, "commondir"))
+	if err != nil {
+		return gitDir
+	}
+	commonDir := strings.TrimSpace(string(content))
+	if !filepath.IsAbs(commonDir) {
+		commonDir = filepath.Join(gitDir, commonDir)
+	}
+	return filepath.Clean(commonDir)
+}
+
+// gitHead is HEAD as read straight from the git directory.
+type gitHead struct {
+	// Branch is the short branch name, or "HEAD" when detached.
+	Branch   string
+	Commit   string
+	Detached bool
+}
+
+// readGitHead reads HEAD without running git: HEAD is either "ref: <ref>" or
+// a bare object name, and the ref resolves through a loose ref file or, for
+// refs git has packed, packed-refs. An unborn branch has no commit.
+func readGitHead(gitDir string) (gitHead, error) {
+	content, err := os.ReadFile(filepath.Join(gitDir, "HEAD"))
+	if err != nil {
+		return gitHead{}, err
+	}
+	head := strings.TrimSpace(string(content))
+
+	ref, ok := strings.CutPrefix(head, "ref: ")
+	if !ok {
+		return gitHead{Branch: "HEAD", Commit: head, Detached: true}, nil
+	}
+
+	commit, err := resolveGitRef(gitCommonDir(gitDir), ref)
+	if err != nil {
+		return gitHead{}, err
+	}
+	return gitHead{Branch: strings.TrimPrefix(ref, "refs/heads/"), Commit: commit}, nil
+}
+
+func resolveGitRef(commonDir string, ref string) (string, error) {
+	content, err := os.ReadFile(filepath.Join(commonDir, filepath.FromSlash(ref)))
+	if err == nil {
+		return strings.TrimSpace(string(content)), nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+
+	packed, err := os.ReadFile(filepath.Join(commonDir, "packed-refs"))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(packed))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") || strings.HasPrefix(line, "^") {
+			continue
+		}
+		oid, name, ok := strings.Cut(line, " ")
+		if ok && name == ref {
+			return oid, nil
+		}
+	}
+	return "", nil
+}
+
+// countGitStashes counts entries in the stash reflog, which is what
+// `git stash list` lists.
+func countGitStashes(gitDir string) int {
+	content, err := os.ReadFile(filepath.Join(gitCommonDir(gitDir), "logs", "refs", "stash"))
+	if err != nil {
+		return 0
+	}
+	return bytes.Count(content, []byte("\n"))
+}
+
+// gitStatusCacheTTL caps how long a cached status is reused even though the
+// index hasn't changed: editing a tracked file or creating an untracked one
+// doesn't touch the index, so without it those changes would never show up.
+const gitStatusCacheTTL = 3 * time.Second
+
+// gitStatusKey identifies the inputs a cached status was computed from. HEAD
+// is included because checking out a commit whose tree matches the index
+// leaves the index alone.
+type gitStatusKey struct {
+	IndexModTime int64  `json:"indexModTime"`
+	IndexSize    int64  `json:"indexSize"`
+	Head         string `json:"head"`
+}
+
+func readGitStatusKey(gitDir string) gitStatusKey {
+	var key gitStatusKey
+	if info, err := os.Stat(filepath.Join(gitDir, "index")); err == nil {
+		key.IndexModTime = info.ModTime().UnixNano()
+		key.IndexSize = info.Size()
+	}
+	if head, err := os.ReadFile(filepath.Join(gitDir, "HEAD")); err == nil {
+		key.Head = string(head)
+	}
+	return key
+}
+
+type gitStatusEntry struct {
+	Key        gitStatusKey `json:"key"`
+	ComputedAt time.Time    `json:"computedAt"`
+	Result     GitResult    `json:"result"`
+}
+
+// The shared statuses are kept in the state store, all together under a key
+// no location or instance has, as a JSON object of work tree to
+// gitStatusEntry.
+const (
+	gitStatusLocationKey   LocationKey   = "@shared"
+	gitStatusInstanceKey   InstanceKey   = "@shared"
+	gitStatusOperationName OperationName = "git_status"
+)
+
+// gitStatusFlight is a status being computed, for others wanting the same
+// one to wait for.
+type gitStatusFlight struct {
+	done   chan struct{}
+	result GitResult
+	err    error
+}
+
+// gitStatusCache shares `git status` results between every instance whose
+// location is inside the same working tree, so a dozen panes in one repository
+// cost one status rather than a dozen. Results are kept in the state store, so
+// they're shared between processes as well as within the daemon, and dropped
+// once they're older than gitStatusCacheTTL.
+type gitStatusCache struct {
+	mu       sync.Mutex
+	inFlight map[string]*gitStatusFlight
+}
+
+var sharedGitStatusCache = &gitStatusCache{inFlight: make(map[string]*gitStatusFlight)}
+
+// get returns the cached status for workTree, or computes it. Concurrent
+// callers in this process for the same working tree wait for a single
+// computation. store may be nil, in which case nothing is kept.
+func (c *gitStatusCache) get(ctx context.Context, store StateStore, workTree string, gitDir string, compute func(context.Context) (GitResult, error)) (GitResult, error) {
+	key := readGitStatusKey(gitDir)
+	c.mu.Lock()
+	entry, ok := c.load(store)[workTree]
+	if ok && entry.Key == key && time.Since(entry.ComputedAt) < gitStatusCacheTTL {
+		c.mu.Unlock()
+		return entry.Result, nil
+	}
+	if flight, ok := c.inFlight[workTree]; ok {
+		c.mu.Unlock()
+		select {
+		case <-flight.done:
+			return flight.result, flight.err
+		case <-ctx.Done():
+			return GitResult{}, ctx.Err()
+		}
+	}
+	flight := &gitStatusFlight{done: make(chan struct{})}
+	c.inFlight[workTree] = flight
+	c.mu.Unlock()
+
+	flight.result, flight.err = compute(ctx)
+
+	c.mu.Lock()
+	delete(c.inFlight, workTree)
+	if flight.err == nil {
+		// git status refreshes stale stat information in the index as a
+		// side effect, so key the entry on the index as it is now, not as
+		// it was.
+		c.store(store, workTree, gitStatusEntry{Key: readGitStatusKey(gitDir), ComputedAt: time.Now(), Result: flight.result})
+	}
+	c.mu.Unlock()
+	close(flight.done)
+	return flight.result, flight.err
+}
+
+// load reads every shared status. Failing to is treated as an empty cache.
+func (c *gitStatusCache) load(store StateStore) map[string]gitStatusEntry {
+	entries := map[string]gitStatusEntry{}
+	if store == nil {
+		return entries
+	}
+	raw, err := store.Get(gitStatusLocationKey, gitStatusInstanceKey, gitStatusOperationName)
+	if err != nil || raw == "" {
+		return entries
+	}
+	if err := json.Unmarshal([]byte(raw), &entries); err != nil {
+		return map[string]gitStatusEntry{}
+	}
+	return entries
+}
+
+// store saves entry for workTree, dropping every entry that's expired so
+// work trees no longer visited don't pile up. Another process saving at the
+// same time can lose its entry, which only costs it a cache miss.
+func (c *gitStatusCache) store(store StateStore, workTree string, entry gitStatusEntry) {
+	if store == nil {
+		return
+	}
+	entries := c.load(store)
+	for other, e := range entries {
+		if time.Since(e.ComputedAt) >= gitStatusCacheTTL {
+			delete(entries, other)
+		}
+	}
+	entries[workTree] = entry
+	raw, err := json.Marshal(entries)
+	if err != nil {
+		return
+	}
+	store.Set(gitStatusLocationKey, gitStatusInstanceKey, gitStatusOperationName, string(raw))
+}
+
+// gitStatus runs `git status --porcelain=v2 --branch` in workTree.
+func gitStatus(ctx context.Context, workTree string) (GitResult, error) {
+	cmd := exec.CommandContext(ctx, "git", "status", "--porcelain=v2", "--branch")
+	cmd.Dir = workTree
+	output, err := cmd.Output()
+	if err != nil {
+		return GitResult{}, fmt.Errorf("git status: %w", err)
+	}
+	return parsePorcelainV2(string(output)), nil
+}
+
+// parsePorcelainV2 parses the output of
+// `git status --porcelain=v2 --branch [--show-stash]`.
+func parsePorcelainV2(output string) GitResult {
+	var result GitResult
+	var shortLines []string
+
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+
+		if header, ok := strings.CutPrefix(line, "# "); ok {
+			key, value, _ := strings.Cut(header, " ")
+			switch key {
+			case "branch.oid":
+				if value != "(initial)" {
+					result.Commit = value
+				}
+			case "branch.head":
+				if value == "(detached)" {
+					result.Detached = true
+					result.Branch = "HEAD"
+				} else {
+					result.Branch = value
+				}
+			case "branch.upstream":
+				result.Upstream = value
+			case "branch.ab":
+				for _, field := range strings.Fields(value) {
+					n, _ := strconv.Atoi(field[1:])
+					if strings.HasPrefix(field, "+") {
+						result.Ahead = n
+					} else {
+						result.Behind = n
+					}
+				}
+			case "stash":
+				result.Stashes, _ = strconv.Atoi(value)
+			}
+			continue
+		}
+
+		result.Entries = append(result.Entries, line)
+		if short := shortStatusLine(line); short != "" {
+			shortLines = append(shortLines, short)
+		}
+		switch line[0] {
+		case '1', '2':
+			if len(line) < 4 {
+				continue
+			}
+			if line[2] != '.' {
+				result.Staged++
+			}
+			if line[3] != '.' {
+				result.Modified++
+			}
+		case 'u':
+			result.Conflicted++
+		case '?':
+			result.Untracked++
+		}
+	}
+
+	if len(result.Commit) >= 7 {
+		result.ShortCommit = result.Commit[:7]
+	}
+	result.Status = strings.Join(shortLines, "\n")
+	return result
+}
+
+// shortStatusLine converts a porcelain v2 entry to how `git status -s`
+// shows it, or "" if it isn't one: "1 .M ... path" is " M path", a rename
+// "2 R. ... new\told" is "R  old -> new", and "? path" is "?? path".
+func shortStatusLine(line string) string {
+	shortXY := func(xy string) string { return strings.ReplaceAll(xy, ".", " ") }
+	switch line[0] {
+	case '1':
+		fields := strings.SplitN(line, " ", 9)
+		if len(fields) == 9 {
+			return shortXY(fields[1]) + " " + fields[8]
+		}
+	case '2':
+		fields := strings.SplitN(line, " ", 10)
+		if len(fields) == 10 {
+			path, origPath, _ := strings.Cut(fields[9], "\t")
+			return shortXY(fields[1]) + " " + origPath + " -> " + path
+		}
+	case 'u':
+		fields := strings.SplitN(line, " ", 11)
+		if len(fields) == 11 {
+			return fields[1] + " " + fields[10]
+		}
+	case '?':
+		return "??" + line[1:]
+	case '!':
+		return "!!" + line[1:]
+	}
+	return ""
+}
@@ -0,0 +1,280 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePorcelainV2(t *testing.T) {
+	output := `# branch.oid 1234567890abcdef1234567890abcdef12345678
+# branch.head main
+# branch.upstream origin/main
+# branch.ab +2 -3
+# stash 4
+1 M. N... 100644 100644 100644 aaaa bbbb staged.go
+1 .M N... 100644 100644 100644 aaaa bbbb modified.go
+1 MM N... 100644 100644 100644 aaaa bbbb both.go
+2 R. N... 100644 100644 100644 aaaa bbbb R100 new.go	old.go
+u UU N... 100644 100644 100644 100644 aaaa bbbb cccc conflict.go
+? untracked.go
+? other.go
+`
+	result := parsePorcelainV2(output)
+
+	require.Equal(t, "main", result.Branch)
+	require.Equal(t, "1234567890abcdef1234567890abcdef12345678", result.Commit)
+	require.Equal(t, "1234567", result.ShortCommit)
+	require.False(t, result.Detached)
+	require.Equal(t, "origin/main", result.Upstream)
+	require.Equal(t, 2, result.Ahead)
+	require.Equal(t, 3, result.Behind)
+	require.Equal(t, 4, result.Stashes)
+	require.Equal(t, 3, result.Staged)
+	require.Equal(t, 2, result.Modified)
+	require.Equal(t, 1, result.Conflicted)
+	require.Equal(t, 2, result.Untracked)
+	require.Equal(t, "M  staged.go\n M modified.go\nMM both.go\nR  old.go -> new.go\nUU conflict.go\n?? untracked.go\n?? other.go", result.Status)
+	require.Len(t, result.Entries, 7)
+	require.Equal(t, "u UU N... 100644 100644 100644 100644 aaaa bbbb cccc conflict.go", result.Entries[4])
+}
+
+func TestParsePorcelainV2DetachedAndInitial(t *testing.T) {
+	result := parsePorcelainV2("# branch.oid (initial)\n# branch.head (detached)\n")
+	require.True(t, result.Detached)
+	require.Equal(t, "HEAD", result.Branch)
+	require.Empty(t, result.Commit)
+	require.Empty(t, result.Status, "a clean tree has no status entries")
+	require.Empty(t, result.Entries)
+}
+
+func TestGitOperationInProgress(t *testing.T) {
+	cases := map[string]string{
+		"rebase-merge":     "rebase",
+		"rebase-apply":     "rebase",
+		"MERGE_HEAD":       "merge",
+		"CHERRY_PICK_HEAD": "cherry-pick",
+		"REVERT_HEAD":      "revert",
+		"BISECT_LOG":       "bisect",
+	}
+	for marker, expected := range cases {
+		gitDir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(gitDir, marker), nil, 0644))
+		require.Equal(t, expected, gitOperationInProgress(gitDir), marker)
+	}
+
+	require.Empty(t, gitOperationInProgress(t.TempDir()))
+
+	gitDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(gitDir, "rebase-apply", "applying"), 0755))
+	require.Equal(t, "am", gitOperationInProgress(gitDir))
+}
+
+func TestFindGitDirFollowsGitFile(t *testing.T) {
+	root := t.TempDir()
+	worktree := filepath.Join(root, "worktree")
+	realGitDir := filepath.Join(root, "repo", ".git", "worktrees", "worktree")
+	require.NoError(t, os.MkdirAll(filepath.Join(worktree, "sub", "dir"), 0755))
+	require.NoError(t, os.MkdirAll(realGitDir, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(worktree, ".git"), []byte("gitdir: ../repo/.git/worktrees/worktree\n"), 0644))
+
+	workTree, gitDir, err := findGitDir(filepath.Join(worktree, "sub", "dir"))
+	require.NoError(t, err)
+	require.Equal(t, worktree, workTree)
+	require.Equal(t, realGitDir, gitDir)
+}
+
+func TestFindGitDirOutsideRepository(t *testing.T) {
+	_, _, err := findGitDir(t.TempDir())
+	require.ErrorIs(t, err, errNotGitRepository)
+}
+
+func runGit(t *testing.T, dir string, args ...string) {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_CONFIG_GLOBAL=/dev/null",
+		"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com",
+	)
+	output, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(output))
+}
+
+func TestGitGenerateAgainstRealRepository(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	dir := t.TempDir()
+	runGit(t, dir, "init", "-q", "-b", "main")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0644))
+	runGit(t, dir, "add", "a.txt")
+	runGit(t, dir, "commit", "-q", "-m", "initial")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a.txt"), []byte("changed"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "b.txt"), []byte("b"), 0644))
+
+	result, err := (&Git{}).Generate(context.Background(), "pane", testTmuxInstance, dir, "")
+	require.NoError(t, err)
+
+	git, ok := result.(GitResult)
+	require.True(t, ok)
+	require.Equal(t, "main", git.Branch)
+	require.Len(t, git.Commit, 40)
+	require.Equal(t, 1, git.Modified)
+	require.Equal(t, 1, git.Untracked)
+	require.Empty(t, git.Operation)
+}
+
+func TestGitGenerateOutsideRepositoryIsNil(t *testing.T) {
+	result, err := (&Git{}).Generate(context.Background(), "pane", testTmuxInstance, t.TempDir(), "")
+	require.NoError(t, err)
+	require.Nil(t, result)
+}
+
+// writeTestFile writes content to path, creating its directory as needed.
+func writeTestFile(t *testing.T, path, content string) {
+	t.Helper()
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+}
+
+func TestReadGitHeadResolvesLooseAndPackedRefs(t *testing.T) {
+	gitDir := t.TempDir()
+	writeTestFile(t, filepath.Join(gitDir, "HEAD"), "ref: refs/heads/feature/x\n")
+	writeTestFile(t, filepath.Join(gitDir, "refs/heads/feature/x"), "1111111111111111111111111111111111111111\n")
+
+	head, err := readGitHead(gitDir)
+	require.NoError(t, err)
+	require.Equal(t, gitHead{Branch: "feature/x", Commit: "1111111111111111111111111111111111111111"}, head)
+
+	writeTestFile(t, filepath.Join(gitDir, "HEAD"), "ref: refs/heads/main\n")
+	writeTestFile(t, filepath.Join(gitDir, "packed-refs"), "# pack-refs with: peeled fully-peeled sorted\n"+
+		"2222222222222222222222222222222222222222 refs/heads/main\n"+
+		"3333333333333333333333333333333333333333 refs/tags/v1\n"+
+		"^4444444444444444444444444444444444444444\n")
+
+	head, err = readGitHead(gitDir)
+	require.NoError(t, err)
+	require.Equal(t, gitHead{Branch: "main", Commit: "2222222222222222222222222222222222222222"}, head)
+}
+
+func TestReadGitHeadDetachedAndUnborn(t *testing.T) {
+	gitDir := t.TempDir()
+	writeTestFile(t, filepath.Join(gitDir, "HEAD"), "5555555555555555555555555555555555555555\n")
+
+	head, err := readGitHead(gitDir)
+	require.NoError(t, err)
+	require.Equal(t, gitHead{Branch: "HEAD", Commit: "5555555555555555555555555555555555555555", Detached: true}, head)
+
+	writeTestFile(t, filepath.Join(gitDir, "HEAD"), "ref: refs/heads/main\n")
+	head, err = readGitHead(gitDir)
+	require.NoError(t, err)
+	require.Equal(t, gitHead{Branch: "main"}, head)
+}
+
+func TestReadGitHeadInLinkedWorktreeUsesCommonDir(t *testing.T) {
+	commonDir := t.TempDir()
+	gitDir := filepath.Join(commonDir, "worktrees", "wt")
+	writeTestFile(t, filepath.Join(gitDir, "HEAD"), "ref: refs/heads/wt-branch\n")
+	writeTestFile(t, filepath.Join(gitDir, "commondir"), "../..\n")
+	writeTestFile(t, filepath.Join(commonDir, "refs/heads/wt-branch"), "6666666666666666666666666666666666666666\n")
+	writeTestFile(t, filepath.Join(commonDir, "logs/refs/stash"), "a\nb\n")
+
+	head, err := readGitHead(gitDir)
+	require.NoError(t, err)
+	require.Equal(t, "6666666666666666666666666666666666666666", head.Commit)
+	require.Equal(t, 2, countGitStashes(gitDir))
+}
+
+func TestGitStatusCacheSharesResultUntilIndexChanges(t *testing.T) {
+	gitDir := t.TempDir()
+	writeTestFile(t, filepath.Join(gitDir, "HEAD"), "ref: refs/heads/main\n")
+	writeTestFile(t, filepath.Join(gitDir, "index"), "v1")
+
+	cache := &gitStatusCache{inFlight: make(map[string]*gitStatusFlight)}
+	store := NewMemoryStateStore()
+	computed := 0
+	compute := func(context.Context) (GitResult, error) {
+		computed++
+		return GitResult{Modified: computed}, nil
+	}
+
+	first, err := cache.get(context.Background(), store, "/repo", gitDir, compute)
+	require.NoError(t, err)
+	second, err := cache.get(context.Background(), store, "/repo", gitDir, compute)
+	require.NoError(t, err)
+	require.Equal(t, 1, computed, "a second instance in the same repository reuses the status")
+	require.Equal(t, first, second)
+
+	writeTestFile(t, filepath.Join(gitDir, "index"), "version 2")
+	third, err := cache.get(context.Background(), store, "/repo", gitDir, compute)
+	require.NoError(t, err)
+	require.Equal(t, 2, computed, "a changed index invalidates the cached status")
+	require.Equal(t, 2, third.Modified)
+}
+
+func TestGitStatusCacheEvictsExpiredWorkTrees(t *testing.T) {
+	gitDir := t.TempDir()
+	writeTestFile(t, filepath.Join(gitDir, "HEAD"), "ref: refs/heads/main\n")
+
+	cache := &gitStatusCache{inFlight: make(map[string]*gitStatusFlight)}
+	store := NewMemoryStateStore()
+	cache.store(store, "/gone", gitStatusEntry{ComputedAt: time.Now().Add(-time.Hour)})
+	require.Contains(t, cache.load(store), "/gone")
+
+	_, err := cache.get(context.Background(), store, "/repo", gitDir, func(context.Context) (GitResult, error) {
+		return GitResult{}, nil
+	})
+	require.NoError(t, err)
+	entries := cache.load(store)
+	require.Contains(t, entries, "/repo")
+	require.NotContains(t, entries, "/gone", "expired entries are dropped")
+}
+
+// TestGitStatusHelperProcess isn't a real test: it's a separate process for
+// TestGitStatusCacheIsSharedBetweenProcesses, printing whether it had to
+// compute the status.
+func TestGitStatusHelperProcess(t *testing.T) {
+	dbPath, gitDir := os.Getenv("CLT_TEST_GIT_STATUS_DB"), os.Getenv("CLT_TEST_GIT_STATUS_DIR")
+	if dbPath == "" {
+		return
+	}
+	store, err := NewSQLiteState(dbPath)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	result, err := sharedGitStatusCache.get(context.Background(), store, "/repo", gitDir, func(context.Context) (GitResult, error) {
+		return GitResult{Modified: os.Getpid()}, nil
+	})
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Print(result.Modified)
+	os.Exit(0)
+}
+
+func TestGitStatusCacheIsSharedBetweenProcesses(t *testing.T) {
+	gitDir := t.TempDir()
+	writeTestFile(t, filepath.Join(gitDir, "HEAD"), "ref: refs/heads/main\n")
+	writeTestFile(t, filepath.Join(gitDir, "index"), "v1")
+	t.Setenv("CLT_TEST_GIT_STATUS_DB", filepath.Join(t.TempDir(), "state.db"))
+	t.Setenv("CLT_TEST_GIT_STATUS_DIR", gitDir)
+
+	run := func() string {
+		output, err := exec.Command(os.Args[0], "-test.run=^TestGitStatusHelperProcess$").CombinedOutput()
+		require.NoError(t, err, string(output))
+		return string(output)
+	}
+	first := run()
+	require.Equal(t, first, run(), "the second process reuses the status the first computed")
+}
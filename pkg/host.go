@@ -0,0 +1,319 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// HostDetailsResult describes the machine and session a location is rendered
+// in, exposed to templates as .host_details.
+type HostDetailsResult struct {
+	Hostname string
+	// ShortHostname is Hostname up to the first dot.
+	ShortHostname string
+
+	User     string
+	IsRoot   bool
+	IsSudo   bool
+	SudoUser string
+
+	IsSSH bool
+	// SSHClient is the client's address, when the SSH environment variables
+	// survived to this process.
+	SSHClient string
+
+	IsContainer bool
+	// Container is the container runtime: "docker", "podman", "kubernetes",
+	// "lxc", or whatever the runtime put in $container.
+	Container string
+
+	IsVM bool
+	// Virtualization is the hypervisor, in systemd-detect-virt's vocabulary
+	// where it can be told ("kvm", "qemu", "vmware", "oracle", "microsoft",
+	// "xen", "amazon", "google", "parallels"), or "vm" when only the
+	// presence of one is known.
+	Virtualization string
+
+	// IsProduction is true when the hostname matches one of the operation's
+	// configured `production` patterns.
+	IsProduction bool
+}
+
+// hostProbe is where host detection reads from; tests point root at a fake
+// filesystem and swap the environment and process table.
+type hostProbe struct {
+	root   string
+	getenv func(string) string
+	// parent returns a process's parent pid and command name.
+	parent func(ctx context.Context, pid int) (ppid int, command string, ok bool)
+	pid    int
+	goos   string
+	// uid and username are the client's (see Instance.UserID).
+	uid      int
+	username string
+	// store, if set, keeps the outcome of the walk up the process tree
+	// under instanceKey (see cachedSSHAncestor).
+	store       StateStore
+	instanceKey InstanceKey
+}
+
+// instanceHostProbe probes the real host, from the point of view of the
+// instance's client process.
+func instanceHostProbe(instance Instance) hostProbe {
+	return hostProbe{
+		root:     "/",
+		getenv:   instance.Getenv,
+		parent:   processParent,
+		pid:      instance.ProcessID(),
+		goos:     runtime.GOOS,
+		uid:      instance.UserID(),
+		username: instance.Username(),
+	}
+}
+
+func (p hostProbe) path(name string) string {
+	return filepath.Join(p.root, name)
+}
+
+func (p hostProbe) exists(name string) bool {
+	_, err := os.Stat(p.path(name))
+	return err == nil
+}
+
+func (p hostProbe) read(name string) string {
+	content, err := os.ReadFile(p.path(name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(content))
+}
+
+// maxProcessAncestors bounds the walk up the process tree.
+const maxProcessAncestors = 32
+
+// sshSession reports whether this process is part of an SSH session: from
+// the variables sshd sets, or failing that (they're lost across `sudo -i`,
+// `su -`, or a tmux server started elsewhere) by finding sshd among our
+// ancestors.
+func (p hostProbe) sshSession(ctx context.Context) (bool, string) {
+	if conn := p.getenv("SSH_CONNECTION"); conn != "" {
+		return true, strings.Fields(conn)[0]
+	}
+	if client := p.getenv("SSH_CLIENT"); client != "" {
+		return true, strings.Fields(client)[0]
+	}
+	if p.getenv("SSH_TTY") != "" {
+		return true, ""
+	}
+
+	return p.cachedSSHAncestor(ctx), ""
+}
+
+// sshAncestorLocationKey and sshAncestorOperationName are where
+// cachedSSHAncestor keeps its answer, under the instance's own key so that
+// clear-state forgets it along with everything else.
+const (
+	sshAncestorLocationKey   LocationKey   = "@shared"
+	sshAncestorOperationName OperationName = "ssh_ancestor"
+)
+
+// cachedSSHAncestor is hasSSHAncestor, remembered per instance: without
+// /proc the walk forks ps once per ancestor, and a shell or tmux server
+// doesn't change what it descends from.
+func (p hostProbe) cachedSSHAncestor(ctx context.Context) bool {
+	if p.store == nil || p.instanceKey == "" {
+		return p.hasSSHAncestor(ctx)
+	}
+	if cached, err := p.store.Get(sshAncestorLocationKey, p.instanceKey, sshAncestorOperationName); err == nil && cached != "" {
+		return cached == "true"
+	}
+	found := p.hasSSHAncestor(ctx)
+	// Failing to save only costs the next render another walk.
+	p.store.Set(sshAncestorLocationKey, p.instanceKey, sshAncestorOperationName, strconv.FormatBool(found))
+	return found
+}
+
+// hasSSHAncestor reports whether sshd is among the client's ancestors.
+func (p hostProbe) hasSSHAncestor(ctx context.Context) bool {
+	pid := p.pid
+	for i := 0; i < maxProcessAncestors && pid > 1; i++ {
+		ppid, command, ok := p.parent(ctx, pid)
+		if !ok {
+			break
+		}
+		if command == "sshd" || command == "sshd-session" {
+			return true
+		}
+		pid = ppid
+	}
+	return false
+}
+
+// container detects a container runtime from the markers runtimes leave
+// behind.
+func (p hostProbe) container() string {
+	switch {
+	case p.exists(".dockerenv"):
+		return "docker"
+	case p.exists("run/.containerenv"):
+		return "podman"
+	case p.getenv("KUBERNETES_SERVICE_HOST") != "":
+		return "kubernetes"
+	}
+	// systemd and most runtimes set $container for PID 1; it only reaches
+	// us if something passed it on, hence the fallback to cgroups.
+	if runtimeName := p.getenv("container"); runtimeName != "" {
+		return runtimeName
+	}
+
+	cgroup := p.read("proc/1/cgroup")
+	switch {
+	case strings.Contains(cgroup, "kubepods"):
+		return "kubernetes"
+	case strings.Contains(cgroup, "docker"):
+		return "docker"
+	case strings.Contains(cgroup, "libpod"):
+		return "podman"
+	case strings.Contains(cgroup, "/lxc"):
+		return "lxc"
+	}
+	return ""
+}
+
+// dmiVendors maps substrings of the DMI vendor/product strings to
+// systemd-detect-virt's names for them.
+var dmiVendors = []struct{ marker, name string }{
+	{"KVM", "kvm"},
+	{"QEMU", "qemu"},
+	{"VMware", "vmware"},
+	{"VirtualBox", "oracle"},
+	{"innotek", "oracle"},
+	{"Xen", "xen"},
+	{"Microsoft Corporation", "microsoft"},
+	{"Amazon EC2", "amazon"},
+	{"Google", "google"},
+	{"Parallels", "parallels"},
+}
+
+// virtualization detects a hypervisor like systemd-detect-virt's VM checks:
+// DMI strings first, then the CPU's hypervisor flag. On macOS the kernel
+// reports it directly.
+func (p hostProbe) virtualization(ctx context.Context) string {
+	if p.goos == "darwin" {
+		output, err := exec.CommandContext(ctx, "sysctl", "-n", "kern.hv_vmm_present").Output()
+		if err == nil && strings.TrimSpace(string(output)) == "1" {
+			return "vm"
+		}
+		return ""
+	}
+
+	dmi := p.read("sys/class/dmi/id/sys_vendor") + " " + p.read("sys/class/dmi/id/product_name")
+	for _, vendor := range dmiVendors {
+		if strings.Contains(dmi, vendor.marker) {
+			return vendor.name
+		}
+	}
+
+	for _, line := range strings.Split(p.read("proc/cpuinfo"), "\n") {
+		if strings.HasPrefix(line, "flags") && strings.Contains(line, " hypervisor") {
+			return "vm"
+		}
+	}
+	return ""
+}
+
+// processParent looks up a process's parent and command name, from /proc
+// where there is one and ps otherwise.
+func processParent(ctx context.Context, pid int) (int, string, bool) {
+	if stat, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat")); err == nil {
+		// pid (comm) state ppid ...; comm may itself contain spaces and
+		// parentheses, so split on the last ')'.
+		s := string(stat)
+		open, end := strings.IndexByte(s, '('), strings.LastIndexByte(s, ')')
+		if open < 0 || end < open {
+			return 0, "", false
+		}
+		fields := strings.Fields(s[end+1:])
+		if len(fields) < 2 {
+			return 0, "", false
+		}
+		ppid, err := strconv.Atoi(fields[1])
+		return ppid, s[open+1 : end], err == nil
+	}
+
+	output, err := exec.CommandContext(ctx, "ps", "-o", "ppid=", "-o", "comm=", "-p", strconv.Itoa(pid)).Output()
+	if err != nil {
+		return 0, "", false
+	}
+	fields := strings.Fields(string(output))
+	if len(fields) < 2 {
+		return 0, "", false
+	}
+	ppid, err := strconv.Atoi(fields[0])
+	return ppid, filepath.Base(strings.Join(fields[1:], " ")), err == nil
+}
+
+// matchesAny reports whether s matches any of the shell glob patterns.
+func matchesAny(patterns []string, s ...string) bool {
+	for _, pattern := range patterns {
+		for _, candidate := range s {
+			if ok, _ := filepath.Match(pattern, candidate); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// configurePatterns reads an optional list of glob patterns from an
+// operation's config, rejecting malformed ones up front.
+func configurePatterns(rawConfig map[string]interface{}, operation, key string) ([]string, error) {
+	raw, ok := rawConfig[key]
+	if !ok {
+		return nil, nil
+	}
+	list, ok := raw.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: %s must be a list", operation, key)
+	}
+	patterns := make([]string, 0, len(list))
+	for _, p := range list {
+		pattern, ok := p.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s: %s must be a list of strings", operation, key)
+		}
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("%s: %s pattern %q: %w", operation, key, pattern, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+func (p hostProbe) details(ctx context.Context, hostname string, productionPatterns []string) HostDetailsResult {
+	shortHostname, _, _ := strings.Cut(hostname, ".")
+	result := HostDetailsResult{
+		Hostname:      hostname,
+		ShortHostname: shortHostname,
+		User:          p.username,
+		IsRoot:        p.uid == 0,
+		SudoUser:      p.getenv("SUDO_USER"),
+		Container:     p.container(),
+		IsProduction:  matchesAny(productionPatterns, hostname, shortHostname),
+	}
+	result.IsSudo = result.SudoUser != ""
+	result.IsSSH, result.SSHClient = p.sshSession(ctx)
+	result.IsContainer = result.Container != ""
+	if !result.IsContainer {
+		// Inside a container, DMI and cpuinfo describe the host, not us.
+		result.Virtualization = p.virtualization(ctx)
+	}
+	result.IsVM = result.Virtualization != ""
+	return result
+}
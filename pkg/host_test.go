@@ -0,0 +1,141 @@
+package pkg
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeHostProbe returns a probe over an empty fake root with the given
+// environment and a process table where pid 100's ancestors are parents.
+func fakeHostProbe(t *testing.T, env map[string]string, parents map[int]string) hostProbe {
+	t.Helper()
+	return hostProbe{
+		root:   t.TempDir(),
+		getenv: func(key string) string { return env[key] },
+		parent: func(_ context.Context, pid int) (int, string, bool) {
+			command, ok := parents[pid]
+			return pid - 1, command, ok
+		},
+		pid:      100,
+		goos:     "linux",
+		uid:      1000,
+		username: "bob",
+	}
+}
+
+func TestHostProbeSSHFromEnvironment(t *testing.T) {
+	probe := fakeHostProbe(t, map[string]string{"SSH_CONNECTION": "10.0.0.5 52311 10.0.0.1 22"}, nil)
+	isSSH, client := probe.sshSession(context.Background())
+	require.True(t, isSSH)
+	require.Equal(t, "10.0.0.5", client)
+
+	probe = fakeHostProbe(t, map[string]string{"SSH_TTY": "/dev/pts/3"}, nil)
+	isSSH, client = probe.sshSession(context.Background())
+	require.True(t, isSSH)
+	require.Empty(t, client)
+}
+
+func TestHostProbeSSHFromProcessChain(t *testing.T) {
+	probe := fakeHostProbe(t, nil, map[int]string{100: "zsh", 99: "sudo", 98: "sshd-session"})
+	isSSH, _ := probe.sshSession(context.Background())
+	require.True(t, isSSH, "sshd among our ancestors means SSH even after sudo cleared the environment")
+
+	probe = fakeHostProbe(t, nil, map[int]string{100: "zsh", 99: "tmux: server", 98: "systemd"})
+	isSSH, _ = probe.sshSession(context.Background())
+	require.False(t, isSSH)
+}
+
+func TestHostProbeCachesProcessChainPerInstance(t *testing.T) {
+	probe := fakeHostProbe(t, nil, map[int]string{100: "zsh", 99: "sshd-session"})
+	lookups := 0
+	parent := probe.parent
+	probe.parent = func(ctx context.Context, pid int) (int, string, bool) {
+		lookups++
+		return parent(ctx, pid)
+	}
+	probe.store, probe.instanceKey = NewMemoryStateStore(), testShellInstance.Key
+
+	isSSH, _ := probe.sshSession(context.Background())
+	require.True(t, isSSH)
+	require.Equal(t, 2, lookups)
+
+	isSSH, _ = probe.sshSession(context.Background())
+	require.True(t, isSSH)
+	require.Equal(t, 2, lookups, "the walk isn't repeated for the same instance")
+
+	require.NoError(t, probe.store.DeleteInstance(testShellInstance.Key))
+	probe.sshSession(context.Background())
+	require.Equal(t, 4, lookups, "clear-state forgets it")
+}
+
+func TestHostProbeContainer(t *testing.T) {
+	probe := fakeHostProbe(t, nil, nil)
+	require.Empty(t, probe.container())
+
+	writeTestFile(t, probe.path("proc/1/cgroup"), "0::/kubepods/besteffort/pod1234/abcd\n")
+	require.Equal(t, "kubernetes", probe.container())
+
+	writeTestFile(t, probe.path("run/.containerenv"), "")
+	require.Equal(t, "podman", probe.container())
+
+	writeTestFile(t, probe.path(".dockerenv"), "")
+	require.Equal(t, "docker", probe.container())
+
+	probe = fakeHostProbe(t, map[string]string{"container": "lxc"}, nil)
+	require.Equal(t, "lxc", probe.container())
+}
+
+func TestHostProbeVirtualization(t *testing.T) {
+	probe := fakeHostProbe(t, nil, nil)
+	require.Empty(t, probe.virtualization(context.Background()))
+
+	writeTestFile(t, probe.path("proc/cpuinfo"), "processor\t: 0\nflags\t\t: fpu vme de hypervisor lahf_lm\n")
+	require.Equal(t, "vm", probe.virtualization(context.Background()))
+
+	writeTestFile(t, probe.path("sys/class/dmi/id/sys_vendor"), "QEMU\n")
+	writeTestFile(t, probe.path("sys/class/dmi/id/product_name"), "Standard PC (Q35 + ICH9, 2009)\n")
+	require.Equal(t, "qemu", probe.virtualization(context.Background()))
+}
+
+func TestHostProbeDetails(t *testing.T) {
+	probe := fakeHostProbe(t, map[string]string{"SUDO_USER": "alice"}, nil)
+	writeTestFile(t, probe.path(".dockerenv"), "")
+	writeTestFile(t, probe.path("sys/class/dmi/id/sys_vendor"), "VMware, Inc.\n")
+
+	result := probe.details(context.Background(), "prod-db-1.example.com", []string{"prod-*"})
+	require.Equal(t, "prod-db-1", result.ShortHostname)
+	require.True(t, result.IsProduction)
+	require.True(t, result.IsSudo)
+	require.Equal(t, "alice", result.SudoUser)
+	require.True(t, result.IsContainer)
+	require.False(t, result.IsVM, "inside a container the DMI strings are the host's")
+	require.False(t, result.IsSSH)
+	require.NotEmpty(t, result.User)
+
+	result = probe.details(context.Background(), "dev-box", []string{"prod-*", "*.prod.example.com"})
+	require.False(t, result.IsProduction)
+}
+
+func TestHostDetailsConfigure(t *testing.T) {
+	op := &HostDetails{}
+	require.NoError(t, op.Configure(map[string]interface{}{"type": "host_details"}))
+	require.Empty(t, op.production)
+
+	require.NoError(t, op.Configure(map[string]interface{}{"production": []interface{}{"prod-*"}}))
+	require.Equal(t, []string{"prod-*"}, op.production)
+
+	require.Error(t, op.Configure(map[string]interface{}{"production": "prod-*"}))
+	require.Error(t, op.Configure(map[string]interface{}{"production": []interface{}{"[prod"}}))
+}
+
+func TestProcessParentOfSelf(t *testing.T) {
+	ppid, command, ok := processParent(context.Background(), os.Getpid())
+	if !ok {
+		t.Skip("no /proc or ps available")
+	}
+	require.Equal(t, os.Getppid(), ppid)
+	require.NotEmpty(t, command)
+}
@@ -0,0 +1,78 @@
+package pkg
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// iniFile is a parsed INI file: section name to key to value. Keys outside
+// any section are under "".
+type iniFile map[string]map[string]string
+
+// parseINI reads the simple INI dialect used by the gcloud and AWS CLIs:
+// `[section]` headers, `key = value` (or `key: value`) pairs, and `#`/`;`
+// comment lines. Later duplicates override earlier ones. Indented lines
+// continue the previous value, as in AWS's nested `s3 =` blocks; they are
+// kept but not otherwise interpreted.
+func parseINI(path string) (iniFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	ini := iniFile{"": {}}
+	section := ""
+	lastKey := ""
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		raw := scanner.Text()
+		line := strings.TrimSpace(raw)
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("%s:%d: unterminated section header", path, lineNumber)
+			}
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			if ini[section] == nil {
+				ini[section] = map[string]string{}
+			}
+			lastKey = ""
+			continue
+		}
+
+		if raw[0] == ' ' || raw[0] == '\t' {
+			if lastKey != "" {
+				ini[section][lastKey] += "\n" + line
+				continue
+			}
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			key, value, ok = strings.Cut(line, ":")
+		}
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected key = value", path, lineNumber)
+		}
+		lastKey = strings.TrimSpace(key)
+		ini[section][lastKey] = strings.TrimSpace(value)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return ini, nil
+}
+
+// get returns a key from a section, or "" if either is missing.
+func (f iniFile) get(section, key string) string {
+	return f[section][key]
+}
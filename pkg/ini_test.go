@@ -0,0 +1,39 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseINI(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config")
+	require.NoError(t, os.WriteFile(path, []byte(`# comment
+top = level
+[profile dev]
+region = us-east-1
+; another comment
+s3 =
+    max_concurrent_requests = 20
+output: json
+`), 0644))
+
+	ini, err := parseINI(path)
+	require.NoError(t, err)
+	require.Equal(t, "level", ini.get("", "top"))
+	require.Equal(t, "us-east-1", ini.get("profile dev", "region"))
+	require.Equal(t, "json", ini.get("profile dev", "output"))
+	require.Equal(t, "\nmax_concurrent_requests = 20", ini.get("profile dev", "s3"))
+	require.Empty(t, ini.get("missing", "region"))
+}
+
+func TestParseINIReportsMalformedLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config")
+	require.NoError(t, os.WriteFile(path, []byte("[core]\nnot a pair\n"), 0644))
+
+	_, err := parseINI(path)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), ":2: expected key = value")
+}
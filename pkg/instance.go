@@ -0,0 +1,340 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// Instance keys name the host an instance belongs to, then identify it
+// within that host, dot separated:
+//
+//	tmux.[<socket>.][$<session>.][@<window>.][%<pane>]   e.g. tmux.%3, tmux.work.$0.@1.%3
+//	zellij.[<session>.]<pane id>                         e.g. zellij.main.2
+//	shell.[<tty>.]<pid>                                  e.g. shell.1234, shell.pts/3.1234
+//
+// A bare pid (1234) is read as a shell, and a key starting with a tmux id
+// ($1.%3, %3) as tmux, as keys were before they had a kind; the latter are
+// deprecated (see IsLegacyInstanceKey). The scripts from ShellInit and TmuxInit are generated from the
+// prefixes here, so they're the one place the format is defined.
+const (
+	tmuxInstancePrefix   = "tmux."
+	zellijInstancePrefix = "zellij."
+	shellInstancePrefix  = "shell."
+)
+
+// InstanceKind is the host an instance belongs to.
+type InstanceKind string
+
+const (
+	InstanceTmux   InstanceKind = "tmux"
+	InstanceZellij InstanceKind = "zellij"
+	InstanceShell  InstanceKind = "shell"
+)
+
+// Instance is a parsed InstanceKey; see ParseInstanceKey. Which fields are
+// set depends on Kind. tmux ids keep their sigil ("$0", "@1", "%3") so they
+// can be compared with tmux's own output, and Socket is the server's socket
+// name (tmux -L).
+//
+// Env, ClientPID, ClientUID and ClientUser describe the process asking for
+// the instance to be rendered or updated, when that isn't this one (see
+// DaemonRequest). Operations read them through Getenv, Environ, ProcessID,
+// UserID and Username rather than os.Getenv, os.Getpid and so on, which
+// under the daemon would be the daemon's.
+type Instance struct {
+	Key     InstanceKey  `json:"key"`
+	Kind    InstanceKind `json:"kind"`
+	Socket  string       `json:"socket,omitempty"`
+	Session string       `json:"session,omitempty"`
+	Window  string       `json:"window,omitempty"`
+	Pane    string       `json:"pane,omitempty"`
+	TTY     string       `json:"tty,omitempty"`
+	PID     int          `json:"pid,omitempty"`
+
+	Env       map[string]string `json:"-"`
+	ClientPID int               `json:"-"`
+	// ClientUID is a pointer since 0 is root rather than unset.
+	ClientUID  *int   `json:"-"`
+	ClientUser string `json:"-"`
+}
+
+// Getenv reads the client's environment variable key, or this process's if
+// there's no separate client. Only the variables in ClientEnvironment are
+// forwarded by clients.
+func (i Instance) Getenv(key string) string {
+	if i.Env == nil {
+		return os.Getenv(key)
+	}
+	return i.Env[key]
+}
+
+// Environ is the environment for processes run on the client's behalf
+// (commands, post commands, plugins): this process's, with the variables
+// clients forward replaced by the client's.
+func (i Instance) Environ() []string {
+	if i.Env == nil {
+		return os.Environ()
+	}
+	var env []string
+	for _, entry := range os.Environ() {
+		key, _, _ := strings.Cut(entry, "=")
+		if !isClientEnvVar(key) {
+			env = append(env, entry)
+		}
+	}
+	for key, value := range i.Env {
+		env = append(env, key+"="+value)
+	}
+	return env
+}
+
+// UserID is the client's effective uid, or this process's if there's no
+// separate client.
+func (i Instance) UserID() int {
+	if i.ClientUID == nil {
+		return os.Geteuid()
+	}
+	return *i.ClientUID
+}
+
+// Username is the client's user name, or this process's if there's no
+// separate client.
+func (i Instance) Username() string {
+	if i.ClientUser != "" {
+		return i.ClientUser
+	}
+	if i.ClientUID == nil {
+		if name := CurrentUsername(); name != "" {
+			return name
+		}
+	}
+	return i.Getenv("USER")
+}
+
+type instanceContextKey struct{}
+
+// withInstance hands the instance being updated to operations' Update, which
+// isn't passed one, so that processes it runs see the client's environment.
+func withInstance(ctx context.Context, instance Instance) context.Context {
+	return context.WithValue(ctx, instanceContextKey{}, instance)
+}
+
+// instanceFrom returns the instance set by withInstance, or the zero
+// Instance, which stands for this process.
+func instanceFrom(ctx context.Context) Instance {
+	instance, _ := ctx.Value(instanceContextKey{}).(Instance)
+	return instance
+}
+
+// CurrentUsername is this process's user name, for a client to send along
+// with its requests (see DaemonRequest), or "" if it can't be found.
+func CurrentUsername() string {
+	if current, err := user.Current(); err == nil {
+		return current.Username
+	}
+	return os.Getenv("USER")
+}
+
+// ProcessID is the client's pid, or this process's if there's no separate
+// client.
+func (i Instance) ProcessID() int {
+	if i.ClientPID == 0 {
+		return os.Getpid()
+	}
+	return i.ClientPID
+}
+
+// clientEnvVars and clientEnvPrefixes are the environment variables
+// operations read (see ClientEnvironment).
+var (
+	clientEnvVars = []string{
+		"AWS_PROFILE", "AWS_DEFAULT_PROFILE", "AWS_REGION", "AWS_DEFAULT_REGION",
+		"AWS_ACCESS_KEY_ID", "AWS_CONFIG_FILE", "AWS_SHARED_CREDENTIALS_FILE",
+		"KUBECONFIG",
+		"SSH_CONNECTION", "SSH_CLIENT", "SSH_TTY", "SUDO_USER", "USER",
+		"KUBERNETES_SERVICE_HOST", "container",
+		"TMUX",
+		MemeDirEnvVar,
+	}
+	// gcloud reads any CLOUDSDK_<SECTION>_<KEY> as a property override.
+	clientEnvPrefixes = []string{"CLOUDSDK_"}
+)
+
+// ClientEnvironment is the part of this process's environment operations
+// depend on, for a client to send along with its requests so the daemon
+// renders what the client's shell would see. It's never nil, so an empty
+// environment isn't mistaken for a missing one.
+func ClientEnvironment() map[string]string {
+	env := map[string]string{}
+	for _, key := range clientEnvVars {
+		if value, ok := os.LookupEnv(key); ok {
+			env[key] = value
+		}
+	}
+	for _, entry := range os.Environ() {
+		key, value, _ := strings.Cut(entry, "=")
+		for _, prefix := range clientEnvPrefixes {
+			if strings.HasPrefix(key, prefix) {
+				env[key] = value
+			}
+		}
+	}
+	return env
+}
+
+// isClientEnvVar is whether key is one ClientEnvironment forwards.
+func isClientEnvVar(key string) bool {
+	for _, name := range clientEnvVars {
+		if key == name {
+			return true
+		}
+	}
+	for _, prefix := range clientEnvPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// TmuxPane returns the pane id of a tmux instance.
+func (i Instance) TmuxPane() (string, bool) {
+	if i.Kind != InstanceTmux || i.Pane == "" {
+		return "", false
+	}
+	return i.Pane, true
+}
+
+// TmuxInstanceKey is the instance key for a tmux pane, given its pane id
+// (e.g. "%3", or the format "#{pane_id}").
+func TmuxInstanceKey(paneID string) InstanceKey {
+	return InstanceKey(tmuxInstancePrefix + paneID)
+}
+
+// ShellInstanceKey is the instance key for a shell outside tmux, given its
+// pid (or e.g. "$$").
+func ShellInstanceKey(pid string) InstanceKey {
+	return InstanceKey(shellInstancePrefix + pid)
+}
+
+// ParseInstanceKey validates key and splits it into its parts.
+func ParseInstanceKey(key InstanceKey) (Instance, error) {
+	instance := Instance{Key: key}
+	var err error
+	switch raw := string(key); {
+	case strings.HasPrefix(raw, tmuxInstancePrefix):
+		instance.Kind = InstanceTmux
+		err = parseTmuxInstance(&instance, strings.TrimPrefix(raw, tmuxInstancePrefix))
+	case strings.HasPrefix(raw, zellijInstancePrefix):
+		instance.Kind = InstanceZellij
+		err = parseZellijInstance(&instance, strings.TrimPrefix(raw, zellijInstancePrefix))
+	case strings.HasPrefix(raw, shellInstancePrefix):
+		instance.Kind = InstanceShell
+		err = parseShellInstance(&instance, strings.TrimPrefix(raw, shellInstancePrefix))
+	case isDigits(raw):
+		instance.Kind = InstanceShell
+		err = parseShellInstance(&instance, raw)
+	case IsLegacyInstanceKey(key):
+		instance.Kind = InstanceTmux
+		err = parseTmuxInstance(&instance, raw)
+	default:
+		err = fmt.Errorf("expected a %s, %s or %s key, or a pid", InstanceTmux, InstanceZellij, InstanceShell)
+	}
+	if err != nil {
+		return Instance{}, fmt.Errorf("invalid instance key %q: %w", key, err)
+	}
+	return instance, nil
+}
+
+// IsLegacyInstanceKey reports whether key is a tmux key without its kind,
+// such as "$1.%3" or "%3" from tmux configs written before keys had one.
+// They're still read as tmux keys, but should be replaced with
+// TmuxInstanceKey's.
+func IsLegacyInstanceKey(key InstanceKey) bool {
+	return key != "" && strings.IndexByte("$@%", key[0]) >= 0
+}
+
+// parseTmuxInstance reads the session, window and pane ids off the end of
+// rest; whatever precedes them is the socket name, which may contain dots.
+func parseTmuxInstance(instance *Instance, rest string) error {
+	fields := strings.Split(rest, ".")
+	ids := map[byte]*string{'$': &instance.Session, '@': &instance.Window, '%': &instance.Pane}
+	order := "$@%"
+	last := len(order)
+	for len(fields) > 0 {
+		field := fields[len(fields)-1]
+		if field == "" {
+			return fmt.Errorf("empty field")
+		}
+		position := strings.IndexByte(order, field[0])
+		if position < 0 {
+			break
+		}
+		if position >= last {
+			return fmt.Errorf("%q out of order: expected [socket.][$session.][@window.][%%pane]", field)
+		}
+		if !isDigits(field[1:]) {
+			return fmt.Errorf("%q is not a tmux id", field)
+		}
+		*ids[field[0]] = field
+		last = position
+		fields = fields[:len(fields)-1]
+	}
+	if last == len(order) {
+		return fmt.Errorf("no tmux session, window or pane id")
+	}
+	instance.Socket = strings.Join(fields, ".")
+	return nil
+}
+
+func parseZellijInstance(instance *Instance, rest string) error {
+	session, pane := "", rest
+	if i := strings.LastIndexByte(rest, '.'); i >= 0 {
+		session, pane = rest[:i], rest[i+1:]
+		if session == "" {
+			return fmt.Errorf("empty session name")
+		}
+	}
+	if !isDigits(pane) {
+		return fmt.Errorf("%q is not a zellij pane id", pane)
+	}
+	instance.Session = session
+	instance.Pane = pane
+	return nil
+}
+
+func parseShellInstance(instance *Instance, rest string) error {
+	tty, pid := "", rest
+	if i := strings.LastIndexByte(rest, '.'); i >= 0 {
+		tty, pid = rest[:i], rest[i+1:]
+		if tty == "" {
+			return fmt.Errorf("empty tty")
+		}
+	}
+	if !isDigits(pid) {
+		return fmt.Errorf("%q is not a pid", pid)
+	}
+	n, err := strconv.Atoi(pid)
+	if err != nil || n == 0 {
+		return fmt.Errorf("%q is not a pid", pid)
+	}
+	instance.TTY = tty
+	instance.PID = n
+	return nil
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
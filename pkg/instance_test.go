@@ -0,0 +1,97 @@
+package pkg
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	testTmuxInstance  = Instance{Key: "tmux.%1", Kind: InstanceTmux, Pane: "%1"}
+	testShellInstance = Instance{Key: "shell.12345", Kind: InstanceShell, PID: 12345}
+)
+
+func TestParseInstanceKey(t *testing.T) {
+	tests := []struct {
+		key  InstanceKey
+		want Instance
+	}{
+		{"tmux.%3", Instance{Kind: InstanceTmux, Pane: "%3"}},
+		{"tmux.$0", Instance{Kind: InstanceTmux, Session: "$0"}},
+		{"tmux.work.$0.@1.%3", Instance{Kind: InstanceTmux, Socket: "work", Session: "$0", Window: "@1", Pane: "%3"}},
+		{"tmux.my.socket.@1.%3", Instance{Kind: InstanceTmux, Socket: "my.socket", Window: "@1", Pane: "%3"}},
+		{"zellij.2", Instance{Kind: InstanceZellij, Pane: "2"}},
+		{"zellij.my.session.2", Instance{Kind: InstanceZellij, Session: "my.session", Pane: "2"}},
+		{"shell.1234", Instance{Kind: InstanceShell, PID: 1234}},
+		{"shell.pts/3.1234", Instance{Kind: InstanceShell, TTY: "pts/3", PID: 1234}},
+		{"1234", Instance{Kind: InstanceShell, PID: 1234}},
+		{"$1.%3", Instance{Kind: InstanceTmux, Session: "$1", Pane: "%3"}},
+		{"%3", Instance{Kind: InstanceTmux, Pane: "%3"}},
+	}
+	for _, test := range tests {
+		t.Run(string(test.key), func(t *testing.T) {
+			test.want.Key = test.key
+			instance, err := ParseInstanceKey(test.key)
+			require.NoError(t, err)
+			require.Equal(t, test.want, instance)
+		})
+	}
+
+	for _, key := range []InstanceKey{
+		"", "test", "tmux.", "tmux.work", "tmux.%", "tmux.%x", "tmux.%3.@1", "tmux.%3.%4", "tmux..%3",
+		"zellij.", "zellij.main", "zellij..2", "shell.", "shell.abc", "shell.0", ".1234", "tmux%3",
+		"%x", "%3.work", "$1.%3.@1",
+	} {
+		_, err := ParseInstanceKey(key)
+		require.Error(t, err, "key %q", key)
+	}
+}
+
+func TestInstanceKeysRoundTrip(t *testing.T) {
+	instance, err := ParseInstanceKey(TmuxInstanceKey("%3"))
+	require.NoError(t, err)
+	pane, ok := instance.TmuxPane()
+	require.True(t, ok)
+	require.Equal(t, "%3", pane)
+
+	instance, err = ParseInstanceKey(ShellInstanceKey("1234"))
+	require.NoError(t, err)
+	require.Equal(t, 1234, instance.PID)
+	_, ok = instance.TmuxPane()
+	require.False(t, ok)
+}
+
+func TestInstanceEnvironment(t *testing.T) {
+	t.Setenv("AWS_PROFILE", "work")
+	t.Setenv("CLOUDSDK_CORE_PROJECT", "proj")
+	t.Setenv("KUBECONFIG", "")
+	os.Unsetenv("KUBECONFIG")
+
+	env := ClientEnvironment()
+	require.Equal(t, "work", env["AWS_PROFILE"])
+	require.Equal(t, "proj", env["CLOUDSDK_CORE_PROJECT"])
+	require.NotContains(t, env, "KUBECONFIG")
+	require.NotContains(t, env, "PATH", "only what operations read is forwarded")
+
+	instance := testShellInstance
+	require.Equal(t, "work", instance.Getenv("AWS_PROFILE"), "without a client, this process's environment")
+	require.Equal(t, os.Getpid(), instance.ProcessID())
+
+	instance.Env, instance.ClientPID = map[string]string{}, 4242
+	require.Empty(t, instance.Getenv("AWS_PROFILE"), "a client's empty environment isn't ours")
+	require.Equal(t, 4242, instance.ProcessID())
+
+	instance.Env = map[string]string{"CLOUDSDK_CORE_PROJECT": "theirs"}
+	environ := instance.Environ()
+	require.Contains(t, environ, "CLOUDSDK_CORE_PROJECT=theirs")
+	require.NotContains(t, environ, "CLOUDSDK_CORE_PROJECT=proj")
+	require.NotContains(t, environ, "AWS_PROFILE=work", "forwarded variables the client doesn't have are unset")
+	require.Contains(t, environ, "PATH="+os.Getenv("PATH"), "the rest is this process's")
+
+	require.Equal(t, os.Geteuid(), instance.UserID())
+	root := 0
+	instance.ClientUID, instance.ClientUser = &root, "root"
+	require.Equal(t, 0, instance.UserID())
+	require.Equal(t, "root", instance.Username())
+}
@@ -0,0 +1,211 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+
+	"gopkg.in/yaml.v3"
+)
+
+// KubeResult is the current kubectl context, exposed to templates as .kube.
+// Printing it directly ({{ .kube }}) gives Name.
+type KubeResult struct {
+	// Context is the current-context as written in the kubeconfig.
+	Context string
+	// Name is Context's configured alias, or Context itself if it has none.
+	Name      string
+	Cluster   string
+	Server    string
+	User      string
+	Namespace string
+	// IsProduction is true when Context or Name matches one of the
+	// operation's configured `production` patterns.
+	IsProduction bool
+}
+
+func (r KubeResult) String() string {
+	return r.Name
+}
+
+// kubeconfig is the subset of a kubeconfig file we read.
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Contexts       []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster   string `yaml:"cluster"`
+			User      string `yaml:"user"`
+			Namespace string `yaml:"namespace"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+	Clusters []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server string `yaml:"server"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+}
+
+// kubeconfigPaths is the list of kubeconfig files kubectl would read:
+// $KUBECONFIG's entries, or ~/.kube/config.
+func kubeconfigPaths(getenv func(string) string) ([]string, error) {
+	if env := getenv("KUBECONFIG"); env != "" {
+		var paths []string
+		for _, path := range filepath.SplitList(env) {
+			if path != "" {
+				paths = append(paths, path)
+			}
+		}
+		return paths, nil
+	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	return []string{filepath.Join(homeDir, ".kube", "config")}, nil
+}
+
+// readKubeconfig merges the kubeconfig files with kubectl's rules: the
+// first file to set current-context wins, and so does the first file to
+// define a context or cluster of a given name. Missing files are skipped.
+func readKubeconfig(paths []string) (*kubeconfig, error) {
+	merged := &kubeconfig{}
+	contexts := map[string]bool{}
+	clusters := map[string]bool{}
+	for _, path := range paths {
+		content, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		var file kubeconfig
+		if err := yaml.Unmarshal(content, &file); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+
+		if merged.CurrentContext == "" {
+			merged.CurrentContext = file.CurrentContext
+		}
+		for _, context := range file.Contexts {
+			if !contexts[context.Name] {
+				contexts[context.Name] = true
+				merged.Contexts = append(merged.Contexts, context)
+			}
+		}
+		for _, cluster := range file.Clusters {
+			if !clusters[cluster.Name] {
+				clusters[cluster.Name] = true
+				merged.Clusters = append(merged.Clusters, cluster)
+			}
+		}
+	}
+	return merged, nil
+}
+
+// current resolves current-context into a KubeResult, or nil if there is
+// no current context.
+func (c *kubeconfig) current() *KubeResult {
+	if c.CurrentContext == "" {
+		return nil
+	}
+
+	result := &KubeResult{Context: c.CurrentContext, Name: c.CurrentContext, Namespace: "default"}
+	for _, context := range c.Contexts {
+		if context.Name == c.CurrentContext {
+			result.Cluster = context.Context.Cluster
+			result.User = context.Context.User
+			if context.Context.Namespace != "" {
+				result.Namespace = context.Context.Namespace
+			}
+			break
+		}
+	}
+	for _, cluster := range c.Clusters {
+		if cluster.Name == result.Cluster {
+			result.Server = cluster.Cluster.Server
+			break
+		}
+	}
+	return result
+}
+
+// Kube exposes the current kubectl context, read straight from the
+// kubeconfig files rather than by running kubectl. It generates nil when
+// there's no current context.
+//
+// Optionally configured with aliases for unwieldy context names, and
+// context-name globs that mark production clusters:
+//
+//   - type: kube
+//     aliases: [{context: "arn:aws:eks:us-east-1:123456789012:cluster/payments", alias: payments}]
+//     production: ["prod-*", "payments"]
+//
+// Aliases are a list rather than a map because viper lowercases map keys.
+type Kube struct {
+	aliases    map[string]string
+	production []string
+}
+
+func (*Kube) Name() OperationName      { return "kube" }
+func (*Kube) IsAsync() bool            { return false }
+func (*Kube) ResultType() reflect.Type { return reflect.TypeOf(KubeResult{}) }
+
+func (k *Kube) Configure(rawConfig map[string]interface{}) error {
+	if aliasesRaw, ok := rawConfig["aliases"]; ok {
+		aliasesList, ok := aliasesRaw.([]interface{})
+		if !ok {
+			return fmt.Errorf("kube: aliases must be a list")
+		}
+		aliases := make(map[string]string, len(aliasesList))
+		for _, a := range aliasesList {
+			entry, ok := a.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("kube: aliases entries must have a context and an alias")
+			}
+			context, contextOK := entry["context"].(string)
+			alias, aliasOK := entry["alias"].(string)
+			if !contextOK || !aliasOK {
+				return fmt.Errorf("kube: aliases entries must have a context and an alias")
+			}
+			aliases[context] = alias
+		}
+		k.aliases = aliases
+	}
+
+	production, err := configurePatterns(rawConfig, "kube", "production")
+	if err != nil {
+		return err
+	}
+	k.production = production
+	return nil
+}
+
+func (*Kube) Update(_ context.Context, _ string, state string) (string, error) {
+	return state, nil
+}
+func (k *Kube) Generate(ctx context.Context, locationKey LocationKey, instance Instance, locationPath string, state string) (interface{}, error) {
+	paths, err := kubeconfigPaths(instance.Getenv)
+	if err != nil {
+		return nil, err
+	}
+	config, err := readKubeconfig(paths)
+	if err != nil {
+		return nil, err
+	}
+
+	result := config.current()
+	if result == nil {
+		return nil, nil
+	}
+	if alias, ok := k.aliases[result.Context]; ok {
+		result.Name = alias
+	}
+	result.IsProduction = matchesAny(k.production, result.Context, result.Name)
+	return *result, nil
+}
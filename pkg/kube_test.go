@@ -0,0 +1,99 @@
+package pkg
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeKubeconfig(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	return path
+}
+
+func TestKubeMergesKubeconfigFiles(t *testing.T) {
+	dir := t.TempDir()
+	first := writeKubeconfig(t, dir, "first", `
+contexts:
+- name: staging
+  context:
+    cluster: staging-cluster
+    user: staging-admin
+`)
+	second := writeKubeconfig(t, dir, "second", `
+current-context: staging
+contexts:
+- name: staging
+  context:
+    cluster: shadowed
+    user: shadowed
+- name: prod
+  context:
+    cluster: prod-cluster
+    namespace: payments
+clusters:
+- name: staging-cluster
+  cluster:
+    server: https://staging.example.com
+`)
+	t.Setenv("KUBECONFIG", first+string(os.PathListSeparator)+filepath.Join(dir, "missing")+string(os.PathListSeparator)+second)
+
+	result, err := (&Kube{}).Generate(context.Background(), "pane", testTmuxInstance, dir, "")
+	require.NoError(t, err)
+	require.Equal(t, KubeResult{
+		Context:   "staging",
+		Name:      "staging",
+		Cluster:   "staging-cluster",
+		Server:    "https://staging.example.com",
+		User:      "staging-admin",
+		Namespace: "default",
+	}, result, "the first file to define a context wins")
+}
+
+func TestKubeAliasesAndProduction(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("KUBECONFIG", writeKubeconfig(t, dir, "config", `
+current-context: arn:aws:eks:us-east-1:123456789012:cluster/payments
+contexts:
+- name: arn:aws:eks:us-east-1:123456789012:cluster/payments
+  context:
+    cluster: payments
+    namespace: api
+`))
+
+	op := &Kube{}
+	require.NoError(t, op.Configure(map[string]interface{}{
+		"aliases": []interface{}{
+			map[string]interface{}{"context": "arn:aws:eks:us-east-1:123456789012:cluster/payments", "alias": "payments"},
+		},
+		"production": []interface{}{"payments"},
+	}))
+
+	result, err := op.Generate(context.Background(), "pane", testTmuxInstance, dir, "")
+	require.NoError(t, err)
+	kube := result.(KubeResult)
+	require.Equal(t, "payments", kube.String())
+	require.Equal(t, "api", kube.Namespace)
+	require.True(t, kube.IsProduction)
+}
+
+func TestKubeWithoutCurrentContextIsNil(t *testing.T) {
+	t.Setenv("KUBECONFIG", filepath.Join(t.TempDir(), "missing"))
+
+	result, err := (&Kube{}).Generate(context.Background(), "pane", testTmuxInstance, "/", "")
+	require.NoError(t, err)
+	require.Nil(t, result)
+}
+
+func TestKubeConfigureRejectsMalformedAliases(t *testing.T) {
+	require.Error(t, (&Kube{}).Configure(map[string]interface{}{"aliases": map[string]interface{}{"a": "b"}}))
+	require.Error(t, (&Kube{}).Configure(map[string]interface{}{
+		"aliases": []interface{}{map[string]interface{}{"context": "a"}},
+	}))
+	require.Error(t, (&Kube{}).Configure(map[string]interface{}{"production": []interface{}{"[a"}}))
+}
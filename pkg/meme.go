@@ -16,10 +16,10 @@ const MemeDirEnvVar = "MEME_DIR"
 // MemeDirDefault mirrors meme.sh's default.
 const MemeDirDefault = "dotfiles/nix/memes"
 
-// MemeDir resolves the directory memes are read from: $MEME_DIR if set,
-// otherwise ~/dotfiles/nix/memes.
-func MemeDir() string {
-	if dir := os.Getenv(MemeDirEnvVar); dir != "" {
+// MemeDir resolves the directory memes are read from: $MEME_DIR if set in
+// getenv's environment, otherwise ~/dotfiles/nix/memes.
+func MemeDir(getenv func(string) string) string {
+	if dir := getenv(MemeDirEnvVar); dir != "" {
 		return dir
 	}
 	home, err := os.UserHomeDir()
@@ -58,6 +58,19 @@ func ListMemes(dir string) ([]string, error) {
 // and pulls its glyphs from MemeFont.ttf's SBIX color bitmaps.
 const MemeCodepointBase = 0x100000
 
+// MemeCodepointCount is the size of that range. Memes that sort past it have
+// no code point MemeTerminal renders, so they don't get one: the meme
+// operation leaves them out and MemeCodepoint reports an error for them.
+const MemeCodepointCount = 1024
+
+// memeCodepoint is the code point of the meme at index in ListMemes' output.
+func memeCodepoint(name string, index int) (rune, error) {
+	if index >= MemeCodepointCount {
+		return 0, fmt.Errorf("meme %q is number %d in sorted order, past the %d MemeTerminal can show", name, index+1, MemeCodepointCount)
+	}
+	return rune(MemeCodepointBase + index), nil
+}
+
 // MemeCodepoint resolves name to a meme in dir — the exact ListMemes() name
 // first, falling back to a case-insensitive match (erroring if that's
 // ambiguous, e.g. both "Pepe" and "pepe" present as distinct entries) — and
@@ -66,7 +79,8 @@ const MemeCodepointBase = 0x100000
 // (used by the Nix derivation that builds MemeFont.ttf, see dotfiles/nix/flake.nix)
 // assigns code points in, so the two stay in sync as long as the font is
 // rebuilt whenever the meme directory's contents change — there's no
-// separate manifest file recording the mapping.
+// separate manifest file recording the mapping. Memes past the first
+// MemeCodepointCount are an error.
 func MemeCodepoint(dir, name string) (rune, error) {
 	names, err := ListMemes(dir)
 	if err != nil {
@@ -74,7 +88,7 @@ func MemeCodepoint(dir, name string) (rune, error) {
 	}
 	for i, n := range names {
 		if n == name {
-			return rune(MemeCodepointBase + i), nil
+			return memeCodepoint(n, i)
 		}
 	}
 
@@ -95,5 +109,5 @@ func MemeCodepoint(dir, name string) (rune, error) {
 	if matchIdx == -1 {
 		return 0, fmt.Errorf("no meme named %q in %s", name, dir)
 	}
-	return rune(MemeCodepointBase + matchIdx), nil
+	return memeCodepoint(names[matchIdx], matchIdx)
 }
@@ -1,6 +1,8 @@
 package pkg
 
 import (
+	"context"
+	"fmt"
 	"os"
 	"path/filepath"
 	"testing"
@@ -16,15 +18,14 @@ func writeTestImage(t *testing.T, dir, name string, content []byte) string {
 }
 
 func TestMemeDirEnvOverride(t *testing.T) {
-	t.Setenv(MemeDirEnvVar, "/custom/meme/dir")
-	require.Equal(t, "/custom/meme/dir", MemeDir())
+	env := map[string]string{MemeDirEnvVar: "/custom/meme/dir"}
+	require.Equal(t, "/custom/meme/dir", MemeDir(func(key string) string { return env[key] }))
 }
 
 func TestMemeDirDefault(t *testing.T) {
-	t.Setenv(MemeDirEnvVar, "")
 	home, err := os.UserHomeDir()
 	require.NoError(t, err)
-	require.Equal(t, filepath.Join(home, MemeDirDefault), MemeDir())
+	require.Equal(t, filepath.Join(home, MemeDirDefault), MemeDir(func(string) string { return "" }))
 }
 
 func TestListMemes(t *testing.T) {
@@ -103,3 +104,23 @@ func TestMemeCodepointAmbiguous(t *testing.T) {
 	require.Error(t, err)
 	require.Contains(t, err.Error(), "ambiguous")
 }
+
+func TestMemeCodepointPastRange(t *testing.T) {
+	dir := t.TempDir()
+	for i := 0; i <= MemeCodepointCount; i++ {
+		writeTestImage(t, dir, fmt.Sprintf("meme%04d.png", i), []byte("a"))
+	}
+
+	got, err := MemeCodepoint(dir, fmt.Sprintf("meme%04d", MemeCodepointCount-1))
+	require.NoError(t, err)
+	require.Equal(t, rune(MemeCodepointBase+MemeCodepointCount-1), got)
+
+	_, err = MemeCodepoint(dir, fmt.Sprintf("meme%04d", MemeCodepointCount))
+	require.ErrorContains(t, err, "past the 1024 MemeTerminal can show")
+
+	t.Setenv(MemeDirEnvVar, dir)
+	result, err := (&Meme{}).Generate(context.Background(), "pane", testTmuxInstance, dir, "")
+	require.NoError(t, err)
+	require.Len(t, result, MemeCodepointCount)
+	require.NotContains(t, result, fmt.Sprintf("meme%04d", MemeCodepointCount))
+}
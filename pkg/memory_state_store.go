@@ -6,20 +6,22 @@ import (
 )
 
 type MemoryStateStore struct {
-	mu    sync.RWMutex
-	store map[string]string
+	mu sync.RWMutex
+	// store is keyed by instance first so DeleteInstance can drop a whole
+	// instance at once.
+	store map[InstanceKey]map[string]string
 }
 
 func NewMemoryStateStore() *MemoryStateStore {
 	return &MemoryStateStore{
-		store: make(map[string]string),
+		store: make(map[InstanceKey]map[string]string),
 	}
 }
 
 func (m *MemoryStateStore) Get(locationKey LocationKey, instanceKey InstanceKey, operationName OperationName) (string, error) {
 	m.mu.RLock()
-	key := fmt.Sprintf("%s-%s-%s", locationKey, instanceKey, operationName)
-	content, exists := m.store[key]
+	key := fmt.Sprintf("%s-%s", locationKey, operationName)
+	content, exists := m.store[instanceKey][key]
 	m.mu.RUnlock()
 
 	if exists {
@@ -32,8 +34,18 @@ func (m *MemoryStateStore) Get(locationKey LocationKey, instanceKey InstanceKey,
 func (m *MemoryStateStore) Set(locationKey LocationKey, instanceKey InstanceKey, operationName OperationName, value string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	key := fmt.Sprintf("%s-%s-%s", locationKey, instanceKey, operationName)
-	m.store[key] = value
+	key := fmt.Sprintf("%s-%s", locationKey, operationName)
+	if m.store[instanceKey] == nil {
+		m.store[instanceKey] = make(map[string]string)
+	}
+	m.store[instanceKey][key] = value
+	return nil
+}
+
+func (m *MemoryStateStore) DeleteInstance(instanceKey InstanceKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.store, instanceKey)
 	return nil
 }
 
@@ -1,18 +1,22 @@
 package pkg
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"reflect"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type Operation interface {
 	Name() OperationName
 	IsAsync() bool
-	Update(string, string) (string, error)
-	Generate(locationKey LocationKey, instanceKey InstanceKey, locationPath string, state string) (interface{}, error)
+	Update(ctx context.Context, locationPath string, state string) (string, error)
+	Generate(ctx context.Context, locationKey LocationKey, instance Instance, locationPath string, state string) (interface{}, error)
 }
 
 // Configurable is implemented by operations that take extra fields from
@@ -22,118 +26,233 @@ type Configurable interface {
 	Configure(rawConfig map[string]interface{}) error
 }
 
-// Git
-type Git struct{}
+// StateReducer is implemented by operations whose set-state input is an
+// event to fold into their state rather than the new state itself (e.g.
+// duration's "start"/"end"). See SetState.
+type StateReducer interface {
+	ReduceState(state string, input string) (string, error)
+}
 
-type GitResult struct {
-	Branch string
-	Status string
+// ResultTyper is implemented by operations whose Generate returns values of
+// one type (besides nil or an empty string standing in for "nothing"), so
+// strict templates can be checked against it (see Location.Strict). A nil
+// type means it can't be known up front.
+type ResultTyper interface {
+	ResultType() reflect.Type
 }
 
-func (b *Git) Name() OperationName                   { return "git" }
-func (b *Git) IsAsync() bool                         { return false }
-func (b *Git) Update(_ string, state string) (string, error) { return state, nil }
-func (b *Git) Generate(locationKey LocationKey, instanceKey InstanceKey, locationPath string, state string) (interface{}, error) {
-	cmd := exec.Command("git", "rev-parse", "--abbrev-ref", "HEAD")
-	cmd.Dir = locationPath
-	output, err := cmd.Output()
+// Git exposes the state of the repository enclosing the location path (see
+// GitResult). HEAD, stashes and operations in progress are read straight from
+// the git directory; only the working tree status needs `git status`, and
+// that is shared between everything rendering inside the same working tree
+// (see gitStatusCache).
+type Git struct{}
+
+func (b *Git) Name() OperationName    { return "git" }
+func (*Git) ResultType() reflect.Type { return reflect.TypeOf(GitResult{}) }
+
+// IsAsync: `git status` in a large repository can take far longer than a
+// status line redraw should, so Git renders from its last cached result.
+func (b *Git) IsAsync() bool                                                    { return true }
+func (b *Git) Update(_ context.Context, _ string, state string) (string, error) { return state, nil }
+func (b *Git) Generate(ctx context.Context, locationKey LocationKey, instance Instance, locationPath string, state string) (interface{}, error) {
+	workTree, gitDir, err := findGitDir(locationPath)
 	if err != nil {
 		return nil, nil
 	}
 
-	branch := strings.TrimSpace(string(output))
+	head, err := readGitHead(gitDir)
+	if err != nil {
+		return nil, fmt.Errorf("reading HEAD: %w", err)
+	}
 
-	commandStatus := exec.Command("git", "status", "-s")
-	commandStatus.Dir = locationPath
-	outputStatus, err := commandStatus.Output()
+	result, err := sharedGitStatusCache.get(ctx, stateStoreFrom(ctx), workTree, gitDir, func(ctx context.Context) (GitResult, error) {
+		return gitStatus(ctx, workTree)
+	})
 	if err != nil {
-		return nil, nil
+		return nil, err
 	}
 
-	status := strings.TrimSpace(string(outputStatus))
+	result.Branch = head.Branch
+	result.Commit = head.Commit
+	result.ShortCommit = ""
+	if len(head.Commit) >= 7 {
+		result.ShortCommit = head.Commit[:7]
+	}
+	result.Detached = head.Detached
+	result.Stashes = countGitStashes(gitDir)
+	result.Operation = gitOperationInProgress(gitDir)
 
-	return GitResult{Branch: branch, Status: status}, nil
+	return result, nil
 }
 
 // venv
 type PythonVirtualEnv struct{}
 
-func (*PythonVirtualEnv) Name() OperationName                   { return "venv" }
-func (*PythonVirtualEnv) IsAsync() bool                         { return false }
-func (*PythonVirtualEnv) Update(_ string, state string) (string, error) { return state, nil }
-func (*PythonVirtualEnv) Generate(locationKey LocationKey, instanceKey InstanceKey, locationPath string, state string) (interface{}, error) {
+func (*PythonVirtualEnv) Name() OperationName      { return "venv" }
+func (*PythonVirtualEnv) IsAsync() bool            { return false }
+func (*PythonVirtualEnv) ResultType() reflect.Type { return reflect.TypeOf("") }
+func (*PythonVirtualEnv) Update(_ context.Context, _ string, state string) (string, error) {
+	return state, nil
+}
+func (*PythonVirtualEnv) Generate(ctx context.Context, locationKey LocationKey, instance Instance, locationPath string, state string) (interface{}, error) {
 	return state, nil
 }
 
 // vim mode
 type VimMode struct{}
 
-func (*VimMode) Name() OperationName                   { return "vim" }
-func (*VimMode) IsAsync() bool                         { return false }
-func (*VimMode) Update(_ string, state string) (string, error) { return state, nil }
-func (*VimMode) Generate(locationKey LocationKey, instanceKey InstanceKey, locationPath string, state string) (interface{}, error) {
+func (*VimMode) Name() OperationName                                              { return "vim" }
+func (*VimMode) IsAsync() bool                                                    { return false }
+func (*VimMode) ResultType() reflect.Type                                         { return reflect.TypeOf("") }
+func (*VimMode) Update(_ context.Context, _ string, state string) (string, error) { return state, nil }
+func (*VimMode) Generate(ctx context.Context, locationKey LocationKey, instance Instance, locationPath string, state string) (interface{}, error) {
 	return state, nil
 }
 
-// // gcloud project
+// GCloudProject exposes the active gcloud configuration (see GCloudResult),
+// read from gcloud's own config files rather than by running `gcloud config`,
+// which takes the best part of a second to start. Nil if gcloud isn't set up.
 type GCloudProject struct{}
 
-func (*GCloudProject) Name() OperationName                   { return "gcloud" }
-func (*GCloudProject) IsAsync() bool                         { return false }
-func (*GCloudProject) Update(_ string, state string) (string, error) { return state, nil }
-func (*GCloudProject) Generate(locationKey LocationKey, instanceKey InstanceKey, locationPath string, state string) (interface{}, error) {
-	// #  if type "gcloud" > /dev/null && gcloud projects list > /dev/null 2>&1 ; then
-	// #    tmux setenv -g "PANE_GCLOUD_PROJECT${IDS}" "$(gcloud config get-value project)"
-	// #    tmux refresh-client -S
-	// #  fi
+func (*GCloudProject) Name() OperationName      { return "gcloud" }
+func (*GCloudProject) IsAsync() bool            { return false }
+func (*GCloudProject) ResultType() reflect.Type { return reflect.TypeOf(GCloudResult{}) }
+func (*GCloudProject) Update(_ context.Context, _ string, state string) (string, error) {
+	return state, nil
+}
+func (*GCloudProject) Generate(ctx context.Context, locationKey LocationKey, instance Instance, locationPath string, state string) (interface{}, error) {
+	result, err := readGCloudConfig(instance.Getenv)
+	if err != nil || result == nil {
+		return nil, err
+	}
+	return *result, nil
+}
+
+// AWS exposes the effective AWS CLI profile (see AWSResult), read from the
+// environment and ~/.aws the same way GCloudProject avoids running gcloud.
+// Nil if AWS isn't set up.
+type AWS struct{}
 
-	return "", nil
+func (*AWS) Name() OperationName      { return "aws" }
+func (*AWS) IsAsync() bool            { return false }
+func (*AWS) ResultType() reflect.Type { return reflect.TypeOf(AWSResult{}) }
+func (*AWS) Update(_ context.Context, _ string, state string) (string, error) {
+	return state, nil
+}
+func (*AWS) Generate(ctx context.Context, locationKey LocationKey, instance Instance, locationPath string, state string) (interface{}, error) {
+	result, err := readAWSConfig(instance.Getenv, time.Now())
+	if err != nil || result == nil {
+		return nil, err
+	}
+	return *result, nil
 }
 
-// // exit code
+// ExitCode exposes the last command line's status (see ExitCodeResult), set
+// from the shell with either $? or the whole pipestatus:
+//
+//	commandline_thing set-state prompt "$id" exit_code "${pipestatus[*]}"
+//
+// Before the first command there's no status and it renders as empty.
 type ExitCode struct{}
 
-func (*ExitCode) Name() OperationName                   { return "exit_code" }
-func (*ExitCode) IsAsync() bool                         { return false }
-func (*ExitCode) Update(_ string, state string) (string, error) { return state, nil }
-func (*ExitCode) Generate(locationKey LocationKey, instanceKey InstanceKey, locationPath string, state string) (interface{}, error) {
-	return state, nil
+func (*ExitCode) Name() OperationName                                              { return "exit_code" }
+func (*ExitCode) IsAsync() bool                                                    { return false }
+func (*ExitCode) ResultType() reflect.Type                                         { return reflect.TypeOf(ExitCodeResult{}) }
+func (*ExitCode) Update(_ context.Context, _ string, state string) (string, error) { return state, nil }
+func (*ExitCode) Generate(ctx context.Context, locationKey LocationKey, instance Instance, locationPath string, state string) (interface{}, error) {
+	result, err := parseExitCodes(state)
+	if err != nil || result == nil {
+		return "", err
+	}
+	return *result, nil
+}
+
+// WorkingDirectory exposes the location path shortened in several ways (see
+// WorkingDirectoryResult). All settings are optional:
+//
+//   - type: working_directory
+//     fish_length: 2
+//     max_length: 30
+//     named_dirs: [{path: ~/src/github.com/pj, name: "pj:"}]
+//
+// fish_length defaults to 1 and max_length to no limit.
+type WorkingDirectory struct {
+	namedDirs  []namedDir
+	fishLength int
+	maxLength  int
 }
 
-type WorkingDirectory struct{}
+func (*WorkingDirectory) Name() OperationName      { return "working_directory" }
+func (*WorkingDirectory) IsAsync() bool            { return false }
+func (*WorkingDirectory) ResultType() reflect.Type { return reflect.TypeOf(WorkingDirectoryResult{}) }
+
+func (w *WorkingDirectory) Configure(rawConfig map[string]interface{}) error {
+	for _, key := range []string{"fish_length", "max_length"} {
+		raw, ok := rawConfig[key]
+		if !ok {
+			continue
+		}
+		length, ok := raw.(int)
+		if !ok || length < 1 {
+			return fmt.Errorf("working_directory: %s must be a positive integer", key)
+		}
+		if key == "fish_length" {
+			w.fishLength = length
+		} else {
+			w.maxLength = length
+		}
+	}
+
+	if namedDirsRaw, ok := rawConfig["named_dirs"]; ok {
+		namedDirs, err := parseNamedDirs(namedDirsRaw, userHomeDir())
+		if err != nil {
+			return err
+		}
+		w.namedDirs = namedDirs
+	}
+	return nil
+}
 
-func (*WorkingDirectory) Name() OperationName                   { return "working_directory" }
-func (*WorkingDirectory) IsAsync() bool                         { return false }
-func (*WorkingDirectory) Update(_ string, state string) (string, error) { return state, nil }
-func (*WorkingDirectory) Generate(locationKey LocationKey, instanceKey InstanceKey, locationPath string, state string) (interface{}, error) {
+func (*WorkingDirectory) Update(_ context.Context, _ string, state string) (string, error) {
+	return state, nil
+}
+func (w *WorkingDirectory) Generate(ctx context.Context, locationKey LocationKey, instance Instance, locationPath string, state string) (interface{}, error) {
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
 		return "", err
 	}
 
-	if strings.HasPrefix(locationPath, homeDir) {
-		correctedPath := strings.Replace(locationPath, homeDir, "~", 1)
-		return correctedPath, nil
+	fishLength := w.fishLength
+	if fishLength == 0 {
+		fishLength = 1
 	}
-
-	return locationPath, nil
+	return workingDirectory(locationPath, filepath.Clean(homeDir), w.namedDirs, fishLength, w.maxLength), nil
 }
 
 type TmuxActivePane struct{}
 
-func (*TmuxActivePane) Name() OperationName                   { return "tmux_active_pane" }
-func (*TmuxActivePane) IsAsync() bool                         { return false }
-func (*TmuxActivePane) Update(_ string, state string) (string, error) { return state, nil }
-func (*TmuxActivePane) Generate(locationKey LocationKey, instanceKey InstanceKey, locationPath string, state string) (interface{}, error) {
-	tmux := os.Getenv("TMUX")
+func (*TmuxActivePane) Name() OperationName      { return "tmux_active_pane" }
+func (*TmuxActivePane) IsAsync() bool            { return false }
+func (*TmuxActivePane) ResultType() reflect.Type { return reflect.TypeOf(false) }
+func (*TmuxActivePane) Update(_ context.Context, _ string, state string) (string, error) {
+	return state, nil
+}
+func (*TmuxActivePane) Generate(ctx context.Context, locationKey LocationKey, instance Instance, locationPath string, state string) (interface{}, error) {
+	tmux := instance.Getenv("TMUX")
 	if tmux == "" {
 		return false, nil
 	}
 
-	paneId := strings.Split(string(instanceKey), ".")[1]
+	paneId, ok := instance.TmuxPane()
+	if !ok {
+		return false, nil
+	}
 
-	cmd := exec.Command("tmux", "display", "-p", "#{=-1:pane_id}")
+	cmd := exec.CommandContext(ctx, "tmux", "display", "-p", "#{=-1:pane_id}")
 	cmd.Dir = locationPath
+	// $TMUX is how tmux finds the client's server.
+	cmd.Env = append(os.Environ(), "TMUX="+tmux)
 	output, err := cmd.Output()
 	if err != nil {
 		return false, err
@@ -144,45 +263,69 @@ func (*TmuxActivePane) Generate(locationKey LocationKey, instanceKey InstanceKey
 
 type TmuxCurrentPane struct{}
 
-func (*TmuxCurrentPane) Name() OperationName                   { return "tmux_current_pane" }
-func (*TmuxCurrentPane) IsAsync() bool                         { return false }
-func (*TmuxCurrentPane) Update(_ string, state string) (string, error) { return state, nil }
-func (*TmuxCurrentPane) Generate(locationKey LocationKey, instanceKey InstanceKey, locationPath string, state string) (interface{}, error) {
-	tmux := os.Getenv("TMUX")
+func (*TmuxCurrentPane) Name() OperationName      { return "tmux_current_pane" }
+func (*TmuxCurrentPane) IsAsync() bool            { return false }
+func (*TmuxCurrentPane) ResultType() reflect.Type { return reflect.TypeOf("") }
+func (*TmuxCurrentPane) Update(_ context.Context, _ string, state string) (string, error) {
+	return state, nil
+}
+func (*TmuxCurrentPane) Generate(ctx context.Context, locationKey LocationKey, instance Instance, locationPath string, state string) (interface{}, error) {
+	tmux := instance.Getenv("TMUX")
 	if tmux == "" {
 		return "", nil
 	}
-	paneId := strings.Split(string(instanceKey), ".")[1]
+	paneId, _ := instance.TmuxPane()
 	return paneId, nil
 }
 
 type InTmux struct{}
 
-func (*InTmux) Name() OperationName                   { return "in_tmux" }
-func (*InTmux) IsAsync() bool                         { return false }
-func (*InTmux) Update(_ string, state string) (string, error) { return state, nil }
-func (*InTmux) Generate(locationKey LocationKey, instanceKey InstanceKey, locationPath string, state string) (interface{}, error) {
-	tmux := os.Getenv("TMUX")
+func (*InTmux) Name() OperationName                                              { return "in_tmux" }
+func (*InTmux) IsAsync() bool                                                    { return false }
+func (*InTmux) ResultType() reflect.Type                                         { return reflect.TypeOf(false) }
+func (*InTmux) Update(_ context.Context, _ string, state string) (string, error) { return state, nil }
+func (*InTmux) Generate(ctx context.Context, locationKey LocationKey, instance Instance, locationPath string, state string) (interface{}, error) {
+	tmux := instance.Getenv("TMUX")
 	return tmux != "", nil
 }
 
-type HostDetails struct{}
+// HostDetails describes the host and session: who we are, whether we got
+// here over SSH, and whether we're inside a container or VM (see
+// HostDetailsResult).
+//
+// Optionally configured with hostname globs that mark production machines:
+//
+//   - type: host_details
+//     production: ["prod-*", "*.prod.example.com"]
+type HostDetails struct {
+	production []string
+}
+
+func (*HostDetails) Name() OperationName      { return "host_details" }
+func (*HostDetails) IsAsync() bool            { return false }
+func (*HostDetails) ResultType() reflect.Type { return reflect.TypeOf(HostDetailsResult{}) }
 
-type HostDetailsResult struct {
-	Hostname string
-	IsSSH    bool
+func (h *HostDetails) Configure(rawConfig map[string]interface{}) error {
+	production, err := configurePatterns(rawConfig, "host_details", "production")
+	if err != nil {
+		return err
+	}
+	h.production = production
+	return nil
 }
 
-func (*HostDetails) Name() OperationName                   { return "host_details" }
-func (*HostDetails) IsAsync() bool                         { return false }
-func (*HostDetails) Update(_ string, state string) (string, error) { return state, nil }
-func (*HostDetails) Generate(locationKey LocationKey, instanceKey InstanceKey, locationPath string, state string) (interface{}, error) {
+func (*HostDetails) Update(_ context.Context, _ string, state string) (string, error) {
+	return state, nil
+}
+func (h *HostDetails) Generate(ctx context.Context, locationKey LocationKey, instance Instance, locationPath string, state string) (interface{}, error) {
 	hostname, err := os.Hostname()
 	if err != nil {
 		return nil, err
 	}
 
-	return HostDetailsResult{Hostname: hostname, IsSSH: false}, nil
+	probe := instanceHostProbe(instance)
+	probe.store, probe.instanceKey = stateStoreFrom(ctx), instance.Key
+	return probe.details(ctx, hostname, h.production), nil
 }
 
 // Meme exposes every meme in the meme directory to templates as
@@ -196,16 +339,20 @@ func (*HostDetails) Generate(locationKey LocationKey, instanceKey InstanceKey, l
 // {{ .meme.doge-2 }}.
 type Meme struct{}
 
-func (*Meme) Name() OperationName                   { return "meme" }
-func (*Meme) IsAsync() bool                         { return false }
-func (*Meme) Update(_ string, state string) (string, error) { return state, nil }
-func (*Meme) Generate(locationKey LocationKey, instanceKey InstanceKey, locationPath string, state string) (interface{}, error) {
-	dir := MemeDir()
+func (*Meme) Name() OperationName                                              { return "meme" }
+func (*Meme) IsAsync() bool                                                    { return false }
+func (*Meme) ResultType() reflect.Type                                         { return reflect.TypeOf(map[string]string{}) }
+func (*Meme) Update(_ context.Context, _ string, state string) (string, error) { return state, nil }
+func (*Meme) Generate(ctx context.Context, locationKey LocationKey, instance Instance, locationPath string, state string) (interface{}, error) {
+	dir := MemeDir(instance.Getenv)
 	names, err := ListMemes(dir)
 	if err != nil {
 		return nil, err
 	}
 
+	if len(names) > MemeCodepointCount {
+		names = names[:MemeCodepointCount]
+	}
 	memes := make(map[string]string, len(names))
 	for i, name := range names {
 		memes[name] = string(rune(MemeCodepointBase + i))
@@ -222,9 +369,9 @@ func (*Meme) Generate(locationKey LocationKey, instanceKey InstanceKey, location
 //
 // Configured in YAML as:
 //
-//	- type: cycle
-//	  name: nyan
-//	  names: [nyan1, nyan2, nyan3, nyan4]
+//   - type: cycle
+//     name: nyan
+//     names: [nyan1, nyan2, nyan3, nyan4]
 //
 // `name` becomes this instance's effective Name() — the template field
 // (.nyan) and the state-store key both key off it instead of the fixed
@@ -244,7 +391,8 @@ func (c *Cycle) Name() OperationName {
 	}
 	return "cycle"
 }
-func (*Cycle) IsAsync() bool { return false }
+func (*Cycle) IsAsync() bool            { return false }
+func (*Cycle) ResultType() reflect.Type { return reflect.TypeOf("") }
 
 func (c *Cycle) Configure(rawConfig map[string]interface{}) error {
 	if nameRaw, ok := rawConfig["name"]; ok {
@@ -286,12 +434,12 @@ func (c *Cycle) currentIndex(state string) int {
 	return idx
 }
 
-func (c *Cycle) Update(locationPath string, state string) (string, error) {
+func (c *Cycle) Update(_ context.Context, locationPath string, state string) (string, error) {
 	next := (c.currentIndex(state) + 1) % len(c.names)
 	return strconv.Itoa(next), nil
 }
 
-func (c *Cycle) Generate(locationKey LocationKey, instanceKey InstanceKey, locationPath string, state string) (interface{}, error) {
+func (c *Cycle) Generate(ctx context.Context, locationKey LocationKey, instance Instance, locationPath string, state string) (interface{}, error) {
 	return c.names[c.currentIndex(state)], nil
 }
 
@@ -305,13 +453,17 @@ func LoadAvailableOperations() Operations {
 		(&PythonVirtualEnv{}).Name(): func() Operation { return &PythonVirtualEnv{} },
 		(&VimMode{}).Name():          func() Operation { return &VimMode{} },
 		(&GCloudProject{}).Name():    func() Operation { return &GCloudProject{} },
+		(&AWS{}).Name():              func() Operation { return &AWS{} },
 		(&ExitCode{}).Name():         func() Operation { return &ExitCode{} },
+		(&Duration{}).Name():         func() Operation { return &Duration{} },
 		(&WorkingDirectory{}).Name(): func() Operation { return &WorkingDirectory{} },
 		(&TmuxActivePane{}).Name():   func() Operation { return &TmuxActivePane{} },
 		(&TmuxCurrentPane{}).Name():  func() Operation { return &TmuxCurrentPane{} },
 		(&HostDetails{}).Name():      func() Operation { return &HostDetails{} },
+		(&Kube{}).Name():             func() Operation { return &Kube{} },
 		(&InTmux{}).Name():           func() Operation { return &InTmux{} },
 		(&Meme{}).Name():             func() Operation { return &Meme{} },
 		(&Cycle{}).Name():            func() Operation { return &Cycle{} },
+		(&Command{}).Name():          func() Operation { return &Command{} },
 	}
 }
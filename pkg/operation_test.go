@@ -1,6 +1,7 @@
 package pkg
 
 import (
+	"context"
 	"os"
 	"path/filepath"
 	"strings"
@@ -19,7 +20,7 @@ func TestMemeOperationGenerateReturnsCodepointPerName(t *testing.T) {
 	op := &Meme{}
 	require.Equal(t, OperationName("meme"), op.Name())
 
-	result, err := op.Generate("pane", "tmux.%1", dir, "")
+	result, err := op.Generate(context.Background(), "pane", testTmuxInstance, dir, "")
 	require.NoError(t, err)
 
 	memes, ok := result.(map[string]string)
@@ -35,7 +36,7 @@ func TestMemeOperationUsableAsDottedTemplateField(t *testing.T) {
 	t.Setenv(MemeDirEnvVar, dir)
 
 	op := &Meme{}
-	result, err := op.Generate("pane", "tmux.%1", dir, "")
+	result, err := op.Generate(context.Background(), "pane", testTmuxInstance, dir, "")
 	require.NoError(t, err)
 
 	tmpl, err := template.New("t").Parse("{{ .meme.pepe }}")
@@ -112,16 +113,16 @@ func TestCycleUpdateAdvancesAndWraps(t *testing.T) {
 		"names": []interface{}{"a", "b", "c"},
 	}))
 
-	next, err := c.Update("", "")
+	next, err := c.Update(context.Background(), "", "")
 	require.NoError(t, err)
 	require.Equal(t, "1", next)
 
-	next, err = c.Update("", "1")
+	next, err = c.Update(context.Background(), "", "1")
 	require.NoError(t, err)
 	require.Equal(t, "2", next)
 
 	// wraps back to 0 after the last index
-	next, err = c.Update("", "2")
+	next, err = c.Update(context.Background(), "", "2")
 	require.NoError(t, err)
 	require.Equal(t, "0", next)
 }
@@ -132,7 +133,7 @@ func TestCycleUpdateTreatsInvalidStateAsZero(t *testing.T) {
 		"names": []interface{}{"a", "b"},
 	}))
 
-	next, err := c.Update("", "not-a-number")
+	next, err := c.Update(context.Background(), "", "not-a-number")
 	require.NoError(t, err)
 	require.Equal(t, "1", next)
 }
@@ -143,7 +144,7 @@ func TestCycleGenerateReturnsNameAtState(t *testing.T) {
 		"names": []interface{}{"nyan1", "nyan2", "nyan3", "nyan4"},
 	}))
 
-	result, err := c.Generate("prompt", "12345", "", "2")
+	result, err := c.Generate(context.Background(), "prompt", testShellInstance, "", "2")
 	require.NoError(t, err)
 	require.Equal(t, "nyan3", result)
 }
@@ -154,7 +155,7 @@ func TestCycleGenerateOutOfRangeStateFallsBackToZero(t *testing.T) {
 		"names": []interface{}{"a", "b"},
 	}))
 
-	result, err := c.Generate("prompt", "12345", "", "99")
+	result, err := c.Generate(context.Background(), "prompt", testShellInstance, "", "99")
 	require.NoError(t, err)
 	require.Equal(t, "a", result)
 }
@@ -166,7 +167,7 @@ func TestCycleUsableWithMemeMapInTemplateViaIndex(t *testing.T) {
 	t.Setenv(MemeDirEnvVar, dir)
 
 	memeOp := &Meme{}
-	memes, err := memeOp.Generate("prompt", "12345", dir, "")
+	memes, err := memeOp.Generate(context.Background(), "prompt", testShellInstance, dir, "")
 	require.NoError(t, err)
 
 	cycleOp := &Cycle{}
@@ -174,7 +175,7 @@ func TestCycleUsableWithMemeMapInTemplateViaIndex(t *testing.T) {
 		"name":  "nyan",
 		"names": []interface{}{"nyan1", "nyan2"},
 	}))
-	current, err := cycleOp.Generate("prompt", "12345", dir, "1")
+	current, err := cycleOp.Generate(context.Background(), "prompt", testShellInstance, dir, "1")
 	require.NoError(t, err)
 
 	tmpl, err := template.New("t").Parse(`{{ index .meme .nyan }}`)
@@ -0,0 +1,512 @@
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PluginProtocolVersion is the version of the plugin protocol spoken here.
+//
+// A plugin is an executable that reads requests from stdin and answers each
+// with a response on stdout, one JSON object per line:
+//
+//	{"version": 1, "method": "name"}
+//	{"version": 1, "name": "weather", "async": true}
+//
+//	{"version": 1, "method": "update", "locationPath": "/src", "state": "...", "config": {...}}
+//	{"version": 1, "state": "..."}
+//
+//	{"version": 1, "method": "generate", "locationKey": "prompt", "instanceKey": "shell.123",
+//	 "instance": {"key": "shell.123", "kind": "shell", "pid": 123},
+//	 "locationPath": "/src", "state": "...", "config": {...}}
+//	{"version": 1, "data": {"temperature": 21}}
+//
+// config is the operation's YAML entry and instance the parsed instanceKey
+// (see Instance). An update response without "state" leaves the state
+// unchanged. A response with a non-empty "error" fails the call. Plugins are
+// started per request, except under the daemon where they're kept running
+// and sent one request after another; a plugin should therefore keep
+// answering until stdin closes. Under the daemon, update and generate
+// requests also carry "env", the environment variables the client forwarded
+// (see ClientEnvironment); a plugin started per request runs in that
+// environment, but a resident one has to read it from the request.
+const PluginProtocolVersion = 1
+
+// PluginConfig declares a plugin in the config's top-level `plugins` list:
+//
+//	plugins:
+//	  - path: ~/bin/clt-weather
+//	    args: [--units, metric]
+//	    name: weather
+//	    async: true
+//
+// Operations then use it like a built-in (`type: weather`). Without `name`,
+// the plugin is started to ask for its name (and whether it's async), and
+// the answer remembered until the executable changes (see handshake); give
+// `name` and `async` to skip that altogether. Under the daemon the process
+// is kept running unless keep_alive is false, and what it writes to stderr
+// is logged.
+type PluginConfig struct {
+	Path      string   `mapstructure:"path"`
+	Args      []string `mapstructure:"args"`
+	Name      string   `mapstructure:"name"`
+	Async     bool     `mapstructure:"async"`
+	KeepAlive *bool    `mapstructure:"keep_alive"`
+}
+
+func (c PluginConfig) key() string {
+	return c.Path + "\x00" + strings.Join(c.Args, "\x00")
+}
+
+type pluginRequest struct {
+	Version      int                    `json:"version"`
+	Method       string                 `json:"method"`
+	LocationKey  LocationKey            `json:"locationKey,omitempty"`
+	InstanceKey  InstanceKey            `json:"instanceKey,omitempty"`
+	Instance     *Instance              `json:"instance,omitempty"`
+	LocationPath string                 `json:"locationPath,omitempty"`
+	State        string                 `json:"state"`
+	Config       map[string]interface{} `json:"config,omitempty"`
+	// Env is the client's environment (see Instance.Env), which plugins
+	// started per request also run in.
+	Env map[string]string `json:"env,omitempty"`
+}
+
+type pluginResponse struct {
+	Version int         `json:"version"`
+	Name    string      `json:"name"`
+	Async   bool        `json:"async"`
+	State   *string     `json:"state"`
+	Data    interface{} `json:"data"`
+	Error   string      `json:"error"`
+}
+
+// decodePluginResponse parses a response line, rejecting protocol versions
+// newer than ours and responses that report an error.
+func decodePluginResponse(line []byte) (pluginResponse, error) {
+	var resp pluginResponse
+	if err := json.Unmarshal(line, &resp); err != nil {
+		return resp, fmt.Errorf("invalid response: %w", err)
+	}
+	if resp.Version > PluginProtocolVersion {
+		return resp, fmt.Errorf("unsupported protocol version %d", resp.Version)
+	}
+	if resp.Error != "" {
+		return resp, errors.New(resp.Error)
+	}
+	return resp, nil
+}
+
+// callPluginOnce starts the plugin, sends it one request and waits for it
+// to exit.
+func callPluginOnce(ctx context.Context, config PluginConfig, req pluginRequest) (pluginResponse, error) {
+	line, err := json.Marshal(req)
+	if err != nil {
+		return pluginResponse{}, err
+	}
+
+	cmd := exec.CommandContext(ctx, config.Path, config.Args...)
+	cmd.Env = Instance{Env: req.Env}.Environ()
+	cmd.Stdin = bytes.NewReader(append(line, '\n'))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return pluginResponse{}, fmt.Errorf("%w: %s", err, message)
+		}
+		return pluginResponse{}, err
+	}
+
+	first, _, _ := bytes.Cut(output, []byte("\n"))
+	return decodePluginResponse(first)
+}
+
+// pluginProcess is a plugin kept running between requests, which are sent
+// one at a time. A process that exits or stops answering in time is killed
+// and started afresh on the next request.
+type pluginProcess struct {
+	config PluginConfig
+	logger *log.Logger
+
+	mu     sync.Mutex
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+}
+
+func (p *pluginProcess) start() error {
+	cmd := exec.Command(p.config.Path, p.config.Args...)
+	if p.logger != nil {
+		cmd.Stderr = &lineLogger{logger: p.logger, prefix: "plugin " + p.config.Path + ": "}
+		// Don't let a child that inherited stderr hold up stopping it.
+		cmd.WaitDelay = time.Second
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	p.cmd, p.stdin, p.stdout = cmd, stdin, bufio.NewReader(stdout)
+	return nil
+}
+
+// stopLocked kills the process, if running. p.mu must be held.
+func (p *pluginProcess) stopLocked() {
+	if p.cmd == nil {
+		return
+	}
+	p.stdin.Close()
+	p.cmd.Process.Kill()
+	p.cmd.Wait()
+	p.cmd, p.stdin, p.stdout = nil, nil, nil
+}
+
+func (p *pluginProcess) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stopLocked()
+}
+
+func (p *pluginProcess) call(ctx context.Context, req pluginRequest) (pluginResponse, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.cmd == nil {
+		if err := p.start(); err != nil {
+			return pluginResponse{}, err
+		}
+	}
+
+	line, err := json.Marshal(req)
+	if err != nil {
+		return pluginResponse{}, err
+	}
+	if _, err := p.stdin.Write(append(line, '\n')); err != nil {
+		p.stopLocked()
+		return pluginResponse{}, fmt.Errorf("plugin exited: %w", err)
+	}
+
+	type result struct {
+		line []byte
+		err  error
+	}
+	done := make(chan result, 1)
+	stdout := p.stdout
+	go func() {
+		line, err := stdout.ReadBytes('\n')
+		done <- result{line, err}
+	}()
+
+	select {
+	case r := <-done:
+		if r.err != nil {
+			p.stopLocked()
+			return pluginResponse{}, fmt.Errorf("plugin exited: %w", r.err)
+		}
+		return decodePluginResponse(r.line)
+	case <-ctx.Done():
+		// The reader goroutine is stuck on a response that may still
+		// arrive; only a fresh process can be trusted to stay in step.
+		p.stopLocked()
+		return pluginResponse{}, ctx.Err()
+	}
+}
+
+// pluginRegistry holds the plugin processes kept running under the daemon,
+// so config reloads reuse them.
+type pluginRegistry struct {
+	mu        sync.Mutex
+	resident  bool
+	logger    *log.Logger
+	processes map[string]*pluginProcess
+}
+
+var plugins = &pluginRegistry{processes: make(map[string]*pluginProcess)}
+
+// KeepPluginsResident makes plugins loaded from now on stay running between
+// requests (unless they opt out with keep_alive: false), with what they write
+// to stderr going to logger. The daemon calls it before loading its config;
+// one-shot commands start plugins per request.
+func KeepPluginsResident(logger *log.Logger) {
+	plugins.mu.Lock()
+	defer plugins.mu.Unlock()
+	plugins.resident = true
+	plugins.logger = logger
+}
+
+// ClosePlugins stops every resident plugin process.
+func ClosePlugins() {
+	plugins.retain(nil)
+}
+
+// caller returns how to send requests to the plugin: through its resident
+// process, or by starting it for each one.
+func (r *pluginRegistry) caller(config PluginConfig) func(context.Context, pluginRequest) (pluginResponse, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.resident || (config.KeepAlive != nil && !*config.KeepAlive) {
+		return func(ctx context.Context, req pluginRequest) (pluginResponse, error) {
+			return callPluginOnce(ctx, config, req)
+		}
+	}
+
+	process, ok := r.processes[config.key()]
+	if !ok {
+		process = &pluginProcess{config: config, logger: r.logger}
+		r.processes[config.key()] = process
+	}
+	return process.call
+}
+
+// retain stops resident processes for plugins no longer in configs.
+func (r *pluginRegistry) retain(configs []PluginConfig) {
+	keep := make(map[string]bool, len(configs))
+	for _, config := range configs {
+		keep[config.key()] = true
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key, process := range r.processes {
+		if !keep[key] {
+			process.close()
+			delete(r.processes, key)
+		}
+	}
+}
+
+// registerPlugins returns operations extended with a factory for each
+// plugin, asking plugins that don't declare a name for theirs.
+func registerPlugins(ctx context.Context, operations Operations, configs []PluginConfig) (Operations, error) {
+	if len(configs) == 0 {
+		return operations, nil
+	}
+
+	extended := make(Operations, len(operations)+len(configs))
+	for name, newOperation := range operations {
+		extended[name] = newOperation
+	}
+
+	for i := range configs {
+		config := configs[i]
+		if config.Path == "" {
+			return nil, fmt.Errorf("plugin %d: path is required", i)
+		}
+		if expanded, ok := substitutePrefix(config.Path, "~", userHomeDir()); ok {
+			config.Path = expanded
+		}
+		configs[i] = config
+
+		call := plugins.caller(config)
+		if config.Name == "" {
+			answer, err := handshake(ctx, config, call)
+			if err != nil {
+				return nil, fmt.Errorf("plugin %s: %w", config.Path, err)
+			}
+			config.Name, config.Async = answer.Name, answer.Async
+		}
+
+		name := OperationName(config.Name)
+		if _, ok := extended[name]; ok {
+			return nil, fmt.Errorf("plugin %s: operation %s already exists", config.Path, name)
+		}
+		extended[name] = func() Operation {
+			return &PluginOperation{name: name, async: config.Async, call: call}
+		}
+	}
+
+	plugins.retain(configs)
+	return extended, nil
+}
+
+// pluginHandshake is a plugin's answer to "name", as remembered in
+// pluginHandshakeFile along with the executable's mtime when it was asked.
+type pluginHandshake struct {
+	ModTime time.Time `json:"modTime"`
+	Name    string    `json:"name"`
+	Async   bool      `json:"async"`
+}
+
+// pluginHandshakeFile is where handshake remembers plugins' answers between
+// commands.
+func pluginHandshakeFile() string {
+	return filepath.Join(userHomeDir(), ".config", "commandline_thing", "plugins.json")
+}
+
+// handshake asks a plugin for its name and whether it's async. Outside the
+// daemon the config is loaded by every command, prompt redraws included, so
+// the answer is remembered, keyed on the plugin's path and args, for as long
+// as the executable's mtime stays the same: only the first load after it's
+// installed or rebuilt pays for starting it.
+func handshake(ctx context.Context, config PluginConfig, call func(context.Context, pluginRequest) (pluginResponse, error)) (pluginHandshake, error) {
+	var modTime time.Time
+	if path, err := exec.LookPath(config.Path); err == nil {
+		if info, err := os.Stat(path); err == nil {
+			modTime = info.ModTime()
+		}
+	}
+	known := loadPluginHandshakes()
+	if cached, ok := known[config.key()]; ok && !modTime.IsZero() && cached.ModTime.Equal(modTime) {
+		return cached, nil
+	}
+
+	resp, err := runWithTimeout(ctx, DefaultOperationTimeout, func(ctx context.Context) (pluginResponse, error) {
+		return call(ctx, pluginRequest{Version: PluginProtocolVersion, Method: "name"})
+	})
+	if err != nil {
+		return pluginHandshake{}, err
+	}
+	if resp.Name == "" {
+		return pluginHandshake{}, errors.New("no name in response")
+	}
+
+	answer := pluginHandshake{ModTime: modTime, Name: resp.Name, Async: resp.Async}
+	if !modTime.IsZero() {
+		known[config.key()] = answer
+		// Failing to save only costs the next load another handshake.
+		storePluginHandshakes(known)
+	}
+	return answer, nil
+}
+
+// loadPluginHandshakes reads every remembered handshake. Failing to is
+// treated as having none.
+func loadPluginHandshakes() map[string]pluginHandshake {
+	known := map[string]pluginHandshake{}
+	raw, err := os.ReadFile(pluginHandshakeFile())
+	if err != nil {
+		return known
+	}
+	if err := json.Unmarshal(raw, &known); err != nil {
+		return map[string]pluginHandshake{}
+	}
+	return known
+}
+
+// storePluginHandshakes replaces the remembered handshakes, through a
+// rename so that a command loading them at the same time never sees half a
+// file.
+func storePluginHandshakes(known map[string]pluginHandshake) error {
+	raw, err := json.Marshal(known)
+	if err != nil {
+		return err
+	}
+	path := pluginHandshakeFile()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "plugins-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// lineLogger logs what's written to it a line at a time.
+type lineLogger struct {
+	logger  *log.Logger
+	prefix  string
+	pending []byte
+}
+
+func (w *lineLogger) Write(p []byte) (int, error) {
+	w.pending = append(w.pending, p...)
+	for {
+		line, rest, ok := bytes.Cut(w.pending, []byte("\n"))
+		if !ok {
+			break
+		}
+		w.logger.Printf("%s%s", w.prefix, line)
+		w.pending = rest
+	}
+	return len(p), nil
+}
+
+// PluginOperation adapts an external plugin to Operation. Like cycle, an
+// entry can set `name` to run the same plugin more than once in a location;
+// the whole entry is sent to the plugin as config.
+type PluginOperation struct {
+	name   OperationName
+	async  bool
+	call   func(context.Context, pluginRequest) (pluginResponse, error)
+	config map[string]interface{}
+}
+
+func (p *PluginOperation) Name() OperationName { return p.name }
+func (p *PluginOperation) IsAsync() bool       { return p.async }
+
+func (p *PluginOperation) Configure(rawConfig map[string]interface{}) error {
+	if nameRaw, ok := rawConfig["name"]; ok {
+		name, ok := nameRaw.(string)
+		if !ok {
+			return fmt.Errorf("%s: name must be a string", p.name)
+		}
+		p.name = OperationName(name)
+	}
+	p.config = rawConfig
+	return nil
+}
+
+func (p *PluginOperation) Update(ctx context.Context, locationPath string, state string) (string, error) {
+	resp, err := p.call(ctx, pluginRequest{
+		Version:      PluginProtocolVersion,
+		Method:       "update",
+		LocationPath: locationPath,
+		State:        state,
+		Config:       p.config,
+		Env:          instanceFrom(ctx).Env,
+	})
+	if err != nil {
+		return "", err
+	}
+	if resp.State == nil {
+		return state, nil
+	}
+	return *resp.State, nil
+}
+
+func (p *PluginOperation) Generate(ctx context.Context, locationKey LocationKey, instance Instance, locationPath string, state string) (interface{}, error) {
+	resp, err := p.call(ctx, pluginRequest{
+		Version:      PluginProtocolVersion,
+		Method:       "generate",
+		LocationKey:  locationKey,
+		InstanceKey:  instance.Key,
+		Instance:     &instance,
+		LocationPath: locationPath,
+		State:        state,
+		Config:       p.config,
+		Env:          instance.Env,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Data, nil
+}
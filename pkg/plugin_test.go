@@ -0,0 +1,197 @@
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestPluginHelperProcess isn't a real test: it's the plugin the other tests
+// run, by re-executing the test binary with CLT_TEST_PLUGIN set.
+func TestPluginHelperProcess(t *testing.T) {
+	if os.Getenv("CLT_TEST_PLUGIN") != "1" {
+		return
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		var req pluginRequest
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			fmt.Printf(`{"version": 1, "error": %q}`+"\n", err.Error())
+			continue
+		}
+
+		var resp interface{}
+		switch req.Method {
+		case "name":
+			resp = map[string]interface{}{"version": 1, "name": "weather"}
+		case "update":
+			if req.Config["keep_state"] == true {
+				resp = map[string]interface{}{"version": 1}
+			} else {
+				resp = map[string]interface{}{"version": 1, "state": req.State + "+"}
+			}
+		case "generate":
+			if req.Config["hang"] == true {
+				time.Sleep(time.Minute)
+			}
+			if message, ok := req.Config["stderr"].(string); ok {
+				fmt.Fprintln(os.Stderr, message)
+			}
+			resp = map[string]interface{}{"version": 1, "data": map[string]interface{}{
+				"state": req.State,
+				"pid":   os.Getpid(),
+				"unit":  req.Config["unit"],
+			}}
+		default:
+			resp = map[string]interface{}{"version": 1, "error": "unknown method " + req.Method}
+		}
+		line, _ := json.Marshal(resp)
+		fmt.Println(string(line))
+	}
+	os.Exit(0)
+}
+
+func testPluginConfig(t *testing.T) PluginConfig {
+	t.Helper()
+	t.Setenv("CLT_TEST_PLUGIN", "1")
+	// Keeps handshakes remembered by one test from leaking into others,
+	// or into the real config directory.
+	t.Setenv("HOME", t.TempDir())
+	return PluginConfig{Path: os.Args[0], Args: []string{"-test.run=^TestPluginHelperProcess$"}}
+}
+
+func newPluginOperation(t *testing.T, operations Operations, name OperationName, rawConfig map[string]interface{}) *PluginOperation {
+	t.Helper()
+	newOperation, ok := operations[name]
+	require.True(t, ok, "plugin %s not registered", name)
+	op := newOperation().(*PluginOperation)
+	require.NoError(t, op.Configure(rawConfig))
+	return op
+}
+
+func TestPluginOperationOneShot(t *testing.T) {
+	operations, err := registerPlugins(context.Background(), LoadAvailableOperations(), []PluginConfig{testPluginConfig(t)})
+	require.NoError(t, err)
+	require.Contains(t, operations, OperationName("git"), "built-in operations stay available")
+
+	op := newPluginOperation(t, operations, "weather", map[string]interface{}{"type": "weather", "unit": "metric"})
+	require.Equal(t, OperationName("weather"), op.Name())
+	require.False(t, op.IsAsync())
+
+	state, err := op.Update(context.Background(), "/tmp", "s")
+	require.NoError(t, err)
+	require.Equal(t, "s+", state)
+
+	first, err := op.Generate(context.Background(), "prompt", testShellInstance, "/tmp", state)
+	require.NoError(t, err)
+	require.Equal(t, "s+", first.(map[string]interface{})["state"])
+	require.Equal(t, "metric", first.(map[string]interface{})["unit"])
+
+	second, err := op.Generate(context.Background(), "prompt", testShellInstance, "/tmp", state)
+	require.NoError(t, err)
+	require.NotEqual(t, first.(map[string]interface{})["pid"], second.(map[string]interface{})["pid"], "each request starts the plugin afresh")
+
+	op = newPluginOperation(t, operations, "weather", map[string]interface{}{"type": "weather", "name": "kept", "keep_state": true})
+	require.Equal(t, OperationName("kept"), op.Name())
+	state, err = op.Update(context.Background(), "/tmp", "unchanged")
+	require.NoError(t, err)
+	require.Equal(t, "unchanged", state, "an update response without state leaves it alone")
+}
+
+func TestPluginOperationResident(t *testing.T) {
+	var logged bytes.Buffer
+	KeepPluginsResident(log.New(&logged, "", 0))
+	t.Cleanup(func() {
+		ClosePlugins()
+		plugins.mu.Lock()
+		plugins.resident = false
+		plugins.logger = nil
+		plugins.mu.Unlock()
+	})
+
+	config := testPluginConfig(t)
+	config.Name = "weather"
+	operations, err := registerPlugins(context.Background(), Operations{}, []PluginConfig{config})
+	require.NoError(t, err)
+	op := newPluginOperation(t, operations, "weather", map[string]interface{}{"type": "weather"})
+
+	first, err := op.Generate(context.Background(), "prompt", testShellInstance, "/tmp", "")
+	require.NoError(t, err)
+	second, err := op.Generate(context.Background(), "prompt", testShellInstance, "/tmp", "")
+	require.NoError(t, err)
+	require.Equal(t, first.(map[string]interface{})["pid"], second.(map[string]interface{})["pid"], "the process is reused between requests")
+
+	hanging := newPluginOperation(t, operations, "weather", map[string]interface{}{"type": "weather", "hang": true})
+	_, err = runWithTimeout(context.Background(), 100*time.Millisecond, func(ctx context.Context) (interface{}, error) {
+		return hanging.Generate(ctx, "prompt", testShellInstance, "/tmp", "")
+	})
+	require.ErrorIs(t, err, ErrOperationTimeout)
+
+	third, err := op.Generate(context.Background(), "prompt", testShellInstance, "/tmp", "")
+	require.NoError(t, err)
+	require.NotEqual(t, first.(map[string]interface{})["pid"], third.(map[string]interface{})["pid"], "a plugin that stopped answering is replaced")
+
+	noisy := newPluginOperation(t, operations, "weather", map[string]interface{}{"type": "weather", "stderr": "rate limited"})
+	_, err = noisy.Generate(context.Background(), "prompt", testShellInstance, "/tmp", "")
+	require.NoError(t, err)
+	ClosePlugins()
+	require.Contains(t, logged.String(), "plugin "+config.Path+": rate limited\n")
+}
+
+func TestPluginHandshakeIsRemembered(t *testing.T) {
+	config := testPluginConfig(t)
+	calls := 0
+	call := func(ctx context.Context, req pluginRequest) (pluginResponse, error) {
+		calls++
+		return callPluginOnce(ctx, config, req)
+	}
+
+	answer, err := handshake(context.Background(), config, call)
+	require.NoError(t, err)
+	require.Equal(t, "weather", answer.Name)
+	require.Equal(t, 1, calls)
+
+	answer, err = handshake(context.Background(), config, call)
+	require.NoError(t, err)
+	require.Equal(t, "weather", answer.Name)
+	require.Equal(t, 1, calls, "the plugin isn't asked again while it's unchanged")
+
+	known := loadPluginHandshakes()
+	stale := known[config.key()]
+	stale.ModTime = stale.ModTime.Add(-time.Hour)
+	known[config.key()] = stale
+	require.NoError(t, storePluginHandshakes(known))
+	_, err = handshake(context.Background(), config, call)
+	require.NoError(t, err)
+	require.Equal(t, 2, calls, "a rebuilt plugin is asked again")
+}
+
+func TestRegisterPluginsRejectsClashesAndMissingPaths(t *testing.T) {
+	config := testPluginConfig(t)
+	config.Name = "git"
+	_, err := registerPlugins(context.Background(), LoadAvailableOperations(), []PluginConfig{config})
+	require.ErrorContains(t, err, "already exists")
+
+	_, err = registerPlugins(context.Background(), LoadAvailableOperations(), []PluginConfig{{Name: "x"}})
+	require.ErrorContains(t, err, "path is required")
+}
+
+func TestDecodePluginResponse(t *testing.T) {
+	_, err := decodePluginResponse([]byte(`{"version": 2}`))
+	require.ErrorContains(t, err, "unsupported protocol version")
+
+	_, err = decodePluginResponse([]byte(`{"version": 1, "error": "no network"}`))
+	require.EqualError(t, err, "no network")
+
+	_, err = decodePluginResponse([]byte(`not json`))
+	require.Error(t, err)
+}
@@ -0,0 +1,31 @@
+package pkg
+
+import (
+	"log"
+	"os/exec"
+)
+
+// RunPostCommands starts every configured post command (typically something
+// like `tmux refresh-client -S`) without waiting for it to finish, so that
+// state changes show up immediately. They run in the environment of
+// instance's client (see Instance.Environ), so that e.g. tmux talks to the
+// client's server.
+func RunPostCommands(config *AllConfigs, logger *log.Logger, instance Instance) error {
+	for _, postCommand := range config.PostCommands {
+		cmd := exec.Command("sh", "-c", postCommand)
+		cmd.Env = instance.Environ()
+		logger.Printf("running post command: %s", postCommand)
+		cmd.Stdout = logger.Writer()
+		cmd.Stderr = logger.Writer()
+		err := cmd.Start()
+		if err != nil {
+			logger.Printf("failed to run post command %s: %s", postCommand, err)
+			return err
+		}
+		// Reap the child once it exits; a long-running daemon would otherwise
+		// accumulate zombies.
+		go cmd.Wait()
+	}
+
+	return nil
+}
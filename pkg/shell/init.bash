@@ -0,0 +1,79 @@
+# commandline_thing integration for bash: eval "$(commandline_thing init bash)"
+# The prompt location should use `dialect: bash`. Commands are timed through
+# bash-preexec if it's loaded, or a DEBUG trap if nothing else has one.
+# Readline has no keymap hook, so there's no vim mode state.
+
+__clt_bin={{ .Executable }}
+__clt_location={{ .Location }}
+__clt_locations=({{ .Locations }})
+if [[ -n $TMUX_PANE ]]; then
+  __clt_instance={{ .TmuxInstancePrefix }}"$TMUX_PANE"
+else
+  __clt_instance={{ .ShellInstancePrefix }}"$$"
+fi
+__clt_venv=$'\x01'
+__clt_prompt=""
+__clt_at_prompt=0
+
+__clt_set_state() {
+  local location
+  for location in "${__clt_locations[@]}"; do
+    "$__clt_bin" set-state "$location" "$__clt_instance" "$1" "$2" 2>/dev/null
+  done
+}
+
+__clt_preexec() {
+  __clt_set_state duration "start ${EPOCHREALTIME-}"
+}
+
+__clt_precmd() {
+  # Must come first: anything else run here overwrites $PIPESTATUS.
+  # bash-preexec saves it before running its hooks.
+  local pipe="${PIPESTATUS[*]}"
+  [[ -n ${BP_PIPESTATUS-} ]] && pipe="${BP_PIPESTATUS[*]}"
+
+  __clt_set_state exit_code "$pipe"
+  __clt_set_state duration "end ${EPOCHREALTIME-}"
+  if [[ "${VIRTUAL_ENV-}" != "$__clt_venv" ]]; then
+    __clt_venv="${VIRTUAL_ENV-}"
+    __clt_set_state venv "${__clt_venv##*/}"
+  fi
+
+  local location
+  for location in "${__clt_locations[@]}"; do
+    "$__clt_bin" start-update "$location" "$__clt_instance" "$PWD" 2>/dev/null
+  done
+  __clt_prompt="$("$__clt_bin" generate --columns "${COLUMNS:-0}" "$__clt_location" "$__clt_instance" "$PWD" 2>/dev/null)"
+}
+
+__clt_debug_trap() {
+  # The trap fires for every simple command, PROMPT_COMMAND's included; only
+  # the first one after PROMPT_COMMAND finished starts a user command.
+  # Pressing return on an empty line runs PROMPT_COMMAND straight away.
+  [[ $__clt_at_prompt == 1 && -z ${COMP_LINE-} ]] || return
+  __clt_at_prompt=0
+  [[ $BASH_COMMAND == __clt_precmd* ]] && return
+  __clt_preexec
+}
+
+if [[ -n ${bash_preexec_imported-} || -n ${__bp_imported-} ]]; then
+  preexec_functions+=(__clt_preexec)
+  precmd_functions=(__clt_precmd "${precmd_functions[@]}")
+else
+  if [[ -z $(trap -p DEBUG) ]]; then
+    trap '__clt_debug_trap' DEBUG
+  fi
+  # PROMPT_COMMAND can be an array since bash 5.1.
+  if [[ $(declare -p PROMPT_COMMAND 2>/dev/null) == "declare -a"* ]]; then
+    PROMPT_COMMAND=(__clt_precmd "${PROMPT_COMMAND[@]}" "__clt_at_prompt=1")
+  else
+    PROMPT_COMMAND="__clt_precmd;${PROMPT_COMMAND:+$PROMPT_COMMAND;}__clt_at_prompt=1"
+  fi
+fi
+
+# The generated prompt is spliced in by parameter expansion, whose result
+# isn't expanded again, so nothing in it can run as a command.
+shopt -s promptvars
+# Keeps $COLUMNS current, for generate --columns.
+shopt -s checkwinsize
+PS1='${__clt_prompt}'
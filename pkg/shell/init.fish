@@ -0,0 +1,63 @@
+# commandline_thing integration for fish: commandline_thing init fish | source
+# The prompt locations should use `dialect: fish`.
+
+set -g __clt_bin {{ .Executable }}
+set -g __clt_location {{ .Location }}
+set -g __clt_right_location {{ .RightLocation }}
+set -g __clt_locations {{ .Locations }}
+if set -q TMUX_PANE
+    set -g __clt_instance {{ .TmuxInstancePrefix }}"$TMUX_PANE"
+else
+    set -g __clt_instance {{ .ShellInstancePrefix }}"$fish_pid"
+end
+
+function __clt_set_state
+    for location in $__clt_locations
+        $__clt_bin set-state $location $__clt_instance $argv[1] $argv[2] 2>/dev/null
+    end
+end
+
+function __clt_preexec --on-event fish_preexec
+    __clt_set_state duration start
+end
+
+function __clt_postexec --on-event fish_postexec
+    # Must come first: anything else run here overwrites $pipestatus.
+    set -l pipe $pipestatus
+    __clt_set_state exit_code "$pipe"
+    __clt_set_state duration end
+end
+
+function __clt_venv --on-variable VIRTUAL_ENV
+    set -l name ''
+    set -q VIRTUAL_ENV; and set name (string replace -r '.*/' '' -- $VIRTUAL_ENV)
+    __clt_set_state venv "$name"
+end
+
+function __clt_vim_mode --on-variable fish_bind_mode
+    # fish calls normal mode "default"; visual and replace keep their names.
+    set -l mode $fish_bind_mode
+    test "$mode" = default; and set mode normal
+    __clt_set_state vim $mode
+    commandline -f repaint
+end
+
+function __clt_update --on-event fish_prompt
+    for location in $__clt_locations
+        $__clt_bin start-update $location $__clt_instance $PWD 2>/dev/null
+    end
+end
+
+function fish_prompt
+    $__clt_bin generate --columns $COLUMNS $__clt_location $__clt_instance $PWD 2>/dev/null
+end
+
+if test -n "$__clt_right_location"
+    function fish_right_prompt
+        $__clt_bin generate --columns $COLUMNS $__clt_right_location $__clt_instance $PWD 2>/dev/null
+    end
+end
+
+# Sync state this shell may have inherited from a previous one with the
+# same instance key.
+__clt_venv
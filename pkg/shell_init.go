@@ -0,0 +1,66 @@
+package pkg
+
+import (
+	"embed"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+//go:embed shell/init.*
+var shellInitScripts embed.FS
+
+// ShellInitOptions are the choices baked into a shell integration script.
+type ShellInitOptions struct {
+	// Executable is how the script invokes commandline_thing.
+	Executable string
+	// Location is rendered as the prompt, and RightLocation (zsh and fish
+	// only, optional) as the right prompt.
+	Location      LocationKey
+	RightLocation LocationKey
+}
+
+// ShellInitShells are the shells ShellInit has scripts for.
+var ShellInitShells = []string{"zsh", "bash", "fish"}
+
+// shellQuote single-quotes s so zsh, bash and fish all read it back as one
+// literal word.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// ShellInit returns the script that wires a shell up to commandline_thing:
+// hooks feeding exit_code, duration, venv and vim through set-state,
+// start-update before each prompt, and the prompt itself set to the output
+// of generate. Instances are keyed by tmux pane inside tmux and by the
+// shell's pid outside it (see TmuxInstanceKey and ShellInstanceKey).
+func ShellInit(shell string, options ShellInitOptions) (string, error) {
+	script, err := shellInitScripts.ReadFile("shell/init." + shell)
+	if err != nil {
+		return "", fmt.Errorf("unsupported shell %q, expected one of %s", shell, strings.Join(ShellInitShells, ", "))
+	}
+
+	tmpl, err := template.New(shell).Parse(string(script))
+	if err != nil {
+		return "", err
+	}
+
+	locations := []string{shellQuote(string(options.Location))}
+	if options.RightLocation != "" {
+		locations = append(locations, shellQuote(string(options.RightLocation)))
+	}
+
+	var out strings.Builder
+	err = tmpl.Execute(&out, map[string]string{
+		"Executable":          shellQuote(options.Executable),
+		"Location":            shellQuote(string(options.Location)),
+		"RightLocation":       shellQuote(string(options.RightLocation)),
+		"Locations":           strings.Join(locations, " "),
+		"TmuxInstancePrefix":  shellQuote(tmuxInstancePrefix),
+		"ShellInstancePrefix": shellQuote(shellInstancePrefix),
+	})
+	if err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
@@ -0,0 +1,68 @@
+package pkg
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestShellQuote(t *testing.T) {
+	require.Equal(t, `'plain'`, shellQuote("plain"))
+	require.Equal(t, `'it'\''s $HOME'`, shellQuote("it's $HOME"))
+}
+
+func TestShellInitBakesInOptions(t *testing.T) {
+	for _, shell := range ShellInitShells {
+		script, err := ShellInit(shell, ShellInitOptions{Executable: "/opt/clt bin/commandline_thing", Location: "prompt", RightLocation: "rprompt"})
+		require.NoError(t, err, shell)
+		require.Contains(t, script, `'/opt/clt bin/commandline_thing'`, shell)
+		require.Contains(t, script, `'prompt' 'rprompt'`, shell)
+		require.Contains(t, script, `'tmux.'"$TMUX_PANE"`, shell)
+	}
+
+	_, err := ShellInit("ksh", ShellInitOptions{Executable: "clt", Location: "prompt"})
+	require.ErrorContains(t, err, "unsupported shell")
+}
+
+// TestShellInitBashHooks drives an interactive bash through the generated
+// script with a fake commandline_thing that logs how it's called.
+func TestShellInitBashHooks(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash not installed")
+	}
+
+	dir := t.TempDir()
+	log := filepath.Join(dir, "calls.log")
+	fake := filepath.Join(dir, "fake")
+	require.NoError(t, os.WriteFile(fake, []byte(`#!/bin/sh
+echo "$@" >> `+log+`
+[ "$1" = generate ] && printf 'GEN$(touch `+filepath.Join(dir, "pwned")+`)> '
+exit 0
+`), 0755))
+
+	script, err := ShellInit("bash", ShellInitOptions{Executable: fake, Location: "prompt"})
+	require.NoError(t, err)
+	scriptPath := filepath.Join(dir, "init.bash")
+	require.NoError(t, os.WriteFile(scriptPath, []byte(script), 0644))
+
+	cmd := exec.Command("bash", "--norc", "--noprofile", "-i")
+	cmd.Stdin = strings.NewReader("source " + scriptPath + "\nfalse | true\n\nexit\n")
+	cmd.Env = append(os.Environ(), "TMUX_PANE=%7", "VIRTUAL_ENV=/envs/project", "COLUMNS=91")
+	output, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(output))
+	require.Contains(t, string(output), "GEN$(touch", "the prompt is shown verbatim")
+	require.NoFileExists(t, filepath.Join(dir, "pwned"), "the prompt must never be executed")
+
+	calls, err := os.ReadFile(log)
+	require.NoError(t, err)
+	require.Contains(t, string(calls), "set-state prompt tmux.%7 venv project\n")
+	require.Contains(t, string(calls), "set-state prompt tmux.%7 duration start")
+	require.Contains(t, string(calls), "set-state prompt tmux.%7 exit_code 1 0\n")
+	require.Contains(t, string(calls), "start-update prompt tmux.%7 ")
+	require.Contains(t, string(calls), "generate --columns 91 prompt tmux.%7 ")
+	require.Equal(t, 2, strings.Count(string(calls), "duration start"), "only false | true and exit are timed, not the empty line")
+}
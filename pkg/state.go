@@ -1,6 +1,7 @@
 package pkg
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 
@@ -10,9 +11,26 @@ import (
 type StateStore interface {
 	Get(locationKey LocationKey, instanceKey InstanceKey, operationName OperationName) (string, error)
 	Set(locationKey LocationKey, instanceKey InstanceKey, operationName OperationName, value string) error
+	// DeleteInstance forgets all state for an instance, in every location.
+	DeleteInstance(instanceKey InstanceKey) error
 	Close() error
 }
 
+type stateStoreContextKey struct{}
+
+// withStateStore hands the state store to operations that share state
+// between instances rather than keeping their own (see gitStatusCache),
+// without every operation's Generate having to take it.
+func withStateStore(ctx context.Context, store StateStore) context.Context {
+	return context.WithValue(ctx, stateStoreContextKey{}, store)
+}
+
+// stateStoreFrom returns the state store set by withStateStore, or nil.
+func stateStoreFrom(ctx context.Context) StateStore {
+	store, _ := ctx.Value(stateStoreContextKey{}).(StateStore)
+	return store
+}
+
 type SQLiteStateStore struct {
 	db *sql.DB
 }
@@ -68,6 +86,14 @@ func (s *SQLiteStateStore) Set(locationKey LocationKey, instanceKey InstanceKey,
 	return nil
 }
 
+func (s *SQLiteStateStore) DeleteInstance(instanceKey InstanceKey) error {
+	_, err := s.db.Exec("DELETE FROM state WHERE instance_key = ?", instanceKey)
+	if err != nil {
+		return fmt.Errorf("failed to delete state: %w", err)
+	}
+	return nil
+}
+
 func (s *SQLiteStateStore) Close() error {
 	return s.db.Close()
 }
@@ -0,0 +1,291 @@
+package pkg
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/template/parse"
+)
+
+// templateProblem is a field reference analyzeTemplate found can't work,
+// at Line of the template text.
+type templateProblem struct {
+	Line    int
+	Message string
+}
+
+func (p templateProblem) Error() string {
+	return fmt.Sprintf("template: content:%d: %s", p.Line, p.Message)
+}
+
+// templateDot is what dot (or a variable) holds at some point of a template:
+// the render data itself, a value of a known type, or something unknown
+// (nil typ), past which nothing is checked.
+type templateDot struct {
+	root bool
+	typ  reflect.Type
+}
+
+// templateAnalyzer follows field references through a parsed template,
+// tracking dot and variables through with, range and assignments.
+type templateAnalyzer struct {
+	tree *parse.Tree
+	// operations maps each operation the template can refer to to its
+	// result type, which is nil if unknown (see ResultTyper).
+	operations map[string]reflect.Type
+	problems   []templateProblem
+}
+
+// analyzeTemplate checks every field the template reads from the render
+// data: that the operation exists, and that fields and methods read from
+// its result exist on its result type.
+func analyzeTemplate(tree *parse.Tree, operations map[string]reflect.Type) []templateProblem {
+	a := &templateAnalyzer{tree: tree, operations: operations}
+	if tree != nil && tree.Root != nil {
+		a.list(tree.Root, templateDot{root: true}, map[string]templateDot{"$": {root: true}})
+	}
+	return a.problems
+}
+
+// operationResultTypes maps a location's operations to their result types.
+func operationResultTypes(operations []OperationWrapper) map[string]reflect.Type {
+	types := make(map[string]reflect.Type, len(operations))
+	for _, opWrapper := range operations {
+		var typ reflect.Type
+		if typer, ok := opWrapper.Operation.(ResultTyper); ok {
+			typ = typer.ResultType()
+		}
+		types[string(opWrapper.Operation.Name())] = typ
+	}
+	return types
+}
+
+func (a *templateAnalyzer) report(node parse.Node, format string, args ...interface{}) {
+	problem := templateProblem{Message: fmt.Sprintf(format, args...)}
+	// ErrorContext gives "content:line:column".
+	location, _ := a.tree.ErrorContext(node)
+	if parts := strings.Split(location, ":"); len(parts) >= 3 {
+		problem.Line, _ = strconv.Atoi(parts[len(parts)-2])
+	}
+	a.problems = append(a.problems, problem)
+}
+
+func copyVariables(variables map[string]templateDot) map[string]templateDot {
+	copied := make(map[string]templateDot, len(variables))
+	for name, dot := range variables {
+		copied[name] = dot
+	}
+	return copied
+}
+
+func (a *templateAnalyzer) list(list *parse.ListNode, dot templateDot, variables map[string]templateDot) {
+	if list == nil {
+		return
+	}
+	for _, node := range list.Nodes {
+		switch n := node.(type) {
+		case *parse.ActionNode:
+			a.pipe(n.Pipe, dot, variables)
+		case *parse.IfNode:
+			a.branch(&n.BranchNode, dot, variables, false)
+		case *parse.WithNode:
+			a.branch(&n.BranchNode, dot, variables, false)
+		case *parse.RangeNode:
+			a.branch(&n.BranchNode, dot, variables, true)
+		case *parse.TemplateNode:
+			a.pipe(n.Pipe, dot, variables)
+		}
+	}
+}
+
+// branch handles if, with and range. with and range rebind dot in their
+// body, but not in their else; variables declared inside go out of scope
+// at the end.
+func (a *templateAnalyzer) branch(n *parse.BranchNode, dot templateDot, variables map[string]templateDot, isRange bool) {
+	inner := copyVariables(variables)
+	value := a.pipe(n.Pipe, dot, inner)
+
+	bodyDot := dot
+	switch {
+	case isRange:
+		bodyDot = templateDot{typ: rangeElem(value.typ)}
+		if n.Pipe != nil && len(n.Pipe.Decl) > 0 {
+			// {{ range $i, $e := ... }}: only the element is known.
+			for _, decl := range n.Pipe.Decl {
+				inner[decl.Ident[0]] = templateDot{}
+			}
+			inner[n.Pipe.Decl[len(n.Pipe.Decl)-1].Ident[0]] = bodyDot
+		}
+	case n.NodeType == parse.NodeWith:
+		bodyDot = value
+	}
+	a.list(n.List, bodyDot, inner)
+	a.list(n.ElseList, dot, copyVariables(variables))
+}
+
+// rangeElem is the type range yields for a value of type t.
+func rangeElem(t reflect.Type) reflect.Type {
+	if t == nil {
+		return nil
+	}
+	switch t.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map, reflect.Chan:
+		return t.Elem()
+	case reflect.Int:
+		return t
+	}
+	return nil
+}
+
+// pipe analyzes a pipeline and returns what it evaluates to.
+func (a *templateAnalyzer) pipe(pipe *parse.PipeNode, dot templateDot, variables map[string]templateDot) templateDot {
+	if pipe == nil {
+		return templateDot{}
+	}
+	var value templateDot
+	for i, cmd := range pipe.Cmds {
+		value = a.command(cmd, dot, variables)
+		if i > 0 {
+			// The previous value is passed on as the last argument of a
+			// function, whose result isn't known.
+			value = templateDot{}
+		}
+	}
+	for _, decl := range pipe.Decl {
+		if pipe.IsAssign {
+			if _, ok := variables[decl.Ident[0]]; ok {
+				variables[decl.Ident[0]] = templateDot{}
+			}
+			continue
+		}
+		variables[decl.Ident[0]] = value
+	}
+	return value
+}
+
+func (a *templateAnalyzer) command(cmd *parse.CommandNode, dot templateDot, variables map[string]templateDot) templateDot {
+	var value templateDot
+	for i, arg := range cmd.Args {
+		argValue := a.arg(arg, dot, variables)
+		if i == 0 {
+			value = argValue
+		}
+	}
+	if len(cmd.Args) > 1 {
+		// A function call, or a method called with arguments.
+		return templateDot{}
+	}
+	return value
+}
+
+func (a *templateAnalyzer) arg(arg parse.Node, dot templateDot, variables map[string]templateDot) templateDot {
+	switch n := arg.(type) {
+	case *parse.DotNode:
+		return dot
+	case *parse.FieldNode:
+		return a.fields(n, dot, n.Ident)
+	case *parse.VariableNode:
+		variable, ok := variables[n.Ident[0]]
+		if !ok {
+			return templateDot{}
+		}
+		return a.fields(n, variable, n.Ident[1:])
+	case *parse.ChainNode:
+		var value templateDot
+		if pipe, ok := n.Node.(*parse.PipeNode); ok {
+			value = a.pipe(pipe, dot, variables)
+		} else {
+			value = a.arg(n.Node, dot, variables)
+		}
+		return a.fields(n, value, n.Field)
+	case *parse.PipeNode:
+		return a.pipe(n, dot, variables)
+	}
+	return templateDot{}
+}
+
+// fields follows idents from value, reporting the first one that can't be
+// read.
+func (a *templateAnalyzer) fields(node parse.Node, value templateDot, idents []string) templateDot {
+	if len(idents) == 0 {
+		return value
+	}
+	if value.root {
+		name := idents[0]
+		if name == ErrorsTemplateKey {
+			if len(idents) > 1 {
+				if _, ok := a.operations[idents[1]]; !ok {
+					a.report(node, "refers to %s, but %s isn't an operation in this location", node, idents[1])
+				}
+			}
+			return templateDot{}
+		}
+		if name == ColumnsTemplateKey {
+			return a.fields(node, templateDot{typ: reflect.TypeOf(0)}, idents[1:])
+		}
+		typ, ok := a.operations[name]
+		if !ok {
+			a.report(node, "refers to %s, which isn't an operation in this location", node)
+			return templateDot{}
+		}
+		return a.fields(node, templateDot{typ: typ}, idents[1:])
+	}
+
+	typ := value.typ
+	for _, ident := range idents {
+		if typ == nil {
+			return templateDot{}
+		}
+		next, ok := fieldType(typ, ident)
+		if !ok {
+			a.report(node, "refers to %s, but %s has no field or method %s", node, typ, ident)
+			return templateDot{}
+		}
+		typ = next
+	}
+	return templateDot{typ: typ}
+}
+
+// fieldType is the type of reading .name from a value of type t the way
+// text/template does, or nil if that can't be known (interfaces, and
+// methods returning them).
+func fieldType(t reflect.Type, name string) (reflect.Type, bool) {
+	if t.Kind() == reflect.Interface {
+		return nil, true
+	}
+	method, ok := t.MethodByName(name)
+	if !ok && t.Kind() != reflect.Pointer {
+		method, ok = reflect.PointerTo(t).MethodByName(name)
+	}
+	if ok {
+		if method.Type.NumOut() == 0 || method.Type.Out(0).Kind() == reflect.Interface {
+			return nil, true
+		}
+		return method.Type.Out(0), true
+	}
+
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Map:
+		if t.Key().Kind() != reflect.String {
+			return nil, false
+		}
+		if t.Elem().Kind() == reflect.Interface {
+			return nil, true
+		}
+		return t.Elem(), true
+	case reflect.Struct:
+		field, ok := t.FieldByName(name)
+		if !ok || !field.IsExported() {
+			return nil, false
+		}
+		if field.Type.Kind() == reflect.Interface {
+			return nil, true
+		}
+		return field.Type, true
+	}
+	return nil, false
+}
@@ -0,0 +1,80 @@
+package pkg
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"text/template"
+
+	"github.com/stretchr/testify/require"
+)
+
+func analyzeTemplateString(t *testing.T, text string) []string {
+	t.Helper()
+	tmpl, err := template.New("content").Funcs(DialectPlain.FuncMap()).Parse(text)
+	require.NoError(t, err)
+	operations := map[string]reflect.Type{
+		"git":     reflect.TypeOf(GitResult{}),
+		"host":    reflect.TypeOf(HostDetailsResult{}),
+		"meme":    reflect.TypeOf(map[string]string{}),
+		"lines":   reflect.TypeOf([]string{}),
+		"plugin":  nil,
+		"pointer": reflect.TypeOf(&KubeResult{}),
+	}
+	var out []string
+	for _, problem := range analyzeTemplate(tmpl.Tree, operations) {
+		out = append(out, problem.Error())
+	}
+	return out
+}
+
+func TestAnalyzeTemplateAcceptsValidReferences(t *testing.T) {
+	require.Empty(t, analyzeTemplateString(t, `{{ .git.Branch }}{{ .pointer.String }}{{ .host.IsSSH }}
+{{ with .git }}{{ .ShortCommit }}{{ else }}{{ .host.User }}{{ end }}
+{{ range $i, $line := .lines }}{{ $i }}{{ $line }}{{ $.git.Stashes }}{{ end }}
+{{ $h := .host }}{{ $h.Hostname }}{{ .meme.anything }}{{ .plugin.whatever.deep }}
+{{ .pointer.Namespace }}{{ if .errors.git }}{{ .errors.git.Error }}{{ end }}
+{{ index .meme "doge-2" }}{{ (.git).Branch }}{{ if gt .columns 80 }}{{ end }}`))
+}
+
+func TestAnalyzeTemplateReportsBadReferences(t *testing.T) {
+	require.Equal(t, []string{
+		`template: content:1: refers to .gti.Branch, which isn't an operation in this location`,
+		`template: content:1: refers to .git.Brnch, but pkg.GitResult has no field or method Brnch`,
+		`template: content:2: refers to .Hostnam, but pkg.HostDetailsResult has no field or method Hostnam`,
+		`template: content:2: refers to $.nope, which isn't an operation in this location`,
+		`template: content:3: refers to $h.Nope, but pkg.HostDetailsResult has no field or method Nope`,
+		`template: content:3: refers to .errors.kube, but kube isn't an operation in this location`,
+		`template: content:4: refers to .git.Stashes.Count, but int has no field or method Count`,
+		`template: content:4: refers to .Len, but string has no field or method Len`,
+	}, analyzeTemplateString(t, `{{ .gti.Branch }} {{ .git.Brnch }}
+{{ with .host }}{{ .Hostnam }}{{ .IsSSH }}{{ end }}{{ $.nope }}
+{{ $h := .host }}{{ $h.Nope }}{{ .errors.kube }}
+{{ if .git.Stashes.Count }}{{ end }}{{ range .lines }}{{ .Len }}{{ end }}`))
+}
+
+func TestStrictTemplate(t *testing.T) {
+	config := Location{
+		Strict:     true,
+		Operations: []OperationWrapper{{Operation: &MockOperation2{Baz: "bar"}}},
+		Template:   "{{ .test2.baz }}{{ .tset }}",
+	}
+	_, err := CompileTemplate(config)
+	require.ErrorContains(t, err, "refers to .tset, which isn't an operation in this location")
+
+	config.Template = "{{ .test2.baz }}{{ .errors.test2 }}"
+	content, err := GenerateContent(context.Background(), NewMemoryStateStore(), config, "pane", testTmuxInstance, "/tmp", 0, nil)
+	require.NoError(t, err)
+	require.Equal(t, "bar<nil>", content)
+
+	// Map results can't be checked up front, but a missing key still fails
+	// the render rather than printing "<no value>".
+	config.Template = "{{ .test2.nope }}"
+	_, err = GenerateContent(context.Background(), NewMemoryStateStore(), config, "pane", testTmuxInstance, "/tmp", 0, nil)
+	require.ErrorContains(t, err, `map has no entry for key "nope"`)
+
+	config.Strict = false
+	content, err = GenerateContent(context.Background(), NewMemoryStateStore(), config, "pane", testTmuxInstance, "/tmp", 0, nil)
+	require.NoError(t, err)
+	require.Equal(t, "<no value>", content)
+}
@@ -0,0 +1,84 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// DefaultOperationTimeout applies to operations whose YAML entry doesn't set
+// `timeout`.
+const DefaultOperationTimeout = 5 * time.Second
+
+// ErrOperationTimeout is wrapped by the error returned for an operation that
+// didn't finish within its timeout.
+var ErrOperationTimeout = errors.New("operation timed out")
+
+// parseTimeout accepts a Go duration string ("750ms", "2s") or a plain number
+// of seconds.
+func parseTimeout(raw interface{}) (time.Duration, error) {
+	timeout, err := parseDuration("timeout", raw)
+	if err != nil {
+		return 0, err
+	}
+	if timeout <= 0 {
+		return 0, fmt.Errorf("timeout must be positive")
+	}
+	return timeout, nil
+}
+
+// parseDuration accepts a Go duration string or a plain number of seconds
+// for the config field called name.
+func parseDuration(name string, raw interface{}) (time.Duration, error) {
+	switch v := raw.(type) {
+	case string:
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s %q: %w", name, v, err)
+		}
+		return d, nil
+	case int:
+		return time.Duration(v) * time.Second, nil
+	case float64:
+		return time.Duration(v * float64(time.Second)), nil
+	default:
+		return 0, fmt.Errorf("%s must be a duration string like \"500ms\" or a number of seconds", name)
+	}
+}
+
+// runWithTimeout calls fn with a context that expires after timeout. fn should
+// honour the context (e.g. via exec.CommandContext), but if it doesn't,
+// runWithTimeout still returns on time and leaves fn to finish in the
+// background, discarding its result.
+func runWithTimeout[T any](ctx context.Context, timeout time.Duration, fn func(context.Context) (T, error)) (T, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	type result struct {
+		value T
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		value, err := fn(ctx)
+		done <- result{value, err}
+	}()
+
+	var zero T
+	select {
+	case r := <-done:
+		// An operation that honoured the context fails with whatever its
+		// cancellation looks like (e.g. "signal: killed"); report it as the
+		// timeout it really is.
+		if r.err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return zero, fmt.Errorf("%w after %s", ErrOperationTimeout, timeout)
+		}
+		return r.value, r.err
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return zero, fmt.Errorf("%w after %s", ErrOperationTimeout, timeout)
+		}
+		return zero, ctx.Err()
+	}
+}
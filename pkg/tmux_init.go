@@ -0,0 +1,113 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// TmuxInitOptions are the choices baked into the tmux integration.
+type TmuxInitOptions struct {
+	// Executable is how tmux invokes commandline_thing.
+	Executable string
+	// StatusLocation is rendered as a second status line and PaneLocation
+	// as every pane's border. Either may be empty to leave it alone.
+	StatusLocation LocationKey
+	PaneLocation   LocationKey
+}
+
+// tmuxHookIndex is the slot our hooks use in each hook array, so installing
+// twice replaces rather than duplicates them and other hooks are left be.
+const tmuxHookIndex = 42
+
+// tmuxSetting is one global tmux option or hook.
+type tmuxSetting struct {
+	hook  bool
+	name  string
+	value string
+}
+
+// tmuxSettings lists what the integration sets. Instances are keyed by
+// pane (see TmuxInstanceKey); the status line's pane is the active one.
+// Each location is told how wide it can be: the client's width for the
+// status line and the pane's for its border.
+func tmuxSettings(options TmuxInitOptions) []tmuxSetting {
+	executable := shellQuote(options.Executable)
+	instance := shellQuote(string(TmuxInstanceKey("#{pane_id}")))
+	path := "#{q:pane_current_path}"
+	generate := func(location LocationKey, width string) string {
+		return fmt.Sprintf("#(%s generate --columns %s %s %s %s)", executable, width, shellQuote(string(location)), instance, path)
+	}
+
+	var settings []tmuxSetting
+	var updates []string
+	if options.StatusLocation != "" {
+		settings = append(settings,
+			tmuxSetting{name: "status", value: "2"},
+			tmuxSetting{name: "status-format[1]", value: generate(options.StatusLocation, "#{client_width}")},
+		)
+		updates = append(updates, string(options.StatusLocation))
+	}
+	if options.PaneLocation != "" {
+		settings = append(settings,
+			tmuxSetting{name: "pane-border-status", value: "top"},
+			tmuxSetting{name: "pane-border-format", value: generate(options.PaneLocation, "#{pane_width}")},
+		)
+		updates = append(updates, string(options.PaneLocation))
+	}
+
+	var startUpdates []string
+	for _, location := range updates {
+		startUpdates = append(startUpdates, fmt.Sprintf("%s start-update %s %s %s", executable, shellQuote(location), instance, path))
+	}
+	if len(startUpdates) > 0 {
+		update := "run-shell -b " + tmuxQuote(strings.Join(startUpdates, "; "))
+		settings = append(settings,
+			tmuxSetting{name: "focus-events", value: "on"},
+			tmuxSetting{hook: true, name: fmt.Sprintf("pane-focus-in[%d]", tmuxHookIndex), value: update},
+			tmuxSetting{hook: true, name: fmt.Sprintf("after-select-pane[%d]", tmuxHookIndex), value: update},
+		)
+	}
+
+	clear := fmt.Sprintf("%s clear-state %s", executable, shellQuote(string(TmuxInstanceKey("#{hook_pane}"))))
+	settings = append(settings, tmuxSetting{hook: true, name: fmt.Sprintf("pane-exited[%d]", tmuxHookIndex), value: "run-shell -b " + tmuxQuote(clear)})
+	return settings
+}
+
+// tmuxQuote double-quotes s as a tmux command argument, where $ and ~
+// would otherwise be expanded.
+func tmuxQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`, `~`, `\~`).Replace(s) + `"`
+}
+
+// TmuxInit returns tmux config lines wiring the status line, pane borders
+// and pane hooks up to commandline_thing, for source-file or tmux.conf.
+func TmuxInit(options TmuxInitOptions) string {
+	var out strings.Builder
+	out.WriteString("# commandline_thing integration for tmux: source-file it from tmux.conf,\n")
+	out.WriteString("# or apply it to the running server with `commandline_thing install tmux`.\n")
+	for _, setting := range tmuxSettings(options) {
+		command := "set-option"
+		if setting.hook {
+			command = "set-hook"
+		}
+		fmt.Fprintf(&out, "%s -g %s %s\n", command, setting.name, tmuxQuote(setting.value))
+	}
+	return out.String()
+}
+
+// InstallTmux applies the integration to the running tmux server.
+func InstallTmux(ctx context.Context, options TmuxInitOptions) error {
+	for _, setting := range tmuxSettings(options) {
+		command := "set-option"
+		if setting.hook {
+			command = "set-hook"
+		}
+		output, err := exec.CommandContext(ctx, "tmux", command, "-g", setting.name, setting.value).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("tmux %s %s: %w: %s", command, setting.name, err, strings.TrimSpace(string(output)))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package pkg
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTmuxInit(t *testing.T) {
+	config := TmuxInit(TmuxInitOptions{Executable: "/opt/$clt/commandline_thing", StatusLocation: "status", PaneLocation: "pane"})
+	require.Contains(t, config, `set-option -g pane-border-format "#('/opt/\$clt/commandline_thing' generate --columns #{pane_width} 'pane' 'tmux.#{pane_id}' #{q:pane_current_path})"`)
+	require.Contains(t, config, `set-option -g status-format[1] `)
+	require.Contains(t, config, `set-hook -g pane-focus-in[42] "run-shell -b \"'/opt/\\\$clt/commandline_thing' start-update 'status'`)
+	require.Contains(t, config, `set-hook -g pane-exited[42] `)
+	require.Contains(t, config, `clear-state 'tmux.#{hook_pane}'`)
+
+	config = TmuxInit(TmuxInitOptions{Executable: "clt"})
+	require.NotContains(t, config, "status-format")
+	require.NotContains(t, config, "pane-focus-in", "with nothing rendered there's nothing to update")
+	require.Contains(t, config, "pane-exited", "state is still cleaned up")
+}
+
+// TestInstallTmux applies the integration to a private tmux server and
+// checks tmux read it back the same as the generated config.
+func TestInstallTmux(t *testing.T) {
+	if _, err := exec.LookPath("tmux"); err != nil {
+		t.Skip("tmux not installed")
+	}
+	t.Setenv("TMUX_TMPDIR", t.TempDir())
+	t.Setenv("TMUX", "")
+	tmux := func(args ...string) string {
+		t.Helper()
+		output, err := exec.Command("tmux", args...).CombinedOutput()
+		require.NoError(t, err, string(output))
+		return string(output)
+	}
+	tmux("-f", os.DevNull, "new-session", "-d", "-s", "test")
+	t.Cleanup(func() { exec.Command("tmux", "kill-server").Run() })
+
+	options := TmuxInitOptions{Executable: "/opt/clt bin/commandline_thing", StatusLocation: "status", PaneLocation: "pane"}
+	require.NoError(t, InstallTmux(context.Background(), options))
+	installed := tmux("show-options", "-gv", "pane-border-format")
+	hooks := tmux("show-hooks", "-gw")
+
+	// Installing twice replaces our hooks rather than adding more.
+	require.NoError(t, InstallTmux(context.Background(), options))
+	require.Equal(t, hooks, tmux("show-hooks", "-gw"))
+	require.Equal(t, 1, strings.Count(hooks, "pane-exited["))
+
+	configPath := t.TempDir() + "/clt.tmux"
+	require.NoError(t, os.WriteFile(configPath, []byte(TmuxInit(options)), 0644))
+	tmux("set-option", "-gu", "pane-border-format")
+	tmux("source-file", configPath)
+	require.Equal(t, installed, tmux("show-options", "-gv", "pane-border-format"), "init and install set the same thing")
+	require.Contains(t, installed, "'tmux.#{pane_id}'")
+}
@@ -7,6 +7,7 @@ package pkg
 type LocationKey string
 
 // The specific instance of a location we are generating/updating/storing for, usually a specific tmux window or pane.
+// See ParseInstanceKey for the format.
 type InstanceKey string
 
 // Name of the operation e.g. "branch", "git", etc
@@ -1,25 +1,184 @@
 package pkg
 
-import "fmt"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
 
-func Update(stateStore StateStore, config Location, locationKey LocationKey, instanceKey InstanceKey, locationPath string) error {
-	for _, opWrapper := range config.Operations {
+// Update runs every operation's Update() in a location concurrently, each
+// bounded by its timeout, and writes back any state that changed. State
+// that was set (see SetState) while the operations ran is left alone. Async
+// operations are also generated here and their results cached for
+// GenerateContent to render.
+//
+// A failing operation keeps its previous state and doesn't stop the others;
+// every failure is reported in the returned error (see errors.Join).
+func Update(ctx context.Context, stateStore StateStore, config Location, locationKey LocationKey, instance Instance, locationPath string) error {
+	ctx = withStateStore(ctx, stateStore)
+	ctx = withInstance(ctx, instance)
+	var updateErrors []error
+
+	// Reads and writes against the state store stay sequential; only the
+	// operations themselves run concurrently.
+	operationStates := make([]string, len(config.Operations))
+	skip := make([]bool, len(config.Operations))
+	for i, opWrapper := range config.Operations {
+		op := opWrapper.Operation
+		operationState, err := stateStore.Get(locationKey, instance.Key, op.Name())
+		if err != nil {
+			updateErrors = append(updateErrors, fmt.Errorf("error getting state for operation %s: %w", op.Name(), err))
+			skip[i] = true
+			continue
+		}
+		operationStates[i] = operationState
+	}
+
+	type updateResult struct {
+		nextState string
+		cached    *cachedResult
+	}
+
+	results := make([]updateResult, len(config.Operations))
+	errs := make([]error, len(config.Operations))
+	var wg sync.WaitGroup
+	for i, opWrapper := range config.Operations {
+		if skip[i] {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, opWrapper OperationWrapper) {
+			defer wg.Done()
+			results[i], errs[i] = runWithTimeout(ctx, opWrapper.timeout(), func(ctx context.Context) (updateResult, error) {
+				op := opWrapper.Operation
+				nextState, err := op.Update(ctx, locationPath, operationStates[i])
+				if err != nil {
+					return updateResult{}, err
+				}
+				if !op.IsAsync() {
+					return updateResult{nextState: nextState}, nil
+				}
+
+				// Async operations are only ever generated here; renders
+				// pick the result up from the cache (see GenerateContent).
+				// A failure is cached too, so renders can show it as
+				// {{ .errors.<name> }}.
+				result, err := op.Generate(ctx, locationKey, instance, locationPath, nextState)
+				cached := &cachedResult{Value: result, GeneratedAt: time.Now()}
+				if err != nil {
+					cached.Value = nil
+					cached.Error = err.Error()
+					err = fmt.Errorf("error generating data: %w", err)
+				}
+				return updateResult{nextState: nextState, cached: cached}, err
+			})
+		}(i, opWrapper)
+	}
+	wg.Wait()
+
+	for i, opWrapper := range config.Operations {
 		op := opWrapper.Operation
 		operationName := op.Name()
-		operationState, err := stateStore.Get(locationKey, instanceKey, operationName)
+		if skip[i] {
+			continue
+		}
+		if errs[i] != nil {
+			updateErrors = append(updateErrors, fmt.Errorf("error updating operation %s: %w", op.Name(), errs[i]))
+		}
+
+		if results[i].cached != nil {
+			err := storeCachedResult(stateStore, locationKey, instance.Key, operationName, *results[i].cached)
+			if err != nil {
+				updateErrors = append(updateErrors, fmt.Errorf("error caching result for operation %s: %w", op.Name(), err))
+			}
+		}
+		if errs[i] != nil || results[i].nextState == operationStates[i] {
+			continue
+		}
+
+		// The operations may have taken a while (up to their timeouts), and
+		// a set-state that arrived in the meantime wins over what Update()
+		// computed from the state before it.
+		current, err := stateStore.Get(locationKey, instance.Key, operationName)
 		if err != nil {
-			return fmt.Errorf("error getting state for operation %s: %w", op.Name(), err)
+			updateErrors = append(updateErrors, fmt.Errorf("error getting state for operation %s: %w", op.Name(), err))
+			continue
 		}
-		nextState, err := op.Update(locationPath, operationState)
+		if current != operationStates[i] {
+			continue
+		}
+		err = stateStore.Set(locationKey, instance.Key, operationName, results[i].nextState)
 		if err != nil {
-			return fmt.Errorf("error generating data for operation %s: %w", op.Name(), err)
+			updateErrors = append(updateErrors, fmt.Errorf("error setting state for operation %s: %w", op.Name(), err))
+		}
+	}
+
+	return errors.Join(updateErrors...)
+}
+
+// RefreshAsync is Update restricted to a location's async operations: it
+// recomputes their cached results without advancing any other operation's
+// state, which is what a render asking for fresher results (see
+// GenerateContent) wants. changed reports whether any cached value or error
+// differs from before, i.e. whether post commands have anything to redraw.
+func RefreshAsync(ctx context.Context, stateStore StateStore, config Location, locationKey LocationKey, instance Instance, locationPath string) (changed bool, err error) {
+	asyncConfig := config
+	asyncConfig.Operations = nil
+	for _, opWrapper := range config.Operations {
+		if opWrapper.Operation.IsAsync() {
+			asyncConfig.Operations = append(asyncConfig.Operations, opWrapper)
 		}
+	}
 
-		err = stateStore.Set(locationKey, instanceKey, operationName, nextState)
+	before := make([]*cachedResult, len(asyncConfig.Operations))
+	for i, opWrapper := range asyncConfig.Operations {
+		// An unreadable entry counts as missing, so anything cached in its
+		// place is a change.
+		before[i], _ = loadCachedResult(stateStore, locationKey, instance.Key, opWrapper.Operation)
+	}
+
+	err = Update(ctx, stateStore, asyncConfig, locationKey, instance, locationPath)
+
+	for i, opWrapper := range asyncConfig.Operations {
+		after, _ := loadCachedResult(stateStore, locationKey, instance.Key, opWrapper.Operation)
+		if !sameCachedResult(before[i], after) {
+			changed = true
+		}
+	}
+	return changed, err
+}
+
+func sameCachedResult(a, b *cachedResult) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Error == b.Error && reflect.DeepEqual(a.Value, b.Value)
+}
+
+// SetState stores value as an operation's state. If the operation is a
+// StateReducer, value is instead folded into its current state. An operation
+// name that isn't in the location's config is stored as is, so state can be
+// seeded before the config that uses it.
+func SetState(stateStore StateStore, config Location, locationKey LocationKey, instanceKey InstanceKey, operationName OperationName, value string) error {
+	for _, opWrapper := range config.Operations {
+		reducer, ok := opWrapper.Operation.(StateReducer)
+		if !ok || opWrapper.Operation.Name() != operationName {
+			continue
+		}
+
+		state, err := stateStore.Get(locationKey, instanceKey, operationName)
+		if err != nil {
+			return fmt.Errorf("error getting state for operation %s: %w", operationName, err)
+		}
+		value, err = reducer.ReduceState(state, value)
 		if err != nil {
-			return fmt.Errorf("error setting state for operation %s: %w", op.Name(), err)
+			return fmt.Errorf("error reducing state for operation %s: %w", operationName, err)
 		}
+		break
 	}
 
-	return nil
+	return stateStore.Set(locationKey, instanceKey, operationName, value)
 }
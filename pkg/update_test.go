@@ -1,6 +1,8 @@
 package pkg
 
 import (
+	"context"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -15,8 +17,8 @@ import (
 // for that location.
 func TestUpdatePreservesOtherOperationsStateAlongsideCycle(t *testing.T) {
 	store := NewMemoryStateStore()
-	require.NoError(t, store.Set("prompt", "12345", "exit_code", "1"))
-	require.NoError(t, store.Set("prompt", "12345", "vim", "1"))
+	require.NoError(t, store.Set("prompt", testShellInstance.Key, "exit_code", "1"))
+	require.NoError(t, store.Set("prompt", testShellInstance.Key, "vim", "1"))
 
 	config := Location{
 		Operations: []OperationWrapper{
@@ -26,17 +28,17 @@ func TestUpdatePreservesOtherOperationsStateAlongsideCycle(t *testing.T) {
 		},
 	}
 
-	require.NoError(t, Update(store, config, "prompt", "12345", "/tmp"))
+	require.NoError(t, Update(context.Background(), store, config, "prompt", testShellInstance, "/tmp"))
 
-	exitCode, err := store.Get("prompt", "12345", "exit_code")
+	exitCode, err := store.Get("prompt", testShellInstance.Key, "exit_code")
 	require.NoError(t, err)
 	require.Equal(t, "1", exitCode, "exit_code state must survive an Update() call for an unrelated operation")
 
-	vim, err := store.Get("prompt", "12345", "vim")
+	vim, err := store.Get("prompt", testShellInstance.Key, "vim")
 	require.NoError(t, err)
 	require.Equal(t, "1", vim, "vim state must survive an Update() call for an unrelated operation")
 
-	nyan, err := store.Get("prompt", "12345", "nyan")
+	nyan, err := store.Get("prompt", testShellInstance.Key, "nyan")
 	require.NoError(t, err)
 	require.Equal(t, "1", nyan, "cycle's own state must advance")
 }
@@ -54,3 +56,145 @@ func mustConfiguredCycle(t *testing.T, name string, names ...string) *Cycle {
 	}))
 	return c
 }
+
+func TestUpdateContinuesPastFailingOperation(t *testing.T) {
+	store := NewMemoryStateStore()
+	require.NoError(t, store.Set("prompt", testShellInstance.Key, "broken", "previous"))
+
+	config := Location{
+		Operations: []OperationWrapper{
+			{Operation: &MockFailingOperation{}},
+			{Operation: mustConfiguredCycle(t, "nyan", "nyan1", "nyan2")},
+			{Operation: &MockFailingOperation{}},
+		},
+	}
+
+	err := Update(context.Background(), store, config, "prompt", testShellInstance, "/tmp")
+	require.Error(t, err)
+	require.Equal(t, 2, strings.Count(err.Error(), "update boom"), "every failure is reported")
+
+	nyan, err := store.Get("prompt", testShellInstance.Key, "nyan")
+	require.NoError(t, err)
+	require.Equal(t, "1", nyan, "operations after a failing one still update")
+
+	broken, err := store.Get("prompt", testShellInstance.Key, "broken")
+	require.NoError(t, err)
+	require.Equal(t, "previous", broken, "a failing operation keeps its previous state")
+}
+
+func TestSetStateReducesThroughOperation(t *testing.T) {
+	store := NewMemoryStateStore()
+	config := Location{Operations: []OperationWrapper{{Operation: &Duration{}}, {Operation: &ExitCode{}}}}
+
+	require.NoError(t, SetState(store, config, "prompt", testShellInstance.Key, "duration", "start 1700000000.250"))
+	require.NoError(t, SetState(store, config, "prompt", testShellInstance.Key, "duration", "end 1700000003.500"))
+	duration, err := store.Get("prompt", testShellInstance.Key, "duration")
+	require.NoError(t, err)
+	require.Equal(t, "1700000000250 1700000003500", duration)
+
+	require.NoError(t, SetState(store, config, "prompt", testShellInstance.Key, "exit_code", "130"))
+	exitCode, err := store.Get("prompt", testShellInstance.Key, "exit_code")
+	require.NoError(t, err)
+	require.Equal(t, "130", exitCode, "operations that aren't reducers store the value as is")
+
+	require.Error(t, SetState(store, config, "prompt", testShellInstance.Key, "duration", "bogus"))
+}
+
+// MockBlockingOperation's Update() waits to be released, like git running
+// up to its timeout, and bumps its state when it's done.
+type MockBlockingOperation struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (m *MockBlockingOperation) Generate(ctx context.Context, locationKey LocationKey, instance Instance, locationPath string, state string) (interface{}, error) {
+	return state, nil
+}
+
+func (m *MockBlockingOperation) Name() OperationName {
+	return "blocking"
+}
+
+func (m *MockBlockingOperation) IsAsync() bool {
+	return false
+}
+
+func (m *MockBlockingOperation) Update(_ context.Context, _ string, state string) (string, error) {
+	close(m.started)
+	<-m.release
+	return state + "+", nil
+}
+
+func TestUpdateKeepsStateSetWhileOperationsRun(t *testing.T) {
+	store := NewMemoryStateStore()
+	require.NoError(t, store.Set("prompt", testShellInstance.Key, "exit_code", "0"))
+	require.NoError(t, store.Set("prompt", testShellInstance.Key, "blocking", "old"))
+
+	blocking := &MockBlockingOperation{started: make(chan struct{}), release: make(chan struct{})}
+	config := Location{
+		Operations: []OperationWrapper{{Operation: &ExitCode{}}, {Operation: blocking}},
+	}
+
+	done := make(chan error)
+	go func() { done <- Update(context.Background(), store, config, "prompt", testShellInstance, "/tmp") }()
+
+	<-blocking.started
+	require.NoError(t, SetState(store, config, "prompt", testShellInstance.Key, "exit_code", "1"))
+	require.NoError(t, SetState(store, config, "prompt", testShellInstance.Key, "blocking", "new"))
+	close(blocking.release)
+	require.NoError(t, <-done)
+
+	exitCode, err := store.Get("prompt", testShellInstance.Key, "exit_code")
+	require.NoError(t, err)
+	require.Equal(t, "1", exitCode, "an unchanged state isn't written back over a set-state")
+
+	state, err := store.Get("prompt", testShellInstance.Key, "blocking")
+	require.NoError(t, err)
+	require.Equal(t, "new", state, "a set-state wins over an Update() computed from the state before it")
+
+	require.NoError(t, Update(context.Background(), store, Location{Operations: []OperationWrapper{{Operation: &MockBlockingOperation{
+		started: make(chan struct{}), release: closedChannel(),
+	}}}}, "prompt", testShellInstance, "/tmp"))
+	state, err = store.Get("prompt", testShellInstance.Key, "blocking")
+	require.NoError(t, err)
+	require.Equal(t, "new+", state, "without a set-state in between, Update() writes as before")
+}
+
+func closedChannel() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}
+
+type MockConstantAsyncOperation struct {
+	MockAsyncOperation
+}
+
+func (m *MockConstantAsyncOperation) Update(_ context.Context, _ string, state string) (string, error) {
+	return state, nil
+}
+
+func TestRefreshAsyncLeavesOtherOperationsAlone(t *testing.T) {
+	store := NewMemoryStateStore()
+	op := &MockConstantAsyncOperation{}
+	config := Location{
+		Operations: []OperationWrapper{
+			{Operation: mustConfiguredCycle(t, "nyan", "nyan1", "nyan2")},
+			{Operation: op},
+		},
+	}
+
+	changed, err := RefreshAsync(context.Background(), store, config, "prompt", testShellInstance, "/tmp")
+	require.NoError(t, err)
+	require.True(t, changed, "nothing was cached before")
+	require.Equal(t, 1, op.generated)
+
+	nyan, err := store.Get("prompt", testShellInstance.Key, "nyan")
+	require.NoError(t, err)
+	require.Equal(t, "", nyan, "cycle state must not advance")
+
+	changed, err = RefreshAsync(context.Background(), store, config, "prompt", testShellInstance, "/tmp")
+	require.NoError(t, err)
+	require.False(t, changed, "same result as before")
+	require.Equal(t, 2, op.generated)
+}
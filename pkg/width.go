@@ -0,0 +1,107 @@
+package pkg
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/width"
+)
+
+// runeWidth is how many terminal cells r takes up: 2 for East Asian wide
+// and fullwidth characters (which include most emoji) and for memes (see
+// MemeCodepointBase), 0 for combining marks, format and control characters,
+// and 1 for everything else, ambiguous-width characters included.
+func runeWidth(r rune) int {
+	switch {
+	case r >= MemeCodepointBase && r < MemeCodepointBase+MemeCodepointCount:
+		return 2
+	case r == 0x200d || unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf, unicode.Cc):
+		return 0
+	}
+	switch width.LookupRune(r).Kind() {
+	case width.EastAsianWide, width.EastAsianFullwidth:
+		return 2
+	}
+	return 1
+}
+
+// displayWidth is how many terminal cells s takes up.
+func displayWidth(s string) int {
+	total := 0
+	for _, r := range s {
+		total += runeWidth(r)
+	}
+	return total
+}
+
+// truncateWidth cuts s to at most n cells, ending it in "…" if anything was
+// cut. A wide character that would straddle the limit is dropped whole.
+func truncateWidth(s string, n int) string {
+	if n <= 0 {
+		return ""
+	}
+	if displayWidth(s) <= n {
+		return s
+	}
+	used := 0
+	for i, r := range s {
+		w := runeWidth(r)
+		if used+w > n-1 {
+			return s[:i] + "…"
+		}
+		used += w
+	}
+	return s
+}
+
+// ansiEscapeRe matches CSI (e.g. SGR colours) and OSC escape sequences.
+var ansiEscapeRe = regexp.MustCompile(`\x1b\[[0-?]*[ -/]*[@-~]|\x1b\][^\x07\x1b]*(?:\x07|\x1b\\)`)
+
+var bashMarkupRe = regexp.MustCompile("\x01[^\x02]*\x02")
+
+// stripMarkup removes open...close wrapped markup from s and unescapes
+// doubled escape characters, reading left to right so that an escaped
+// escape character followed by open (e.g. tmux's "##[") is left as text.
+func stripMarkup(s string, escape byte, open, close string) string {
+	var out strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == escape && i+1 < len(s) && s[i+1] == escape:
+			out.WriteByte(escape)
+			i++
+		case strings.HasPrefix(s[i:], open):
+			end := strings.Index(s[i+len(open):], close)
+			if end < 0 {
+				return out.String()
+			}
+			i += len(open) + end + len(close) - 1
+		default:
+			out.WriteByte(s[i])
+		}
+	}
+	return out.String()
+}
+
+// visibleWidth is how many cells the widest line of s takes up once the
+// dialect's markup (styles, escapes and zero-width wrappers) is stripped and
+// its escaped characters are unescaped.
+func visibleWidth(d Dialect, s string) int {
+	switch d {
+	case DialectTmux:
+		s = stripMarkup(s, '#', "#[", "]")
+	case DialectZsh:
+		s = stripMarkup(s, '%', "%{", "%}")
+	case DialectBash:
+		s = bashMarkupRe.ReplaceAllString(s, "")
+	}
+	s = ansiEscapeRe.ReplaceAllString(s, "")
+
+	widest := 0
+	for _, line := range strings.Split(s, "\n") {
+		if w := displayWidth(line); w > widest {
+			widest = w
+		}
+	}
+	return widest
+}
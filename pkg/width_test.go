@@ -0,0 +1,49 @@
+package pkg
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDisplayWidth(t *testing.T) {
+	meme := string(rune(MemeCodepointBase + 3))
+	tests := map[string]int{
+		"":          0,
+		"main":      4,
+		"日本語":       6,
+		"ｆｕｌｌ":      8,
+		"🚀 ok":      5,
+		"é":        1, // e + combining acute
+		meme + meme: 4,
+		"\x1b":      0,
+		"ß→±":       3, // ambiguous counts as narrow
+		"👩‍💻":       4,
+		string(rune(MemeCodepointBase + MemeCodepointCount)): 1,
+	}
+	for s, want := range tests {
+		require.Equal(t, want, displayWidth(s), "%q", s)
+	}
+}
+
+func TestTruncateWidth(t *testing.T) {
+	meme := string(rune(MemeCodepointBase))
+	require.Equal(t, "日本…", truncateWidth("日本語です", 5))
+	require.Equal(t, "日…", truncateWidth("日本語です", 4), "a wide character straddling the limit is dropped")
+	require.Equal(t, "日本語", truncateWidth("日本語", 6))
+	require.Equal(t, meme+"…", truncateWidth(meme+meme+meme, 4))
+	require.Equal(t, "…", truncateWidth("日本語", 1))
+}
+
+func TestWidthAwareTemplateFuncs(t *testing.T) {
+	require.Equal(t, "日本… |  日本|日本  |6", renderDialect(t, DialectPlain, `{{ "日本語です" | truncate 5 | padRight 6 }}|{{ "日本" | padLeft 6 }}|{{ "日本" | padRight 6 }}|{{ width "日本語" }}`))
+}
+
+func TestVisibleWidth(t *testing.T) {
+	require.Equal(t, 7, visibleWidth(DialectTmux, "#[fg=red]main#[default] ##1"))
+	require.Equal(t, 4, visibleWidth(DialectTmux, "##[x]"), "an escaped # isn't the start of a style")
+	require.Equal(t, 6, visibleWidth(DialectZsh, "%{\x1b[31m%}main%{\x1b[0m%} %%"))
+	require.Equal(t, 4, visibleWidth(DialectBash, "\x01\x1b[31m\x02main\x01\x1b[0m\x02"))
+	require.Equal(t, 4, visibleWidth(DialectFish, "\x1b[38;5;208mmain\x1b[0m"))
+	require.Equal(t, 6, visibleWidth(DialectPlain, "ab\n日本語"), "the widest line counts")
+}
@@ -0,0 +1,171 @@
+package pkg
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// WorkingDirectoryResult is the location path shortened several ways,
+// exposed to templates as .working_directory so they can pick one. Printing
+// it directly ({{ .working_directory }}) gives Path.
+type WorkingDirectoryResult struct {
+	// Path has the home directory replaced by ~ and named directories by
+	// their names.
+	Path string
+	// Full is the path as given.
+	Full string
+	// Fish is Path with every component but the first and last cut to
+	// fish_length characters, like fish's prompt_pwd: ~/s/g/p/repo.
+	Fish string
+	// Truncated is Path cut to max_length terminal cells with an ellipsis in
+	// the middle, or Path itself if it fits or max_length isn't set.
+	Truncated string
+	// RepoName is the base name of the enclosing git work tree and
+	// RepoRelative the path within it ("." at its root). Both are "" outside
+	// a repository.
+	RepoName     string
+	RepoRelative string
+}
+
+func (r WorkingDirectoryResult) String() string {
+	return r.Path
+}
+
+// namedDir substitutes name for path at the start of working directories.
+type namedDir struct {
+	path string
+	name string
+}
+
+// substitutePrefix replaces prefix with replacement in path if path is
+// prefix or lies below it.
+func substitutePrefix(path, prefix, replacement string) (string, bool) {
+	if path == prefix {
+		return replacement, true
+	}
+	if strings.HasPrefix(path, strings.TrimSuffix(prefix, "/")+"/") {
+		return replacement + path[len(strings.TrimSuffix(prefix, "/")):], true
+	}
+	return path, false
+}
+
+// shortenPath applies named directories (longest first) and then the home
+// directory.
+func shortenPath(path, homeDir string, namedDirs []namedDir) string {
+	for _, named := range namedDirs {
+		if shortened, ok := substitutePrefix(path, named.path, named.name); ok {
+			return shortened
+		}
+	}
+	if homeDir != "" {
+		if shortened, ok := substitutePrefix(path, homeDir, "~"); ok {
+			return shortened
+		}
+	}
+	return path
+}
+
+// fishPath abbreviates every component of path but the first and last to
+// length characters, keeping the leading dot of hidden directories.
+func fishPath(path string, length int) string {
+	components := strings.Split(path, "/")
+	for i := 1; i < len(components)-1; i++ {
+		component := []rune(components[i])
+		keep := length
+		if len(component) > 0 && component[0] == '.' {
+			keep++
+		}
+		if len(component) > keep {
+			components[i] = string(component[:keep])
+		}
+	}
+	return strings.Join(components, "/")
+}
+
+// truncateMiddle cuts s to at most max cells (see displayWidth) by replacing
+// its middle with an ellipsis. A wide character that would straddle either
+// side is dropped whole.
+func truncateMiddle(s string, max int) string {
+	if max <= 0 || displayWidth(s) <= max {
+		return s
+	}
+	if max == 1 {
+		return "…"
+	}
+	runes := []rune(s)
+	keep := max - 1
+	headWidth := keep / 2
+	tailWidth := keep - headWidth
+
+	head, used := 0, 0
+	for head < len(runes) && used+runeWidth(runes[head]) <= headWidth {
+		used += runeWidth(runes[head])
+		head++
+	}
+	tail, used := len(runes), 0
+	for tail > head && used+runeWidth(runes[tail-1]) <= tailWidth {
+		used += runeWidth(runes[tail-1])
+		tail--
+	}
+	return string(runes[:head]) + "…" + string(runes[tail:])
+}
+
+// parseNamedDirs reads `named_dirs`, a list of {path, name} entries (a list
+// rather than a map because viper lowercases map keys). Paths may start
+// with ~. They're returned longest first so the most specific one wins.
+func parseNamedDirs(raw interface{}, homeDir string) ([]namedDir, error) {
+	list, ok := raw.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("working_directory: named_dirs must be a list")
+	}
+	namedDirs := make([]namedDir, 0, len(list))
+	for _, entryRaw := range list {
+		entry, ok := entryRaw.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("working_directory: named_dirs entries must have a path and a name")
+		}
+		path, pathOK := entry["path"].(string)
+		name, nameOK := entry["name"].(string)
+		if !pathOK || !nameOK || path == "" {
+			return nil, fmt.Errorf("working_directory: named_dirs entries must have a path and a name")
+		}
+		if expanded, ok := substitutePrefix(path, "~", homeDir); ok && homeDir != "" {
+			path = expanded
+		}
+		namedDirs = append(namedDirs, namedDir{path: filepath.Clean(path), name: name})
+	}
+	sort.SliceStable(namedDirs, func(i, j int) bool {
+		return len(namedDirs[i].path) > len(namedDirs[j].path)
+	})
+	return namedDirs, nil
+}
+
+func workingDirectory(path, homeDir string, namedDirs []namedDir, fishLength, maxLength int) WorkingDirectoryResult {
+	path = filepath.Clean(path)
+	shortened := shortenPath(path, homeDir, namedDirs)
+	result := WorkingDirectoryResult{
+		Path:      shortened,
+		Full:      path,
+		Fish:      fishPath(shortened, fishLength),
+		Truncated: truncateMiddle(shortened, maxLength),
+	}
+
+	if workTree, _, err := findGitDir(path); err == nil {
+		if relative, err := filepath.Rel(workTree, path); err == nil {
+			result.RepoName = filepath.Base(workTree)
+			result.RepoRelative = relative
+		}
+	}
+	return result
+}
+
+func userHomeDir() string {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Clean(homeDir)
+}
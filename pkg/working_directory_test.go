@@ -0,0 +1,74 @@
+package pkg
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWorkingDirectoryShortening(t *testing.T) {
+	namedDirs, err := parseNamedDirs([]interface{}{
+		map[string]interface{}{"path": "~/src/github.com", "name": "gh:"},
+		map[string]interface{}{"path": "~/src/github.com/pj", "name": "pj:"},
+	}, "/home/pj")
+	require.NoError(t, err)
+
+	result := workingDirectory("/home/pj/src/github.com/pj/commandline_thing/pkg", "/home/pj", namedDirs, 1, 0)
+	require.Equal(t, "pj:/commandline_thing/pkg", result.Path, "the longest named directory wins")
+	require.Equal(t, "pj:/c/pkg", result.Fish)
+	require.Equal(t, result.Path, result.Truncated)
+	require.Equal(t, "/home/pj/src/github.com/pj/commandline_thing/pkg", result.Full)
+
+	result = workingDirectory("/home/pj/.config/nvim/lua", "/home/pj", nil, 1, 10)
+	require.Equal(t, "~/.config/nvim/lua", result.Path)
+	require.Equal(t, "~/.c/n/lua", result.Fish)
+	require.Equal(t, "~/.c…m/lua", result.Truncated)
+
+	result = workingDirectory("/home/pjx/work", "/home/pj", nil, 2, 0)
+	require.Equal(t, "/home/pjx/work", result.Path, "a sibling of home that shares its prefix isn't under it")
+	require.Equal(t, "/ho/pj/work", result.Fish)
+}
+
+func TestTruncateMiddle(t *testing.T) {
+	require.Equal(t, "abcdef", truncateMiddle("abcdef", 0))
+	require.Equal(t, "abcdef", truncateMiddle("abcdef", 6))
+	require.Equal(t, "ab…ef", truncateMiddle("abcdef", 5))
+	require.Equal(t, "a…f", truncateMiddle("abcdef", 3))
+	require.Equal(t, "…", truncateMiddle("abcdef", 1))
+	require.Equal(t, "~/日…/src", truncateMiddle("~/日本語/プロジェクト/src", 9), "widths are in cells")
+	require.Equal(t, "~/…src", truncateMiddle("~/日本語/プロジェクト/src", 6), "a wide character that doesn't fit is dropped whole")
+}
+
+func TestWorkingDirectoryRepoRelative(t *testing.T) {
+	repo := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(repo, ".git"), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(repo, "pkg", "sub"), 0755))
+
+	result, err := (&WorkingDirectory{}).Generate(context.Background(), "pane", testTmuxInstance, filepath.Join(repo, "pkg", "sub"), "")
+	require.NoError(t, err)
+	wd := result.(WorkingDirectoryResult)
+	require.Equal(t, filepath.Base(repo), wd.RepoName)
+	require.Equal(t, filepath.Join("pkg", "sub"), wd.RepoRelative)
+
+	result, err = (&WorkingDirectory{}).Generate(context.Background(), "pane", testTmuxInstance, repo, "")
+	require.NoError(t, err)
+	require.Equal(t, ".", result.(WorkingDirectoryResult).RepoRelative)
+
+	result, err = (&WorkingDirectory{}).Generate(context.Background(), "pane", testTmuxInstance, t.TempDir(), "")
+	require.NoError(t, err)
+	require.Empty(t, result.(WorkingDirectoryResult).RepoName)
+}
+
+func TestWorkingDirectoryConfigure(t *testing.T) {
+	op := &WorkingDirectory{}
+	require.NoError(t, op.Configure(map[string]interface{}{"fish_length": 2, "max_length": 20}))
+	require.Equal(t, 2, op.fishLength)
+	require.Equal(t, 20, op.maxLength)
+
+	require.Error(t, op.Configure(map[string]interface{}{"max_length": "20"}))
+	require.Error(t, op.Configure(map[string]interface{}{"fish_length": 0}))
+	require.Error(t, op.Configure(map[string]interface{}{"named_dirs": []interface{}{map[string]interface{}{"path": "~/src"}}}))
+}